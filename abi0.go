@@ -0,0 +1,410 @@
+package redefine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+	"unsafe"
+)
+
+// ErrABI0 is returned when a function written in assembly can't be redefined
+// for callers that use its assembly entry point. Nothing is redefined in that
+// case, since only some of the callers would see the change.
+var ErrABI0 = errors.New("the assembly entry point can't be redefined")
+
+// Functions written in assembly use the older stack-based calling convention,
+// ABI0. Go code that calls them directly calls that code, but function values
+// point to a wrapper that the compiler generates to convert from the register
+// based convention, ABIInternal. For every caller to see a redefinition, both
+// need to be redefined. The wrapper can jump to the new function, but the
+// assembly needs an adapter that moves the arguments into registers and the
+// results back to the stack, which is only written with the ABI0Adapter
+// option.
+
+// asmFunc holds the entry points of a function written in assembly.
+type asmFunc struct {
+	// body is the assembly, which takes ABI0 calls.
+	body uintptr
+
+	// wrapper is the ABIInternal wrapper for body, or 0 if the program
+	// doesn't need one.
+	wrapper uintptr
+}
+
+// asmABIPackages can write assembly functions that take ABIInternal calls, from
+// cmd/internal/objabi.
+var asmABIPackages = []string{
+	"runtime",
+	"reflect",
+	"syscall",
+	"internal/bytealg",
+	"internal/chacha8rand",
+	"internal/runtime/syscall/linux",
+	"internal/runtime/syscall/windows",
+	"internal/runtime/startlinetest",
+	"internal/runtime/maps",
+}
+
+// funcFlagAsm is set on functions written in assembly, from internal/abi.
+const funcFlagAsm = 1 << 2
+
+// findAsmFunc returns the entry points of the function at entry if it's an
+// ABI0 assembly function or the wrapper for one. Otherwise it returns the zero
+// value.
+func findAsmFunc(entry uintptr) (asmFunc, error) {
+	info := findfunc(entry)
+	if info._func == nil || info.datap.text+uintptr(info.entryOff) != entry {
+		return asmFunc{}, nil
+	}
+
+	// Most functions are neither, and can be ruled out without looking
+	// anything up.
+	if info.flag&funcFlagAsm == 0 && funcFile(info) != "<autogenerated>" {
+		return asmFunc{}, nil
+	}
+	name := funcName(info)
+
+	// The wrapper has the same name as the assembly.
+	var af asmFunc
+	for _, e := range nameIndexFor(info.datap)[name] {
+		fi := findfunc(e)
+		switch {
+		case fi.flag&funcFlagAsm != 0:
+			af.body = e
+		case funcFile(fi) == "<autogenerated>":
+			af.wrapper = e
+		}
+	}
+	if af.body == 0 || (entry != af.body && entry != af.wrapper) {
+		return asmFunc{}, nil
+	}
+
+	if af.wrapper != 0 {
+		code, err := funcSliceAt(af.wrapper)
+		if err != nil {
+			return asmFunc{}, err
+		}
+		if takesABI0(code, af.body) {
+			// The assembly takes ABIInternal calls and the
+			// wrapper is for callers that use ABI0.
+			return asmFunc{}, nil
+		}
+	} else if slices.Contains(asmABIPackages, funcPackage(name)) {
+		return asmFunc{}, fmt.Errorf("%s: %w: can't tell which calling convention it uses", name, ErrABI0)
+	}
+
+	return af, nil
+}
+
+// abiLayout describes how the arguments and results of a function are passed
+// in registers with ABIInternal, and where they are on the stack with ABI0.
+type abiLayout struct {
+	args, results []abiPart
+
+	// spill is the space the caller reserves for the callee to save the
+	// register arguments.
+	spill uintptr
+
+	// frame is the size of the arguments and results with ABI0.
+	frame uintptr
+}
+
+// abiPart is one register's worth of an argument or result.
+type abiPart struct {
+	// offset is where the part is in the ABI0 frame.
+	offset uintptr
+
+	size uintptr
+
+	// reg is the index of the integer or floating point register the
+	// part is passed in.
+	reg   int
+	float bool
+}
+
+// newABILayout returns the layout of arguments and results for functions of
+// type ft. It's an error if any of them is passed on the stack with
+// ABIInternal, which the adapter doesn't handle.
+func newABILayout(ft reflect.Type) (abiLayout, error) {
+	var l abiLayout
+	ptrSize := unsafe.Sizeof(uintptr(0))
+
+	assign := func(types []reflect.Type, parts *[]abiPart, spill bool) error {
+		a := abiAssigner{parts: parts}
+		for _, t := range types {
+			l.frame = alignUp(l.frame, uintptr(t.Align()))
+			if t.Size() > 0 {
+				if !a.assign(t, l.frame) {
+					return fmt.Errorf("%v is passed on the stack", t)
+				}
+				if spill {
+					l.spill = alignUp(l.spill, uintptr(t.Align())) + t.Size()
+				}
+			}
+			l.frame += t.Size()
+		}
+		l.frame = alignUp(l.frame, ptrSize)
+		return nil
+	}
+
+	in := make([]reflect.Type, ft.NumIn())
+	for i := range in {
+		in[i] = ft.In(i)
+	}
+	out := make([]reflect.Type, ft.NumOut())
+	for i := range out {
+		out[i] = ft.Out(i)
+	}
+
+	if err := assign(in, &l.args, true); err != nil {
+		return abiLayout{}, err
+	}
+	if err := assign(out, &l.results, false); err != nil {
+		return abiLayout{}, err
+	}
+	l.spill = alignUp(l.spill, ptrSize)
+
+	return l, nil
+}
+
+// abiAssigner assigns registers to values, following reflect's abiSeq.
+type abiAssigner struct {
+	parts        *[]abiPart
+	ints, floats int
+}
+
+// assign assigns registers to a value of type t at offset in the ABI0 frame.
+// If there aren't enough registers for the whole value, it returns false and
+// the value goes on the stack.
+func (a *abiAssigner) assign(t reflect.Type, offset uintptr) bool {
+	saved, ints, floats := len(*a.parts), a.ints, a.floats
+	if !a.regAssign(t, offset) {
+		*a.parts = (*a.parts)[:saved]
+		a.ints, a.floats = ints, floats
+		return false
+	}
+	return true
+}
+
+func (a *abiAssigner) regAssign(t reflect.Type, offset uintptr) bool {
+	ptrSize := unsafe.Sizeof(uintptr(0))
+
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Pointer, reflect.UnsafePointer, reflect.Chan, reflect.Map, reflect.Func:
+		return a.intN(offset, t.Size(), 1)
+	case reflect.Float32, reflect.Float64:
+		return a.floatN(offset, t.Size(), 1)
+	case reflect.Complex64:
+		return a.floatN(offset, 4, 2)
+	case reflect.Complex128:
+		return a.floatN(offset, 8, 2)
+	case reflect.String, reflect.Interface:
+		return a.intN(offset, ptrSize, 2)
+	case reflect.Slice:
+		return a.intN(offset, ptrSize, 3)
+	case reflect.Array:
+		switch t.Len() {
+		case 0:
+			return true
+		case 1:
+			return a.regAssign(t.Elem(), offset)
+		default:
+			return false
+		}
+	case reflect.Struct:
+		for i := range t.NumField() {
+			f := t.Field(i)
+			if !a.regAssign(f.Type, offset+f.Offset) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *abiAssigner) intN(offset, size uintptr, n int) bool {
+	if a.ints+n > intArgRegs {
+		return false
+	}
+	for i := range n {
+		*a.parts = append(*a.parts, abiPart{offset: offset + uintptr(i)*size, size: size, reg: a.ints})
+		a.ints++
+	}
+	return true
+}
+
+func (a *abiAssigner) floatN(offset, size uintptr, n int) bool {
+	if a.floats+n > floatArgRegs {
+		return false
+	}
+	for i := range n {
+		*a.parts = append(*a.parts, abiPart{offset: offset + uintptr(i)*size, size: size, reg: a.floats, float: true})
+		a.floats++
+	}
+	return true
+}
+
+func alignUp(n, align uintptr) uintptr {
+	return (n + align - 1) &^ (align - 1)
+}
+
+// checkABI0 returns an error if the assembly at body can't be redefined with
+// functions of type ft.
+func checkABI0(af asmFunc, ft reflect.Type) (abiLayout, error) {
+	info := findfunc(af.body)
+	name := funcName(info)
+
+	l, err := newABILayout(ft)
+	if err != nil {
+		return abiLayout{}, fmt.Errorf("%s: %w: %w", name, ErrABI0, err)
+	}
+	if info.args != argsSizeUnknown && uintptr(info.args) != l.frame {
+		return abiLayout{}, fmt.Errorf("%s: %w: arguments and results take %d bytes, %v takes %d", name, ErrABI0, info.args, ft, l.frame)
+	}
+
+	return l, nil
+}
+
+// loadGFor returns the instructions that load the g register after a call to
+// ABI0 code, copied from the wrapper of the assembly function or from code
+// that's known to call assembly.
+func loadGFor(af asmFunc) ([]byte, error) {
+	if af.wrapper != 0 {
+		if code, err := funcSliceAt(af.wrapper); err == nil {
+			if loadG, err := findLoadG(code); err == nil {
+				return loadG, nil
+			}
+		}
+	}
+	return referenceLoadG()
+}
+
+// referenceLoadG finds the code to load the g register in bytes.IndexByte,
+// which calls assembly in internal/bytealg.
+var referenceLoadG = sync.OnceValues(func() ([]byte, error) {
+	code, err := funcSlice(bytes.IndexByte)
+	if err != nil {
+		return nil, err
+	}
+	return findLoadG(code)
+})
+
+// cloneAsmWrapper copies the wrapper for an assembly function and makes a copy
+// of the assembly for it to call, so Original keeps working after both are
+// redefined. The copy of the assembly is stored in redefined.
+//
+// The caller must hold mu.
+func cloneAsmWrapper[T any](fn T, code []byte, body uintptr) (*clonedFunc[T], error) {
+	bodyFn := funcAt(body)
+	bodyClone, err := detourFunc(bodyFn)
+	if err != nil {
+		bodyClone, err = cloneFunc(bodyFn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to clone assembly function: %w", err)
+	}
+	copied, _ := bodyClone.copied()
+	bodyCopy := uintptr(unsafe.Pointer(unsafe.SliceData(copied)))
+
+	entry := reflect.ValueOf(fn).Pointer()
+	alloc := allocatorFor(entry)
+	alloc.BeginMutate()
+	defer alloc.EndMutate()
+
+	wrapperCopy, err := copyCode(alloc, code, func(_ []byte, target uintptr) uintptr {
+		if target == body {
+			return bodyCopy
+		}
+		return target
+	})
+	if err != nil {
+		bodyClone.Free()
+		return nil, err
+	}
+
+	cf := clonedFunc[T]{
+		clonedCode:   wrapperCopy,
+		alloc:        alloc,
+		originalCode: bytes.Clone(code),
+		companion:    body,
+		name:         symbolName(entry),
+	}
+	cf.Func, cf.ref = makeFunc[T](wrapperCopy)
+
+	bodyClone.companion = entry
+	redefined[body] = bodyClone
+
+	return &cf, nil
+}
+
+// addABI0Adapter writes an adapter that takes ABI0 calls and calls newFn, and
+// returns its address. The adapter and newFn are kept until the cloned
+// function is freed.
+//
+// The caller must hold mu.
+func (cf *clonedFunc[T]) addABI0Adapter(newFn any, l abiLayout, loadG []byte) (uintptr, error) {
+	fv := uintptr((*[2]unsafe.Pointer)(unsafe.Pointer(&newFn))[1])
+	code, err := abi0Adapter(l, fv, loadG)
+	if err != nil {
+		return 0, err
+	}
+
+	addr, err := cf.addTrampoline(len(code), func(buf []byte) error {
+		copy(buf, code)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	cf.closures = append(cf.closures, newFn)
+	return addr, nil
+}
+
+// companionEntry returns the other entry point of an assembly function that
+// was redefined along with this one, or 0.
+func (cf *clonedFunc[T]) companionEntry() uintptr {
+	return cf.companion
+}
+
+// entryPatcher is implemented by clonedFunc for any type.
+type entryPatcher interface {
+	patchedCode
+	patch(code []byte, dest uintptr) error
+	setWritten(code []byte)
+	addClosure(newFn any) (uintptr, error)
+	addABI0Adapter(newFn any, l abiLayout, loadG []byte) (uintptr, error)
+}
+
+// setWritten records the code at the entry point after a patch.
+func (cf *clonedFunc[T]) setWritten(code []byte) {
+	cf.patched = bytes.Clone(code)
+}
+
+// patchEntry writes a jump to dest at the entry point of a function that was
+// cloned. Use verifyPatch first.
+//
+// The caller must hold mu.
+func patchEntry(code []byte, ep entryPatcher, dest uintptr) error {
+	err := mprotect(code, mprotectRWX)
+	if err != nil {
+		return fmt.Errorf("mprotect: %w", err)
+	}
+	defer mprotect(code, mprotectRX)
+
+	err = ep.patch(code, dest)
+	if err != nil {
+		return err
+	}
+	ep.setWritten(code)
+
+	cacheflush(code)
+	return nil
+}
@@ -0,0 +1,142 @@
+package redefine
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/pboyd/redefine/internal/buildtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewABILayout(t *testing.T) {
+	l, err := newABILayout(reflect.TypeFor[func(int8, float64, string) (bool, error)]())
+	require.NoError(t, err)
+
+	assert.Equal(t, []abiPart{
+		{offset: 0, size: 1, reg: 0},
+		{offset: 8, size: 8, reg: 0, float: true},
+		{offset: 16, size: 8, reg: 1},
+		{offset: 24, size: 8, reg: 2},
+	}, l.args)
+	assert.Equal(t, []abiPart{
+		{offset: 32, size: 1, reg: 0},
+		{offset: 40, size: 8, reg: 1},
+		{offset: 48, size: 8, reg: 2},
+	}, l.results)
+	assert.Equal(t, uintptr(32), l.spill)
+	assert.Equal(t, uintptr(56), l.frame)
+
+	// Arrays with more than one element always go on the stack.
+	_, err = newABILayout(reflect.TypeFor[func([2]int)]())
+	assert.ErrorContains(t, err, "passed on the stack")
+}
+
+func TestFindAsmFunc(t *testing.T) {
+	entry, ok := funcByName("math.archFloor")
+	require.True(t, ok)
+
+	af, err := findAsmFunc(entry)
+	require.NoError(t, err)
+	assert.Equal(t, entry, af.body)
+
+	af, err = findAsmFunc(reflect.ValueOf(math.Floor).Pointer())
+	require.NoError(t, err)
+	assert.Zero(t, af)
+}
+
+func TestPackage_Assembly(t *testing.T) {
+	// math.Floor calls the assembly directly, and there's no wrapper.
+	floor := math.Floor
+
+	_, err := Package("math", map[string]any{
+		"archFloor": func(x float64) float64 { return x * 10 },
+	})
+	assert.ErrorIs(t, err, ErrABI0)
+	assert.Equal(t, 1.0, floor(1.5))
+
+	restore, err := Package("math", map[string]any{
+		"archFloor": func(x float64) float64 { return x * 10 },
+	}, ABI0Adapter())
+	if runtime.GOARCH != "amd64" {
+		assert.ErrorIs(t, err, ErrABI0)
+		assert.Equal(t, 1.0, floor(1.5))
+		return
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() { restore() })
+
+	assert.Equal(t, 15.0, floor(1.5))
+	assert.NoError(t, Verify())
+
+	require.NoError(t, restore())
+	assert.Equal(t, 1.0, floor(1.5))
+}
+
+func TestUnsafeFunc_AssemblyClosure(t *testing.T) {
+	entry, ok := funcByName("math.archFloor")
+	require.True(t, ok)
+
+	newFn := func(x float64) float64 { return x * 10 }
+	err := unsafeFunc(funcAt(entry), newFn, true, options{})
+	assert.ErrorIs(t, err, ErrABI0)
+
+	mu.RLock()
+	_, ok = redefined[entry]
+	mu.RUnlock()
+	assert.False(t, ok)
+	assert.Equal(t, 1.0, math.Floor(1.5))
+}
+
+// TestFunc_Assembly runs testdata/asmfunc, which redefines an assembly function
+// that Go code calls both directly and through the wrapper.
+func TestFunc_Assembly(t *testing.T) {
+	buildtest.BuildAndRun(t, "./testdata/asmfunc")
+}
+
+// TestRedirectABI0_Undo puts back redirected assembly, as Func does when the
+// wrapper can't be patched after it.
+func TestRedirectABI0_Undo(t *testing.T) {
+	if !abi0Adapters {
+		t.Skip("no ABI0 adapters on " + runtime.GOARCH)
+	}
+
+	// math.Floor calls the assembly directly.
+	floor := math.Floor
+
+	entry, ok := funcByName("math.archFloor")
+	require.True(t, ok)
+	af, err := findAsmFunc(entry)
+	require.NoError(t, err)
+
+	newFn := func(x float64) float64 { return x * 10 }
+	layout, err := checkABI0(af, reflect.TypeOf(newFn))
+	require.NoError(t, err)
+	loadG, err := loadGFor(af)
+	require.NoError(t, err)
+
+	code, err := funcSliceAt(entry)
+	require.NoError(t, err)
+	original := bytes.Clone(code)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	cloned, err := cloneFunc(funcAt(entry))
+	require.NoError(t, err)
+	redefined[entry] = cloned
+	defer forget(entry)
+
+	undo, err := redirectABI0(entry, newFn, layout, loadG)
+	require.NoError(t, err)
+	assert.Equal(t, 15.0, floor(1.5))
+	assert.NotNil(t, cloned.written())
+
+	require.NoError(t, undo())
+	assert.Equal(t, 1.0, floor(1.5))
+	assert.Equal(t, original, code)
+	assert.Nil(t, cloned.written())
+}
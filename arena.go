@@ -0,0 +1,210 @@
+package redefine
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"syscall"
+	"unsafe"
+
+	"github.com/pboyd/malloc"
+)
+
+// arenaWordSize is the granularity of allocations in a malloc.Arena. Free
+// blocks start with a header of this size.
+const arenaWordSize = 16
+
+// arena is one reserved block of memory for cloned functions.
+type arena struct {
+	*malloc.Arena
+
+	backend  *malloc.VirtReservationBackend
+	protect  func(int) error
+	reserved uintptr
+
+	// allocs maps the address of every allocation to its size, rounded up
+	// to arenaWordSize.
+	allocs map[uintptr]uintptr
+
+	// discarded holds the committed pages that were handed back to the OS
+	// because nothing was allocated in them.
+	discarded map[uintptr]struct{}
+}
+
+// newArena reserves size bytes near datap and commits enough of it to hold
+// startSize bytes.
+func newArena(datap *moduledata, size uintptr, startSize int) (*arena, error) {
+	be, err := initMallocBackend(datap, size)
+	if err != nil {
+		return nil, err
+	}
+	return newArenaAt(be, size, startSize)
+}
+
+// newArenaAt makes an arena from be, which reserved size bytes, and commits
+// enough of it to hold startSize bytes.
+func newArenaAt(be *malloc.VirtReservationBackend, size uintptr, startSize int) (*arena, error) {
+	// The first word of the arena is used by malloc.
+	ma := malloc.NewArena(uint64(startSize+arenaWordSize), malloc.Backend(be))
+	if ma == nil {
+		be.Release()
+		return nil, errors.New("unable to initialize arena")
+	}
+
+	return &arena{
+		Arena:     ma,
+		backend:   be,
+		protect:   mprotectHook(be.Protect),
+		reserved:  size,
+		allocs:    map[uintptr]uintptr{},
+		discarded: map[uintptr]struct{}{},
+	}, nil
+}
+
+// allocate returns size bytes from the arena. The error wraps
+// malloc.ErrOutOfMemory if the reservation is full.
+func (ar *arena) allocate(size int) ([]byte, error) {
+	buf, err := malloc.MallocSlice[byte](ar.Arena, size)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := uintptr(unsafe.Pointer(unsafe.SliceData(buf)))
+	rounded := (uintptr(size) + arenaWordSize - 1) &^ (arenaWordSize - 1)
+	ar.allocs[addr] = rounded
+
+	pageSize := uintptr(syscall.Getpagesize())
+	for page := addr &^ (pageSize - 1); page < addr+rounded; page += pageSize {
+		delete(ar.discarded, page)
+	}
+
+	return buf, nil
+}
+
+// free returns buf to the arena, and hands any pages that are now completely
+// free back to the OS.
+func (ar *arena) free(buf []byte) {
+	addr := uintptr(unsafe.Pointer(unsafe.SliceData(buf)))
+	malloc.FreeSlice(ar.Arena, buf)
+	delete(ar.allocs, addr)
+
+	start, end := ar.freeBlock(addr)
+
+	// The free block starts with a header that malloc uses to track it, so
+	// that page has to stay.
+	pageSize := uintptr(syscall.Getpagesize())
+	start = (start + arenaWordSize + pageSize - 1) &^ (pageSize - 1)
+	end &^= pageSize - 1
+	if start >= end {
+		return
+	}
+
+	// Not fatal if this doesn't work, the pages just stay committed.
+	p := unsafe.Add(unsafe.Pointer(unsafe.SliceData(buf)), int(start)-int(addr))
+	err := discardPages(unsafe.Slice((*byte)(p), end-start))
+	if err != nil {
+		return
+	}
+	for page := start; page < end; page += pageSize {
+		ar.discarded[page] = struct{}{}
+	}
+}
+
+// freeBlock returns the bounds of the free block that contains addr.
+func (ar *arena) freeBlock(addr uintptr) (start, end uintptr) {
+	base := ar.backend.Addr()
+
+	// Skip the empty block malloc keeps at the start.
+	start = base + arenaWordSize
+	end = base + uintptr(ar.Size())
+
+	for a, size := range ar.allocs {
+		if a+size <= addr && a+size > start {
+			start = a + size
+		}
+		if a > addr && a < end {
+			end = a
+		}
+	}
+
+	return start, end
+}
+
+// release frees the reservation. The arena can't be used afterwards.
+func (ar *arena) release() error {
+	return ar.backend.Release()
+}
+
+// stats returns statistics for the arena.
+func (ar *arena) stats() ArenaStats {
+	pageSize := uintptr(syscall.Getpagesize())
+	size := uintptr(ar.Size())
+	free := uintptr(ar.FreeBytes())
+
+	s := ArenaStats{
+		Addr:      ar.backend.Addr(),
+		Reserved:  ar.reserved,
+		Committed: size,
+		Discarded: uintptr(len(ar.discarded)) * pageSize,
+		InUse:     uintptr(ar.Cap()) - free,
+	}
+
+	// The free blocks are the gaps between the allocations, after the
+	// word malloc keeps at the start.
+	var largest uintptr
+	end := s.Addr + arenaWordSize
+	for _, addr := range slices.Sorted(maps.Keys(ar.allocs)) {
+		largest = max(largest, addr-end)
+		end = addr + ar.allocs[addr]
+	}
+	largest = max(largest, s.Addr+size-end)
+	if free > 0 {
+		s.Fragmentation = 1 - float64(min(largest, free))/float64(free)
+	}
+
+	return s
+}
+
+// ArenaStats describes one block of memory that holds cloned functions and
+// trampolines.
+type ArenaStats struct {
+	// Addr is the start of the block.
+	Addr uintptr
+
+	// Reserved is the amount of address space set aside for the arena.
+	Reserved uintptr
+
+	// Committed is the part of the reservation that's been committed for
+	// use.
+	Committed uintptr
+
+	// Discarded is the part of Committed in pages that nothing is
+	// allocated in, which were handed back to the OS. The OS can use the
+	// memory elsewhere until they're touched again, but on Windows they
+	// still count against the commit limit.
+	Discarded uintptr
+
+	// InUse is the amount of memory allocated to functions and
+	// trampolines.
+	InUse uintptr
+
+	// Fragmentation is the fraction of free memory that isn't part of the
+	// largest free block. 0 means the free memory is contiguous.
+	Fragmentation float64
+}
+
+// Arenas returns statistics for every arena that currently holds cloned
+// functions. Arenas are added when existing ones fill up, and released when
+// they're empty.
+func Arenas() []ArenaStats {
+	stats := cloneAllocator.stats()
+
+	moduleAllocatorsMu.Lock()
+	defer moduleAllocatorsMu.Unlock()
+
+	for _, a := range moduleAllocators {
+		stats = append(stats, a.stats()...)
+	}
+
+	return stats
+}
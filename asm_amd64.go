@@ -3,7 +3,6 @@ package redefine
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"math"
@@ -23,6 +22,12 @@ const (
 const idealCloneDistance = 0
 const maxCloneDistance = math.MaxInt32
 
+// codePadding fills the space between functions.
+const codePadding = opcodeINT3
+
+// pcQuantum is the size of the smallest instruction.
+const pcQuantum = 1
+
 func insertJump(buf []byte, dest uintptr) error {
 	const instructionSize = 5 // 1 byte opcode + 4 byte address
 
@@ -36,9 +41,13 @@ func insertJump(buf []byte, dest uintptr) error {
 	// Address to jump from
 	src := uintptr(unsafe.Pointer(unsafe.SliceData(buf))) + instructionSize
 
+	diff := int64(dest) - int64(src)
+	if diff < math.MinInt32 || diff > math.MaxInt32 {
+		return insertAbsJump(buf, dest)
+	}
+
 	buf[0] = opcodeJMP
-	diff32 := int32(dest - src)
-	binary.LittleEndian.PutUint32(buf[1:], uint32(diff32))
+	binary.LittleEndian.PutUint32(buf[1:], uint32(int32(diff)))
 
 	// Pad the rest of the buffer with INT3 opcodes to match what the compiler does
 	for i := instructionSize; i < len(buf); i++ {
@@ -48,12 +57,64 @@ func insertJump(buf []byte, dest uintptr) error {
 	return nil
 }
 
+// insertAbsJump writes a jump to an address that's out of range for JMP
+// rel32, which happens when dest is in a different module.
+func insertAbsJump(buf []byte, dest uintptr) error {
+	const instructionSize = 14 // JMP [RIP+0] followed by the address
+
+	if len(buf) < instructionSize {
+		return fmt.Errorf("%w: jump target 0x%x is too far away and the function is too small for an absolute jump", errAddressOutOfRange, dest)
+	}
+
+	copy(buf, []byte{0xff, 0x25, 0, 0, 0, 0})
+	binary.LittleEndian.PutUint64(buf[6:], uint64(dest))
+
+	for i := instructionSize; i < len(buf); i++ {
+		buf[i] = opcodeINT3
+	}
+
+	return nil
+}
+
+// Size of the code written by writeClosureTrampoline.
+const closureTrampolineSize = 24
+
+// writeClosureTrampoline writes code to buf that calls a closure. ctx is the
+// address of the closure's funcval, which goes in the context register (DX),
+// and code is its entry point.
+func writeClosureTrampoline(buf []byte, ctx, code uintptr) error {
+	if len(buf) < closureTrampolineSize {
+		return errors.New("buffer too small for closure trampoline")
+	}
+
+	// MOVQ $ctx, DX
+	buf[0] = 0x48
+	buf[1] = 0xba
+	binary.LittleEndian.PutUint64(buf[2:], uint64(ctx))
+
+	// JMP [RIP+0], followed by the address
+	copy(buf[10:], []byte{0xff, 0x25, 0, 0, 0, 0})
+	binary.LittleEndian.PutUint64(buf[16:], uint64(code))
+
+	return nil
+}
+
 // relocateFunc copies machine instructions from src into dest translating
 // relative instructions as it goes. dest must be at least as large as src.
 //
+// Branches to addresses inside src are kept inside dest. If resolve is not
+// nil, it's called with the target of every call or jump that leaves src,
+// including recursive calls, and returns the address to use instead.
+//
 // The data underlying the slices is assumed to be the same address the code
 // would execute from.
-func relocateFunc(src, dest []byte) ([]byte, error) {
+func relocateFunc(src, dest []byte, resolve func(uintptr) uintptr) ([]byte, error) {
+	return relocateFuncAt(src, uintptr(unsafe.Pointer(unsafe.SliceData(src))), dest, resolve)
+}
+
+// relocateFuncAt is relocateFunc for a copy of a function that was originally
+// at srcAddr.
+func relocateFuncAt(src []byte, srcAddr uintptr, dest []byte, resolve func(uintptr) uintptr) ([]byte, error) {
 	dest = dest[:len(src)]
 
 	for i := 0; i < len(src); {
@@ -65,7 +126,7 @@ func relocateFunc(src, dest []byte) ([]byte, error) {
 		copy(dest[i:], src[i:i+instruction.Len])
 
 		if instruction.PCRel > 0 {
-			err = fixPCRelAddress(instruction, src[i:i+instruction.Len], dest[i:i+instruction.Len])
+			err = fixPCRelAddress(instruction, src, srcAddr, dest, i, resolve)
 			if err != nil {
 				return nil, err
 			}
@@ -77,19 +138,36 @@ func relocateFunc(src, dest []byte) ([]byte, error) {
 	return dest, nil
 }
 
-func fixPCRelAddress(inst x86asm.Inst, src, dest []byte) error {
-	srcPC := uintptr(unsafe.Pointer(unsafe.SliceData(src))) + uintptr(len(src))
-	destPC := uintptr(unsafe.Pointer(unsafe.SliceData(dest))) + uintptr(len(dest))
+// fixPCRelAddress adjusts the relative address of the instruction at offset
+// in src, which started at srcStart, so that it still refers to the same
+// target from dest.
+func fixPCRelAddress(inst x86asm.Inst, src []byte, srcStart uintptr, dest []byte, offset int, resolve func(uintptr) uintptr) error {
+	srcPC := srcStart + uintptr(offset+inst.Len)
+	destPC := uintptr(unsafe.Pointer(unsafe.SliceData(dest))) + uintptr(offset+inst.Len)
 
 	switch inst.PCRel {
 	case 4:
-		disp := int32(binary.LittleEndian.Uint32(src[inst.PCRelOff:]))
-		newDisp := (int64(srcPC) + int64(disp)) - int64(destPC)
+		disp := int32(binary.LittleEndian.Uint32(src[offset+inst.PCRelOff:]))
+		target := uintptr(int64(srcPC) + int64(disp))
+
+		// A call to the start of the function is recursion, which
+		// goes through the normal entry point. Anything else that's
+		// local to the function has the same displacement in the copy.
+		local := target >= srcStart && target < srcStart+uintptr(len(src))
+		if local && (inst.Op != x86asm.CALL || target != srcStart) {
+			return nil
+		}
+
+		if resolve != nil && (inst.Op == x86asm.CALL || inst.Op == x86asm.JMP) {
+			target = resolve(target)
+		}
+
+		newDisp := int64(target) - int64(destPC)
 		if newDisp < math.MinInt32 || newDisp > math.MaxInt32 {
-			return fmt.Errorf("error at address srcPC=0x%x destPC=0x%x: unable to translate relative address (%d overflows int32)", srcPC, destPC, newDisp)
+			return fmt.Errorf("%w: error at address srcPC=0x%x destPC=0x%x: unable to translate relative address (%d overflows int32)", errAddressOutOfRange, srcPC, destPC, newDisp)
 		}
 
-		binary.LittleEndian.PutUint32(dest[inst.PCRelOff:], uint32(newDisp))
+		binary.LittleEndian.PutUint32(dest[offset+inst.PCRelOff:], uint32(newDisp))
 	case 1:
 		// Ignore 1-byte relative addresses because their most likely jumps inside the function.
 	default:
@@ -99,20 +177,444 @@ func fixPCRelAddress(inst x86asm.Inst, src, dest []byte) error {
 	return nil
 }
 
-func disassemble(code []byte) (string, error) {
-	var buf bytes.Buffer
+// minJumpSize is the fewest bytes insertJump writes.
+const minJumpSize = 5
 
-	baseAddr := uintptr(unsafe.Pointer(unsafe.SliceData(code)))
+// absJumpSize is the most bytes insertJump writes.
+const absJumpSize = 14
 
+// detourPrologue finds the instructions at the start of code that a jump will
+// overwrite, and checks that they can run from somewhere else. It returns
+// their length and the offsets of jumps later in code that go back to the
+// start of the function, like the one after runtime.morestack. Those need to
+// go to the moved prologue instead.
+func detourPrologue(code []byte) (int, []int, error) {
+	n := 0
+	for n < minJumpSize {
+		inst, err := x86asm.Decode(code[n:], 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("decode error at offset %d: %w", n, err)
+		}
+
+		// A call would leave a return address outside the function,
+		// which the runtime can't unwind.
+		if inst.Op == x86asm.CALL {
+			return 0, nil, fmt.Errorf("call at offset %d in the prologue", n)
+		}
+		n += inst.Len
+	}
+
+	var backJumps []int
 	for i := 0; i < len(code); {
-		instruction, err := x86asm.Decode(code[i:], 64)
+		inst, err := x86asm.Decode(code[i:], 64)
 		if err != nil {
-			return "", fmt.Errorf("decode error at offset %d: %w", i, err)
+			return 0, nil, fmt.Errorf("decode error at offset %d: %w", i, err)
+		}
+
+		rel, ok := inst.Args[0].(x86asm.Rel)
+		if ok && inst.Op != x86asm.CALL {
+			target := i + inst.Len + int(rel)
+			if target >= 0 && target < n {
+				// Only a 32-bit jump can be pointed at the moved
+				// prologue.
+				if target != 0 || i < n || inst.PCRel != 4 {
+					return 0, nil, fmt.Errorf("branch at offset %d into the prologue", i)
+				}
+				backJumps = append(backJumps, i)
+			}
 		}
-		fmt.Fprintf(&buf, "0x%08x\t%-20s\t%s\n", baseAddr+uintptr(i), hex.EncodeToString(code[i:i+instruction.Len]), instruction.String())
 
+		i += inst.Len
+	}
+
+	return n, backJumps, nil
+}
+
+// detourSize returns the largest buffer writeDetour could need for a prologue
+// of n bytes.
+func detourSize(n int) int {
+	// Short branches grow from 2 bytes to 6.
+	return 3*n + absJumpSize
+}
+
+// writeDetour copies the first n bytes of code into dest, followed by a jump
+// to the rest of code. It returns the part of dest that was used.
+func writeDetour(code []byte, n int, dest []byte) ([]byte, error) {
+	if cap(dest) < detourSize(n) {
+		return nil, errors.New("buffer too small for detour")
+	}
+
+	src := uintptr(unsafe.Pointer(unsafe.SliceData(code)))
+	destAddr := uintptr(unsafe.Pointer(unsafe.SliceData(dest)))
+
+	out := dest[:0]
+	for i := 0; i < n; {
+		inst, err := x86asm.Decode(code[i:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("decode error at offset %d: %w", i, err)
+		}
+		raw := code[i : i+inst.Len]
+		target := uintptr(int64(src) + int64(i+inst.Len))
+
+		var dispOff int
+		switch inst.PCRel {
+		case 0:
+			out = append(out, raw...)
+			i += inst.Len
+			continue
+		case 1:
+			// Short branches can't reach the function from the
+			// detour, so use the 32-bit form.
+			target = uintptr(int64(target) + int64(int8(raw[inst.PCRelOff])))
+			switch op := raw[0]; {
+			case op == 0xeb: // JMP rel8
+				out = append(out, opcodeJMP)
+			case op >= 0x70 && op <= 0x7f: // Jcc rel8
+				out = append(out, 0x0f, 0x80|op&0xf)
+			default:
+				return nil, fmt.Errorf("unable to move %v", inst)
+			}
+			dispOff = len(out)
+			out = append(out, 0, 0, 0, 0)
+		case 4:
+			target = uintptr(int64(target) + int64(int32(binary.LittleEndian.Uint32(raw[inst.PCRelOff:]))))
+			dispOff = len(out) + inst.PCRelOff
+			out = append(out, raw...)
+		default:
+			return nil, fmt.Errorf("unsupported relative address size: %d", inst.PCRel)
+		}
+
+		disp := int64(target) - int64(destAddr+uintptr(len(out)))
+		if disp < math.MinInt32 || disp > math.MaxInt32 {
+			return nil, fmt.Errorf("%w: unable to move %v", errAddressOutOfRange, inst)
+		}
+		binary.LittleEndian.PutUint32(out[dispOff:], uint32(int32(disp)))
+
+		i += inst.Len
+	}
+
+	jmp := dest[len(out) : len(out)+absJumpSize]
+	err := insertJump(jmp, src+uintptr(n))
+	if err != nil {
+		return nil, err
+	}
+
+	return dest[:len(out)+absJumpSize], nil
+}
+
+// encodeRedirect returns new bytes for the jump at offset in code so that it
+// goes to target.
+func encodeRedirect(code []byte, offset int, target uintptr) ([]byte, error) {
+	inst, err := x86asm.Decode(code[offset:], 64)
+	if err != nil {
+		return nil, fmt.Errorf("decode error at offset %d: %w", offset, err)
+	}
+	if inst.PCRel != 4 {
+		return nil, fmt.Errorf("no 32-bit displacement at offset %d", offset)
+	}
+
+	pc := uintptr(unsafe.Pointer(unsafe.SliceData(code))) + uintptr(offset+inst.Len)
+	disp := int64(target) - int64(pc)
+	if disp < math.MinInt32 || disp > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: jump at offset %d can't reach 0x%x", errAddressOutOfRange, offset, target)
+	}
+
+	raw := bytes.Clone(code[offset : offset+inst.Len])
+	binary.LittleEndian.PutUint32(raw[inst.PCRelOff:], uint32(int32(disp)))
+	return raw, nil
+}
+
+// relocatedSize returns the largest buffer relocateFunc could need to
+// relocate src.
+func relocatedSize(src []byte) int {
+	return len(src)
+}
+
+// callTargets returns the destinations of every call and jump in code that
+// leaves the function, including recursive calls.
+func callTargets(code []byte) ([]uintptr, error) {
+	var targets []uintptr
+
+	start := uintptr(unsafe.Pointer(unsafe.SliceData(code)))
+
+	for i := 0; i < len(code); {
+		instruction, err := x86asm.Decode(code[i:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("decode error at offset %d: %w", i, err)
+		}
 		i += instruction.Len
+
+		if instruction.PCRel != 4 || (instruction.Op != x86asm.CALL && instruction.Op != x86asm.JMP) {
+			continue
+		}
+
+		rel, ok := instruction.Args[0].(x86asm.Rel)
+		if !ok {
+			continue
+		}
+
+		target := uintptr(int64(start) + int64(i) + int64(rel))
+		if !inSlice(code, target) || (instruction.Op == x86asm.CALL && target == start) {
+			targets = append(targets, target)
+		}
+	}
+
+	return targets, nil
+}
+
+// decodeInstructions decodes code, which runs from pc. Bytes that can't be
+// decoded are returned one at a time as "?".
+func decodeInstructions(code []byte, pc uintptr) []Instruction {
+	var insts []Instruction
+
+	for i := 0; i < len(code); {
+		inst := Instruction{
+			Addr:   pc + uintptr(i),
+			Offset: i,
+			Bytes:  code[i : i+1],
+			Text:   "?",
+		}
+
+		decoded, err := x86asm.Decode(code[i:], 64)
+		if err == nil {
+			inst.Bytes = code[i : i+decoded.Len]
+			inst.Text = x86asm.GoSyntax(decoded, uint64(inst.Addr), symbolize)
+
+			// GoSyntax shows the displacement for memory operands, so
+			// add the address they refer to.
+			for _, arg := range decoded.Args {
+				if mem, ok := arg.(x86asm.Mem); ok && mem.Base == x86asm.RIP {
+					target := int64(inst.Addr) + int64(decoded.Len) + int64(int32(mem.Disp))
+					inst.Text += fmt.Sprintf(" // 0x%x", target)
+				}
+			}
+		}
+		inst.Bytes = bytes.Clone(inst.Bytes)
+
+		insts = append(insts, inst)
+		i += len(inst.Bytes)
+	}
+
+	return insts
+}
+
+// decodeEntryJump recognizes a jump at the start of code that could have been
+// written by another patching library.
+func decodeEntryJump(code []byte) (foreignJump, bool) {
+	switch {
+	case len(code) >= 12 && code[0] == 0x48 && code[1] == 0xba && code[10] == 0xff && code[11] == 0x22:
+		// MOVQ $funcval, DX; JMP (DX), which bouk/monkey and gomonkey
+		// write.
+		fv := uintptr(binary.LittleEndian.Uint64(code[2:]))
+		target, ok := funcvalAt(fv)
+		if !ok {
+			return foreignJump{}, false
+		}
+		return foreignJump{target: target, ctx: fv, size: 12}, true
+
+	case len(code) >= absJumpSize && bytes.Equal(code[:6], []byte{0xff, 0x25, 0, 0, 0, 0}):
+		// JMP [RIP+0] followed by the address, like insertAbsJump.
+		return foreignJump{target: uintptr(binary.LittleEndian.Uint64(code[6:])), size: absJumpSize}, true
+
+	case len(code) >= minJumpSize && code[0] == opcodeJMP:
+		start := uintptr(unsafe.Pointer(unsafe.SliceData(code)))
+		disp := int32(binary.LittleEndian.Uint32(code[1:]))
+		return foreignJump{
+			target:   uintptr(int64(start) + minJumpSize + int64(disp)),
+			size:     minJumpSize,
+			relative: true,
+		}, true
 	}
 
-	return buf.String(), nil
+	return foreignJump{}, false
+}
+
+// The number of registers used for arguments and results with ABIInternal.
+const (
+	intArgRegs   = 9
+	floatArgRegs = 15
+)
+
+// intArgRegNums maps the index of an integer argument register to its number
+// in instruction encodings: AX, BX, CX, DI, SI, R8, R9, R10, R11.
+var intArgRegNums = [intArgRegs]byte{0, 3, 1, 7, 6, 8, 9, 10, 11}
+
+// takesABI0 reports whether code, the compiler-generated wrapper for the
+// assembly at body, is for callers that use ABI0. Those wrappers load the g
+// register (R14) before they call the assembly, since ABIInternal needs it.
+func takesABI0(code []byte, body uintptr) bool {
+	pc := uintptr(unsafe.Pointer(unsafe.SliceData(code)))
+	for i := 0; i < len(code); {
+		inst, err := x86asm.Decode(code[i:], 64)
+		if err != nil {
+			return false
+		}
+		i += inst.Len
+
+		switch inst.Op {
+		case x86asm.CALL, x86asm.JMP:
+			rel, ok := inst.Args[0].(x86asm.Rel)
+			if ok && pc+uintptr(i)+uintptr(int64(rel)) == body {
+				return false
+			}
+		case x86asm.RET:
+			return false
+		}
+		if inst.Args[0] == x86asm.R14 {
+			return true
+		}
+	}
+	return false
+}
+
+// findLoadG returns the instructions that load the g register (R14) after a
+// call in code, which ABIInternal code does after calling ABI0 code. Calls to
+// ABIInternal code, like the race detector's hooks in instrumented code, aren't
+// followed by them and are skipped.
+func findLoadG(code []byte) ([]byte, error) {
+	called := false
+	var loadG []byte
+	for i := 0; i < len(code); {
+		inst, err := x86asm.Decode(code[i:], 64)
+		if err != nil {
+			break
+		}
+		raw := code[i : i+inst.Len]
+		i += inst.Len
+
+		if !called {
+			called = inst.Op == x86asm.CALL
+			continue
+		}
+
+		if inst.Op == x86asm.XORPS && inst.Args[0] == x86asm.X15 {
+			continue
+		}
+		if inst.Args[0] != x86asm.R14 {
+			if len(loadG) > 0 {
+				break
+			}
+			called = inst.Op == x86asm.CALL
+			continue
+		}
+		for _, arg := range inst.Args {
+			if mem, ok := arg.(x86asm.Mem); ok && mem.Base == x86asm.RIP {
+				return nil, errors.New("the code that loads g isn't position-independent")
+			}
+		}
+		loadG = append(loadG, raw...)
+	}
+
+	if len(loadG) == 0 {
+		return nil, errors.New("can't find the code that loads g")
+	}
+	return loadG, nil
+}
+
+// abi0Adapters is true where abi0Adapter is implemented.
+const abi0Adapters = true
+
+// abi0Adapter returns code that takes a call with ABI0, calls the function
+// value fv with ABIInternal, and returns the results with ABI0. loadG is the
+// code that loads the g register, see findLoadG.
+func abi0Adapter(l abiLayout, fv uintptr, loadG []byte) ([]byte, error) {
+	if l.spill > math.MaxInt32 || l.frame > math.MaxInt32 {
+		return nil, errors.New("frame too large")
+	}
+	spill := uint32(l.spill)
+
+	// PUSHQ BP; MOVQ SP, BP
+	code := []byte{0x55, 0x48, 0x89, 0xe5}
+	if spill > 0 {
+		// SUBQ $spill, SP
+		code = append(code, 0x48, 0x81, 0xec)
+		code = binary.LittleEndian.AppendUint32(code, spill)
+	}
+
+	code = append(code, loadG...)
+	// XORPS X15, X15
+	code = append(code, 0x45, 0x0f, 0x57, 0xff)
+
+	// The ABI0 arguments are above the return address and BP.
+	frame := spill + 16
+	for _, part := range l.args {
+		code = appendABIMove(code, part, frame, true)
+	}
+
+	// MOVQ $fv, DX; MOVQ (DX), R12; CALL R12
+	code = append(code, 0x48, 0xba)
+	code = binary.LittleEndian.AppendUint64(code, uint64(fv))
+	code = append(code, 0x4c, 0x8b, 0x22, 0x41, 0xff, 0xd4)
+
+	for _, part := range l.results {
+		code = appendABIMove(code, part, frame, false)
+	}
+
+	if spill > 0 {
+		// ADDQ $spill, SP
+		code = append(code, 0x48, 0x81, 0xc4)
+		code = binary.LittleEndian.AppendUint32(code, spill)
+	}
+	// POPQ BP; RET
+	code = append(code, 0x5d, 0xc3)
+
+	return code, nil
+}
+
+// appendABIMove appends an instruction that loads part from the ABI0 frame at
+// frame(SP) into its register, or stores it there from the register.
+func appendABIMove(code []byte, part abiPart, frame uint32, load bool) []byte {
+	var prefix, opcode []byte
+	var reg byte
+	rexW := false
+
+	if part.float {
+		reg = byte(part.reg)
+		prefix = []byte{0xf2} // MOVSD
+		if part.size == 4 {
+			prefix = []byte{0xf3} // MOVSS
+		}
+		opcode = []byte{0x0f, 0x11}
+		if load {
+			opcode = []byte{0x0f, 0x10}
+		}
+	} else {
+		reg = intArgRegNums[part.reg]
+		switch {
+		case load && part.size == 1:
+			opcode = []byte{0x0f, 0xb6} // MOVBLZX
+		case load && part.size == 2:
+			opcode = []byte{0x0f, 0xb7} // MOVWLZX
+		case load:
+			opcode = []byte{0x8b} // MOVL or MOVQ
+		case part.size == 1:
+			opcode = []byte{0x88} // MOVB
+		case part.size == 2:
+			prefix = []byte{0x66}
+			opcode = []byte{0x89} // MOVW
+		default:
+			opcode = []byte{0x89} // MOVL or MOVQ
+		}
+		rexW = part.size == 8
+	}
+
+	code = append(code, prefix...)
+
+	rex := byte(0x40)
+	if rexW {
+		rex |= 0x08
+	}
+	if reg >= 8 {
+		rex |= 0x04
+	}
+	// Byte stores from DI and SI need a REX prefix to not mean BH and DH.
+	if rex != 0x40 || (!part.float && !load && part.size == 1 && reg >= 4) {
+		code = append(code, rex)
+	}
+
+	code = append(code, opcode...)
+
+	// ModRM for [SP+disp32], then SIB and the displacement.
+	code = append(code, 0x80|(reg&7)<<3|4, 0x24)
+	return binary.LittleEndian.AppendUint32(code, frame+uint32(part.offset))
 }
@@ -0,0 +1,31 @@
+package redefine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindLoadG(t *testing.T) {
+	// MOVQ FS:-8, R14
+	load := []byte{0x64, 0x4c, 0x8b, 0x34, 0x25, 0xf8, 0xff, 0xff, 0xff}
+
+	// Code built with -race calls racefuncenter first, which takes an
+	// ABIInternal call, so g isn't loaded after it.
+	code := []byte{
+		0xe8, 0x00, 0x00, 0x00, 0x00, // CALL racefuncenter
+		0x48, 0x8b, 0x4c, 0x24, 0x40, // MOVQ 0x40(SP), CX
+		0xe8, 0x00, 0x00, 0x00, 0x00, // CALL the assembly
+		0x45, 0x0f, 0x57, 0xff, // XORPS X15, X15
+	}
+	code = append(code, load...)
+	code = append(code, 0x48, 0x8b, 0x4c, 0x24, 0x20) // MOVQ 0x20(SP), CX
+
+	loadG, err := findLoadG(code)
+	require.NoError(t, err)
+	assert.Equal(t, load, loadG)
+
+	_, err = findLoadG(code[:15])
+	assert.Error(t, err)
+}
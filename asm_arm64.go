@@ -3,7 +3,6 @@ package redefine
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"unsafe"
@@ -27,6 +26,11 @@ const (
 	// ----------------------------------------------
 	_BLR = uint32(0xd63f0000)
 
+	// ----------------------------------------------
+	// | 1101011000011111000000 | 5-bit reg | 00000 |
+	// ----------------------------------------------
+	_BR = uint32(0xd61f0000)
+
 	// -----------------------------------------------------------
 	// | 1-bit sf | 10100101 | 2-bit hw | 16-bit imm | 5-bit reg |
 	// -----------------------------------------------------------
@@ -47,12 +51,24 @@ const (
 
 const scratchRegister = 16
 
+// Go's closure context register.
+const contextRegister = 26
+
+// Size of the code generated by makeBLTrampoline.
+const blTrampolineSize = 24
+
 // Ideally, cloned functions will be within 128 MiB of the original function.
 // But it's acceptable to be within the 4 GiB range for ADRP because there's code
 // to generate trampolines for BLs.
 const idealCloneDistance = 128 * 1024 * 1024
 const maxCloneDistance = 4 * 1024 * 1024 * 1024
 
+// codePadding fills the space between functions.
+const codePadding = 0
+
+// pcQuantum is the size of the smallest instruction.
+const pcQuantum = 4
+
 func insertJump(buf []byte, dest uintptr) error {
 	if len(buf) < 4 {
 		return errors.New("buffer too small")
@@ -62,7 +78,7 @@ func insertJump(buf []byte, dest uintptr) error {
 	offset := int64(dest) - addr
 
 	if offset < -(1<<27) || offset >= (1<<27) {
-		return fmt.Errorf("B target out of range: %d bytes exceeds 128MiB", offset)
+		return insertAbsJump(buf, dest)
 	}
 
 	encodeB(buf, int32(offset))
@@ -75,18 +91,74 @@ func insertJump(buf []byte, dest uintptr) error {
 	return nil
 }
 
+// insertAbsJump writes a jump to an address that's out of range for B, which
+// happens when dest is in a different module. x16 is free to use at the start
+// of a function.
+func insertAbsJump(buf []byte, dest uintptr) error {
+	const instructionSize = 20 // 4 MOVs and BR
+
+	if len(buf) < instructionSize {
+		return fmt.Errorf("%w: B target 0x%x exceeds 128MiB and the function is too small for an absolute jump", errAddressOutOfRange, dest)
+	}
+
+	encodeMov(buf, true, 0, uint16(dest), scratchRegister)
+	encodeMov(buf[4:], false, 16, uint16(dest>>16), scratchRegister)
+	encodeMov(buf[8:], false, 32, uint16(dest>>32), scratchRegister)
+	encodeMov(buf[12:], false, 48, uint16(dest>>48), scratchRegister)
+	binary.LittleEndian.PutUint32(buf[16:], _BR|uint32(scratchRegister<<5))
+
+	for i := instructionSize; i < len(buf); i++ {
+		buf[i] = 0
+	}
+
+	return nil
+}
+
+// Size of the code written by writeClosureTrampoline.
+const closureTrampolineSize = 36
+
+// writeClosureTrampoline writes code to buf that calls a closure. ctx is the
+// address of the closure's funcval, which goes in the context register (x26),
+// and code is its entry point.
+func writeClosureTrampoline(buf []byte, ctx, code uintptr) error {
+	if len(buf) < closureTrampolineSize {
+		return errors.New("buffer too small for closure trampoline")
+	}
+
+	for i, reg := range []struct {
+		n   uint8
+		val uintptr
+	}{{contextRegister, ctx}, {scratchRegister, code}} {
+		b := buf[i*16:]
+		encodeMov(b, true, 0, uint16(reg.val), reg.n)
+		encodeMov(b[4:], false, 16, uint16(reg.val>>16), reg.n)
+		encodeMov(b[8:], false, 32, uint16(reg.val>>32), reg.n)
+		encodeMov(b[12:], false, 48, uint16(reg.val>>48), reg.n)
+	}
+	binary.LittleEndian.PutUint32(buf[32:], _BR|uint32(scratchRegister<<5))
+
+	return nil
+}
+
 // relocateFunc copies machine instructions from src into dest translating
 // relative instructions as it goes. dest must be at least as large as src.
 //
+// If resolve is not nil, it's called with the target of every BL, including
+// recursive calls, and returns the address to use instead.
+//
 // The data underlying the slices is assumed to be the same address the code
 // would execute from.
-func relocateFunc(src, dest []byte) ([]byte, error) {
+func relocateFunc(src, dest []byte, resolve func(uintptr) uintptr) ([]byte, error) {
+	return relocateFuncAt(src, uintptr(unsafe.Pointer(unsafe.SliceData(src))), dest, resolve)
+}
+
+// relocateFuncAt is relocateFunc for a copy of a function that was originally
+// at srcPC.
+func relocateFuncAt(src []byte, srcPC uintptr, dest []byte, resolve func(uintptr) uintptr) ([]byte, error) {
 	src = trimPadding(src)
 	dest = dest[:len(src)]
 	copy(dest, src)
 
-	srcPC := uintptr(unsafe.Pointer(unsafe.SliceData(src)))
-
 	for i := 0; i < len(src); i += 4 {
 		raw := dest[i : i+4]
 
@@ -101,11 +173,11 @@ func relocateFunc(src, dest []byte) ([]byte, error) {
 
 		for _, arg := range instruction.Args {
 			if _, ok := arg.(arm64asm.PCRel); ok {
-				err = fixPCRelAddress(instruction, srcPC, raw)
+				err = fixPCRelAddress(instruction, srcPC, raw, resolve)
 				if err != nil {
 					if errors.Is(err, errAddressOutOfRange) && instruction.Op == arm64asm.BL {
 						var trErr error
-						dest, trErr = makeBLTrampoline(instruction, srcPC, dest, i)
+						dest, trErr = makeBLTrampoline(blTarget(instruction, srcPC, resolve), dest, i)
 						if trErr != nil {
 							return nil, fmt.Errorf("unable to make trampoline: %w (original error: %w)", trErr, err)
 						}
@@ -134,7 +206,7 @@ func trimPadding(buf []byte) []byte {
 	return buf[:newLen]
 }
 
-func fixPCRelAddress(inst arm64asm.Inst, srcPC uintptr, dest []byte) error {
+func fixPCRelAddress(inst arm64asm.Inst, srcPC uintptr, dest []byte, resolve func(uintptr) uintptr) error {
 	destPC := uintptr(unsafe.Pointer(unsafe.SliceData(dest)))
 
 	switch inst.Op {
@@ -156,8 +228,7 @@ func fixPCRelAddress(inst arm64asm.Inst, srcPC uintptr, dest []byte) error {
 		binary.LittleEndian.PutUint32(dest, encoded)
 
 	case arm64asm.BL:
-		oldOffset := int64(inst.Args[0].(arm64asm.PCRel))
-		offset := int64(srcPC) + oldOffset - int64(destPC)
+		offset := int64(blTarget(inst, srcPC, resolve)) - int64(destPC)
 
 		// BL encodes a 26-bit signed instruction offset.
 		if offset < -(1<<27) || offset >= (1<<27) {
@@ -174,14 +245,21 @@ func fixPCRelAddress(inst arm64asm.Inst, srcPC uintptr, dest []byte) error {
 	return nil
 }
 
-func makeBLTrampoline(inst arm64asm.Inst, srcPC uintptr, dest []byte, blOffset int) ([]byte, error) {
-	if cap(dest)-len(dest) < 24 {
+// blTarget returns the address a BL instruction at srcPC should call.
+func blTarget(inst arm64asm.Inst, srcPC uintptr, resolve func(uintptr) uintptr) uintptr {
+	target := uintptr(int64(srcPC) + int64(inst.Args[0].(arm64asm.PCRel)))
+	if resolve != nil {
+		target = resolve(target)
+	}
+	return target
+}
+
+func makeBLTrampoline(blrTarget uintptr, dest []byte, blOffset int) ([]byte, error) {
+	if cap(dest)-len(dest) < blTrampolineSize {
 		return nil, errors.New("destination is too small for BL trampoline")
 	}
 	origLen := len(dest)
-	dest = dest[:len(dest)+24]
-
-	blrTarget := uintptr(int64(srcPC) + int64(inst.Args[0].(arm64asm.PCRel)))
+	dest = dest[:len(dest)+blTrampolineSize]
 
 	// Encode the trampoline itself. It uses 6 instructions total. 4 to
 	// store a 64-bit number in x16, 1 for BLR x16, and 1 B to return the
@@ -205,6 +283,146 @@ func makeBLTrampoline(inst arm64asm.Inst, srcPC uintptr, dest []byte, blOffset i
 	return dest, nil
 }
 
+// minJumpSize is the fewest bytes insertJump writes.
+const minJumpSize = 4
+
+// absJumpSize is the most bytes insertJump writes.
+const absJumpSize = 20
+
+// detourPrologue finds the instructions at the start of code that a jump will
+// overwrite, and checks that they can run from somewhere else. It returns
+// their length and the offsets of branches later in code that go back to the
+// start of the function, like the one after runtime.morestack. Those need to
+// go to the moved prologue instead.
+func detourPrologue(code []byte) (int, []int, error) {
+	const n = minJumpSize
+
+	inst, err := arm64asm.Decode(code[:n])
+	if err != nil {
+		return 0, nil, fmt.Errorf("decode error at offset 0: %w", err)
+	}
+	if inst.Op == arm64asm.BLR {
+		return 0, nil, errors.New("call in the prologue")
+	}
+	for _, arg := range inst.Args {
+		if _, ok := arg.(arm64asm.PCRel); ok && inst.Op != arm64asm.ADRP {
+			return 0, nil, fmt.Errorf("unable to move %v", inst)
+		}
+	}
+
+	var backJumps []int
+	for i := n; i+4 <= len(code); i += 4 {
+		inst, err := arm64asm.Decode(code[i : i+4])
+		if err != nil {
+			// Padding
+			continue
+		}
+		if inst.Op == arm64asm.BL || inst.Op == arm64asm.ADR || inst.Op == arm64asm.ADRP {
+			continue
+		}
+
+		for _, arg := range inst.Args {
+			rel, ok := arg.(arm64asm.PCRel)
+			if !ok || i+int(rel) != 0 {
+				continue
+			}
+
+			// Only B has the range to reach the moved prologue.
+			if binary.LittleEndian.Uint32(code[i:])&^(1<<26-1) != _B {
+				return 0, nil, fmt.Errorf("branch at offset %d into the prologue", i)
+			}
+			backJumps = append(backJumps, i)
+		}
+	}
+
+	return n, backJumps, nil
+}
+
+// detourSize returns the largest buffer writeDetour could need for a prologue
+// of n bytes.
+func detourSize(n int) int {
+	return n + absJumpSize
+}
+
+// writeDetour copies the first n bytes of code into dest, followed by a jump
+// to the rest of code. It returns the part of dest that was used.
+func writeDetour(code []byte, n int, dest []byte) ([]byte, error) {
+	if cap(dest) < detourSize(n) {
+		return nil, errors.New("buffer too small for detour")
+	}
+	dest = dest[:detourSize(n)]
+
+	srcPC := uintptr(unsafe.Pointer(unsafe.SliceData(code)))
+	for i := 0; i < n; i += 4 {
+		copy(dest[i:], code[i:i+4])
+
+		inst, err := arm64asm.Decode(code[i : i+4])
+		if err != nil {
+			return nil, fmt.Errorf("decode error at offset %d: %w", i, err)
+		}
+		if inst.Op == arm64asm.ADRP {
+			err = fixPCRelAddress(inst, srcPC+uintptr(i), dest[i:], nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err := insertJump(dest[n:], srcPC+uintptr(n))
+	if err != nil {
+		return nil, err
+	}
+
+	return dest, nil
+}
+
+// encodeRedirect returns new bytes for the branch at offset in code so that it
+// goes to target.
+func encodeRedirect(code []byte, offset int, target uintptr) ([]byte, error) {
+	pc := uintptr(unsafe.Pointer(unsafe.SliceData(code))) + uintptr(offset)
+	disp := int64(target) - int64(pc)
+	if disp < -(1<<27) || disp >= (1<<27) {
+		return nil, fmt.Errorf("%w: branch at offset %d can't reach 0x%x", errAddressOutOfRange, offset, target)
+	}
+
+	raw := make([]byte, 4)
+	encodeB(raw, int32(disp))
+	return raw, nil
+}
+
+// relocatedSize returns the largest buffer relocateFunc could need to
+// relocate src, which is enough for every BL to need a trampoline.
+func relocatedSize(src []byte) int {
+	src = trimPadding(src)
+	size := len(src)
+	for i := 0; i+4 <= len(src); i += 4 {
+		if binary.LittleEndian.Uint32(src[i:])&^(1<<26-1) == _BL {
+			size += blTrampolineSize
+		}
+	}
+	return size
+}
+
+// callTargets returns the destinations of every BL in code, including
+// recursive calls.
+func callTargets(code []byte) ([]uintptr, error) {
+	var targets []uintptr
+
+	pc := uintptr(unsafe.Pointer(unsafe.SliceData(code)))
+	for i := 0; i+4 <= len(code); i += 4 {
+		inst := binary.LittleEndian.Uint32(code[i:])
+		if inst&^(1<<26-1) != _BL {
+			continue
+		}
+
+		// Sign-extend the 26-bit instruction offset.
+		offset := int64(int32(inst<<6)>>6) * 4
+		targets = append(targets, uintptr(int64(pc)+int64(i)+offset))
+	}
+
+	return targets, nil
+}
+
 func encodeB(dest []byte, offset int32) {
 	inst := _B | (uint32(offset)>>2)&0x3ffffff
 	binary.LittleEndian.PutUint32(dest, inst)
@@ -225,21 +443,154 @@ func encodeMov(dest []byte, zero bool, lsl uint8, imm uint16, register uint8) {
 	binary.LittleEndian.PutUint32(dest, mov)
 }
 
-func disassemble(code []byte) (string, error) {
-	var buf bytes.Buffer
-
-	baseAddr := uintptr(unsafe.Pointer(unsafe.SliceData(code)))
+// decodeInstructions decodes code, which runs from pc. Instructions that
+// can't be decoded are returned as "?".
+func decodeInstructions(code []byte, pc uintptr) []Instruction {
+	var insts []Instruction
+
+	for i := 0; i+4 <= len(code); i += 4 {
+		inst := Instruction{
+			Addr:   pc + uintptr(i),
+			Offset: i,
+			Bytes:  bytes.Clone(code[i : i+4]),
+			Text:   "?",
+		}
 
-	for i := 0; i < len(code)&^3; i += 4 {
-		var asm string
-		instruction, err := arm64asm.Decode(code[i:])
+		decoded, err := arm64asm.Decode(code[i:])
 		if err == nil {
-			asm = instruction.String()
-		} else {
-			asm = "?"
+			inst.Text = arm64asm.GoSyntax(decoded, uint64(inst.Addr), symbolize, nil)
+		}
+
+		insts = append(insts, inst)
+	}
+
+	return insts
+}
+
+// decodeEntryJump recognizes a jump at the start of code that could have been
+// written by another patching library.
+func decodeEntryJump(code []byte) (foreignJump, bool) {
+	if len(code) < 4 {
+		return foreignJump{}, false
+	}
+
+	first := binary.LittleEndian.Uint32(code)
+	if first&^(1<<26-1) == _B {
+		start := uintptr(unsafe.Pointer(unsafe.SliceData(code)))
+		offset := int64(int32(first<<6)>>6) * 4
+		return foreignJump{
+			target:   uintptr(int64(start) + offset),
+			size:     4,
+			relative: true,
+		}, true
+	}
+
+	// An address loaded into a register with MOVZ and MOVKs.
+	var (
+		addr uint64
+		reg  uint32
+		i    int
+	)
+	for ; i+4 <= len(code) && i < 16; i += 4 {
+		inst := binary.LittleEndian.Uint32(code[i:])
+		op := _MOVK
+		if i == 0 {
+			op = _MOVZ
+		}
+		if inst&0xff800000 != op || (i > 0 && inst&0x1f != reg) {
+			break
+		}
+		reg = inst & 0x1f
+		addr |= uint64((inst>>5)&0xffff) << (16 * ((inst >> 21) & 3))
+	}
+	if i == 0 || i+4 > len(code) {
+		return foreignJump{}, false
+	}
+
+	next := binary.LittleEndian.Uint32(code[i:])
+	if next == _BR|reg<<5 {
+		// Like insertAbsJump.
+		return foreignJump{target: uintptr(addr), size: i + 4}, true
+	}
+
+	// LDR Xt, [Xn]; BR Xt, which gomonkey writes with the address of a
+	// funcval in x26.
+	if i+8 <= len(code) && next&^0x1f == 0xf9400000|reg<<5 {
+		t := next & 0x1f
+		if binary.LittleEndian.Uint32(code[i+4:]) == _BR|t<<5 {
+			target, ok := funcvalAt(uintptr(addr))
+			if !ok {
+				return foreignJump{}, false
+			}
+			return foreignJump{target: target, ctx: uintptr(addr), size: i + 8}, true
+		}
+	}
+
+	return foreignJump{}, false
+}
+
+// The number of registers used for arguments and results with ABIInternal.
+const (
+	intArgRegs   = 16
+	floatArgRegs = 16
+)
+
+// takesABI0 reports whether code, the compiler-generated wrapper for the
+// assembly at body, is for callers that use ABI0. Those wrappers load the
+// arguments from the stack into registers before they call the assembly.
+func takesABI0(code []byte, body uintptr) bool {
+	pc := uintptr(unsafe.Pointer(unsafe.SliceData(code)))
+	for i := 0; i+4 <= len(code); i += 4 {
+		inst, err := arm64asm.Decode(code[i:])
+		if err != nil {
+			continue
+		}
+
+		switch inst.Op {
+		case arm64asm.B, arm64asm.BL:
+			_, ok := inst.Args[0].(arm64asm.PCRel)
+			if ok && blTarget(inst, pc+uintptr(i), nil) == body {
+				return false
+			}
+		case arm64asm.RET:
+			return false
+		case arm64asm.LDR, arm64asm.LDUR, arm64asm.LDP:
+			mem, ok := inst.Args[len(inst.Args)-1].(arm64asm.MemImmediate)
+			if ok && mem.Base == arm64asm.RegSP(arm64asm.SP) && isArgReg(inst.Args[0]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isArgReg reports whether arg is a register used for arguments with
+// ABIInternal.
+func isArgReg(arg arm64asm.Arg) bool {
+	reg, ok := arg.(arm64asm.Reg)
+	if !ok {
+		return false
+	}
+	for _, first := range []arm64asm.Reg{arm64asm.X0, arm64asm.W0, arm64asm.S0, arm64asm.D0} {
+		if reg >= first && reg < first+16 {
+			return true
 		}
-		fmt.Fprintf(&buf, "0x%08x\t%-20s\t%s\n", baseAddr+uintptr(i), hex.EncodeToString(code[i:i+4]), asm)
 	}
+	return false
+}
+
+// findLoadG returns nothing on arm64, where g stays in R28 with both calling
+// conventions.
+func findLoadG([]byte) ([]byte, error) {
+	return nil, nil
+}
+
+// abi0Adapters is true where abi0Adapter is implemented. The ABI0Adapter
+// option is ignored on arm64.
+const abi0Adapters = false
 
-	return buf.String(), nil
+// abi0Adapter would return code that takes a call with ABI0 and calls fv with
+// ABIInternal, but that isn't supported on arm64 yet.
+func abi0Adapter(abiLayout, uintptr, []byte) ([]byte, error) {
+	return nil, errors.New("adapters for ABI0 callers aren't supported on arm64")
 }
@@ -0,0 +1,120 @@
+//go:build linux && (amd64 || arm64)
+
+package redefine
+
+import (
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pboyd/malloc"
+	"github.com/pboyd/redefine/internal/buildtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBuildModes builds the programs in testdata/buildmode with each build
+// mode and runs them.
+func TestBuildModes(t *testing.T) {
+	for _, mode := range []string{"exe", "pie"} {
+		t.Run(mode, func(t *testing.T) {
+			prog := buildtest.Build(t, "./testdata/buildmode/prog", "-buildmode="+mode)
+			buildtest.Run(t, prog)
+		})
+	}
+
+	t.Run("plugin", func(t *testing.T) {
+		buildtest.RequireCgo(t)
+
+		plugin := buildtest.Build(t, "./testdata/buildmode/plugin", "-buildmode=plugin")
+		buildtest.BuildAndRun(t, "./testdata/buildmode/pluginhost", plugin)
+	})
+
+	t.Run("c-shared", func(t *testing.T) {
+		cc := buildtest.RequireCgo(t)
+
+		lib := buildtest.Build(t, "./testdata/buildmode/cshared", "-buildmode=c-shared")
+
+		host := filepath.Join(t.TempDir(), "host")
+		out, err := exec.Command(cc, "-o", host, "testdata/buildmode/cshared/host.c", "-ldl").CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", cc, err, out)
+		}
+		buildtest.Run(t, host, lib)
+	})
+}
+
+var noOriginalValue = 1
+
+//go:noinline
+func noOriginalTarget() int {
+	return noOriginalValue
+}
+
+// TestFunc_NoOriginal redefines a function when the only memory for the copy
+// is too far away, as can happen in position-independent builds.
+func TestFunc_NoOriginal(t *testing.T) {
+	far := farAllocator(t)
+	saved := cloneAllocator
+	cloneAllocator = far
+	t.Cleanup(func() { cloneAllocator = saved })
+
+	require.NoError(t, Func(noOriginalTarget, func() int { return 2 }))
+	t.Cleanup(func() { Restore(noOriginalTarget) })
+	assert.Equal(t, 2, noOriginalTarget())
+
+	mu.RLock()
+	pc := redefined[reflect.ValueOf(noOriginalTarget).Pointer()].(patchedCode)
+	mu.RUnlock()
+	require.Nil(t, pc.funcRef(), "the copy should have been out of range")
+
+	assert.Nil(t, Original(noOriginalTarget))
+
+	_, _, err := Clone(noOriginalTarget)
+	assert.ErrorIs(t, err, ErrNoOriginal)
+	assert.ErrorContains(t, err, "noOriginalTarget")
+
+	require.NoError(t, Restore(noOriginalTarget))
+	assert.Equal(t, 1, noOriginalTarget())
+}
+
+// TestMethodFor_NoOriginal checks that MethodFor returns an error when there's
+// no copy of the method to dispatch other receivers to.
+func TestMethodFor_NoOriginal(t *testing.T) {
+	far := farAllocator(t)
+	saved := cloneAllocator
+	cloneAllocator = far
+	t.Cleanup(func() { cloneAllocator = saved })
+
+	s := &instanceStruct{name: "world"}
+	err := MethodFor(s, (*instanceStruct).Greet, (*instanceFake).Greet)
+	assert.ErrorIs(t, err, ErrNoOriginal)
+
+	// Nothing was left redefined.
+	assert.Equal(t, "hello world", s.Greet("hello"))
+	mu.RLock()
+	_, ok := redefined[reflect.ValueOf((*instanceStruct).Greet).Pointer()]
+	mu.RUnlock()
+	assert.False(t, ok)
+}
+
+// farAllocator returns an allocator with one arena that's too far from the
+// program for copies of its functions to reach their data.
+func farAllocator(t *testing.T) *allocator {
+	t.Helper()
+
+	const size = 1 << 20
+	datap := findfunc(reflect.ValueOf(noOriginalTarget).Pointer()).datap
+	addr := (datap.end + 64<<30) &^ (size - 1)
+	be, err := malloc.VirtBackend(size, malloc.MmapAddr(addr), malloc.MmapProt(mprotectExec), malloc.MmapFlags(_MMAP_FLAGS))
+	if err != nil {
+		t.Skipf("unable to reserve memory far from the program: %v", err)
+	}
+
+	ar, err := newArenaAt(be, size, 4096)
+	require.NoError(t, err)
+	t.Cleanup(func() { ar.release() })
+
+	return &allocator{arenas: []*arena{ar}}
+}
@@ -15,6 +15,11 @@ import (
 
 var errAddressOutOfRange = errors.New("address out of range")
 
+// errArenaOutOfRange is returned by copyCode when the memory it got for the
+// copy is too far from the function to reach the same code and data. It's the
+// only copy failure that Func works around, see unsafeFuncLocked.
+var errArenaOutOfRange = errors.New("no memory close enough to the function for a copy")
+
 // cloneFunc makes a copy of a function that persists after the original
 // function has been modified.
 func cloneFunc[T any](fn T) (*clonedFunc[T], error) {
@@ -28,20 +33,52 @@ func cloneFunc[T any](fn T) (*clonedFunc[T], error) {
 		return nil, err
 	}
 
-	cloneAllocator.BeginMutate()
-	defer cloneAllocator.EndMutate()
+	alloc := allocatorFor(fnv.Pointer())
+	alloc.BeginMutate()
+	defer alloc.EndMutate()
+
+	newCode, err := copyCode(alloc, originalCode, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cf := clonedFunc[T]{clonedCode: newCode, alloc: alloc, name: symbolName(fnv.Pointer())}
+	cf.Func, cf.ref = makeFunc[T](newCode)
+
+	// Make a copy of the code so that no matter what it can be restored.
+	cf.originalCode = make([]byte, len(originalCode))
+	copy(cf.originalCode, originalCode)
+
+	return &cf, nil
+}
 
+// copyCode allocates memory from alloc and relocates src into it. resolve is
+// passed to relocateFunc, along with the new buffer.
+//
+// The caller must call alloc.BeginMutate first.
+func copyCode(alloc *allocator, src []byte, resolve func(dest []byte, target uintptr) uintptr) ([]byte, error) {
 	var newCode []byte
+	var err error
+	var lastBuf uintptr
 
-	for size := len(originalCode); size < len(originalCode)*3; size += len(originalCode) {
-		newCode, err = cloneAllocator.Allocate(size)
+	for size := len(src); size < len(src)*3; size += len(src) {
+		var buf []byte
+		buf, err = alloc.Allocate(size)
 		if err != nil {
 			return nil, err
 		}
+		lastBuf = uintptr(unsafe.Pointer(unsafe.SliceData(buf)))
+
+		var destResolve func(uintptr) uintptr
+		if resolve != nil {
+			destResolve = func(target uintptr) uintptr {
+				return resolve(buf, target)
+			}
+		}
 
-		newCode, err = relocateFunc(originalCode, newCode)
+		newCode, err = relocateFunc(src, buf, destResolve)
 		if err != nil {
-			cloneAllocator.Free(newCode)
+			alloc.Free(buf)
 			newCode = nil
 
 			// If the problem is just that there isn't enough room
@@ -57,6 +94,9 @@ func cloneFunc[T any](fn T) (*clonedFunc[T], error) {
 	}
 
 	if err != nil {
+		if errors.Is(err, errAddressOutOfRange) && !withinCloneDistance(src, lastBuf, len(src)*3) {
+			return nil, fmt.Errorf("%w: %w", errArenaOutOfRange, err)
+		}
 		return nil, err
 	}
 	if newCode == nil {
@@ -65,74 +105,109 @@ func cloneFunc[T any](fn T) (*clonedFunc[T], error) {
 	}
 
 	cacheflush(newCode)
+	addSymbol(newCode, symbolName(uintptr(unsafe.Pointer(unsafe.SliceData(src)))), "copy")
+
+	return newCode, nil
+}
+
+// withinCloneDistance reports whether size bytes at addr are close enough to
+// the module that contains src for a copy there to reach all of it, the same
+// as the arenas that initMallocBackend reserves.
+func withinCloneDistance(src []byte, addr uintptr, size int) bool {
+	lo := uintptr(unsafe.Pointer(unsafe.SliceData(src)))
+	hi := lo + uintptr(len(src))
+	if datap := findfunc(lo).datap; datap != nil {
+		lo, hi = datap.text, datap.end
+	}
+
+	return max(hi, addr+uintptr(size))-min(lo, addr) <= maxCloneDistance
+}
 
+// copyWithOptions copies src, the original code for the function at entry,
+// according to opts. The first buffer returned is the copy of entry, any
+// others are functions it calls that had to be copied too. For isolated
+// copies, it also returns the functions the copy depends on, see
+// isolatedClone.
+//
+// The caller must hold mu.
+func copyWithOptions(alloc *allocator, entry uintptr, src []byte, opts options) ([][]byte, map[uintptr]bool, error) {
+	alloc.BeginMutate()
+	defer alloc.EndMutate()
+
+	if opts.isolated {
+		return isolatedClone(alloc, entry)
+	}
+
+	var resolve func([]byte, uintptr) uintptr
+	if opts.recursive {
+		resolve = func(dest []byte, target uintptr) uintptr {
+			if target == entry {
+				return uintptr(unsafe.Pointer(unsafe.SliceData(dest)))
+			}
+			return target
+		}
+	}
+
+	code, err := copyCode(alloc, src, resolve)
+	if err != nil {
+		return nil, nil, err
+	}
+	return [][]byte{code}, nil, nil
+}
+
+// makeFunc converts a buffer of machine instructions into a function value of
+// type T. The returned reference keeps the function value alive and must be
+// cleared before code is freed.
+func makeFunc[T any](code []byte) (T, **byte) {
 	// This seems too complicated. The idea is to take our newly allocated
 	// buffer of machine instructions and convince Go that it's really a
 	// function pointer of type T.
-	codeData := unsafe.SliceData(newCode)
-	cf := clonedFunc[T]{
-		clonedCode: newCode,
-		// Keep a reference to codeData so it stays around.
-		ref: &codeData,
-	}
-	cf.Func = *(*T)(unsafe.Pointer(uintptr(unsafe.Pointer(&cf.ref))))
+	codeData := unsafe.SliceData(code)
+	// Keep a reference to codeData so it stays around.
+	ref := &codeData
+	return funcFromRef[T](ref), ref
+}
 
-	// Make a copy of the code so that no matter what it can be restored.
-	cf.originalCode = make([]byte, len(originalCode))
-	copy(cf.originalCode, originalCode)
+// funcFromRef returns a function value of type T for the code that a
+// reference from makeFunc points to. Every function type has the same
+// representation, so this works for any T, not just the one passed to
+// makeFunc.
+func funcFromRef[T any](ref **byte) T {
+	return *(*T)(unsafe.Pointer(&ref))
+}
 
-	return &cf, nil
+// inSlice reports whether addr is within the memory underlying buf.
+func inSlice(buf []byte, addr uintptr) bool {
+	start := uintptr(unsafe.Pointer(unsafe.SliceData(buf)))
+	return addr >= start && addr < start+uintptr(len(buf))
 }
 
+// allocator manages the memory for cloned functions from one module. It
+// starts with a single arena and adds more when that fills up.
 type allocator struct {
-	*malloc.Arena
-	mprotect func(int) error
-	mu       sync.Mutex
-	initOnce sync.Once
-	mutable  bool
-}
+	// The module with the functions that are cloned into this arena. nil
+	// is the module that contains this package.
+	datap *moduledata
 
-func (a *allocator) init(startSize int) error {
-	var err error
-	a.initOnce.Do(func() {
-		var be malloc.ArenaBackend
-		be, err = initMallocBackend()
-		if err != nil {
-			return
-		}
+	// The amount to reserve for each arena. 0 is the size of the module's
+	// text segment.
+	arenaSize uintptr
 
-		a.Arena = malloc.NewArena(uint64(startSize), malloc.Backend(be))
-		if a.Arena == nil {
-			err = errors.New("unable to initialize arena")
-			return
-		}
+	arenas []*arena
+	mu     sync.Mutex
 
-		if protBE, ok := be.(malloc.ProtectedArenaBackend); ok {
-			a.mprotect = mprotectHook(protBE.Protect)
-		} else {
-			// No real mprotect for some reason. This shouldn't
-			// really happen, but continue with a no-op mprotect.
-			a.mprotect = func(int) error { return nil }
-		}
-		a.mutable = true
-	})
-	return err
+	// The number of callers between BeginMutate and EndMutate.
+	mutators int
 }
 
-// The lowest address to consider for our cloned functions.
-const absMinAddress = 0x100000
-
-func initMallocBackend() (malloc.ArenaBackend, error) {
-	var text, etext uintptr
-	var end uintptr
-	pc, _, _, _ := runtime.Caller(0)
-	datap := findfunc(pc).datap
-	if datap != nil {
-		text = datap.text
-		etext = datap.etext
-		end = datap.end
+// addArena reserves a new arena with room for at least size bytes.
+func (a *allocator) addArena(size int) (*arena, error) {
+	datap := a.datap
+	if datap == nil {
+		pc, _, _, _ := runtime.Caller(0)
+		datap = findfunc(pc).datap
 	}
-	if text == 0 || etext == 0 || end == 0 {
+	if datap == nil || datap.text == 0 || datap.etext == 0 || datap.end == 0 {
 		return nil, fmt.Errorf("failed to find moduledata")
 	}
 
@@ -142,9 +217,32 @@ func initMallocBackend() (malloc.ArenaBackend, error) {
 	// is reserved up-front, but pages are only committed as
 	// needed.
 	//
-	// Use the size of the existing text segment so there's enough space to
-	// clone every statically-linked function.
-	size := (etext - text + pageSize - 1) &^ (pageSize - 1)
+	// By default, use the size of the existing text segment so there's
+	// enough space to clone every statically-linked function.
+	reserve := a.arenaSize
+	if reserve == 0 {
+		reserve = datap.etext - datap.text
+	}
+	reserve = max(reserve, uintptr(size)+2*arenaWordSize)
+	reserve = (reserve + pageSize - 1) &^ (pageSize - 1)
+
+	ar, err := newArena(datap, reserve, size)
+	if err != nil {
+		return nil, err
+	}
+	a.arenas = append(a.arenas, ar)
+	return ar, nil
+}
+
+// The lowest address to consider for our cloned functions.
+const absMinAddress = 0x100000
+
+// initMallocBackend reserves size bytes of memory near datap.
+func initMallocBackend(datap *moduledata, size uintptr) (*malloc.VirtReservationBackend, error) {
+	text := datap.text
+	end := datap.end
+
+	pageSize := uintptr(syscall.Getpagesize())
 
 	// Cloned functions need to be near the existing text and data
 	// segments so that they can be reached by the same
@@ -202,7 +300,7 @@ func initMallocBackend() (malloc.ArenaBackend, error) {
 	return malloc.VirtBackend(size, malloc.MmapAddr(minAddress), malloc.MmapProt(mprotectExec), malloc.MmapFlags(_MMAP_FLAGS))
 }
 
-func tryBackendRange(size, minAddress, maxAddress uintptr) malloc.ArenaBackend {
+func tryBackendRange(size, minAddress, maxAddress uintptr) *malloc.VirtReservationBackend {
 	for addr := minAddress; addr <= maxAddress; addr += 0x100000 {
 		be, err := malloc.VirtBackend(size, malloc.MmapAddr(addr), malloc.MmapProt(mprotectExec), malloc.MmapFlags(_MMAP_FLAGS))
 		if err == nil {
@@ -222,62 +320,171 @@ func (a *allocator) BeginMutate() error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	// Note that BeginMutate can be called before the initial allocation.
+	// Note that BeginMutate can be called before the initial allocation,
+	// and by more than one caller at a time.
 
-	if a.mprotect == nil || a.mutable {
+	a.mutators++
+	if a.mutators > 1 {
 		return nil
 	}
 
-	err := a.mprotect(mprotectRWX)
-	if err == nil {
-		a.mutable = true
+	for _, ar := range a.arenas {
+		err := ar.protect(mprotectRWX)
+		if err != nil {
+			return err
+		}
 	}
-	return err
+	return nil
 }
 
 func (a *allocator) EndMutate() error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	if !a.mutable {
+	if a.mutators == 0 {
 		return nil
 	}
 
-	err := a.mprotect(mprotectRX)
-	if err == nil {
-		a.mutable = false
+	a.mutators--
+	if a.mutators > 0 {
+		return nil
 	}
-	return err
+
+	for _, ar := range a.arenas {
+		err := ar.protect(mprotectRX)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (a *allocator) Allocate(size int) ([]byte, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
-	err := a.init(size)
-	if err != nil {
-		return nil, fmt.Errorf("error initializing allocator: %w", err)
-	}
 
-	if !a.mutable {
+	if a.mutators == 0 {
 		panic("Allocate called in immutable state")
 	}
 
-	return malloc.MallocSlice[byte](a.Arena, size)
+	for _, ar := range a.arenas {
+		buf, err := ar.allocate(size)
+		if !errors.Is(err, malloc.ErrOutOfMemory) {
+			return buf, err
+		}
+	}
+
+	// Everything is full, so reserve another arena.
+	ar, err := a.addArena(size)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing allocator: %w", err)
+	}
+	return ar.allocate(size)
 }
 
 func (a *allocator) Free(buf []byte) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	if !a.mutable {
+	if a.mutators == 0 {
 		panic("Free called in immutable state")
 	}
 
-	malloc.FreeSlice(a.Arena, buf)
+	addr := uintptr(unsafe.Pointer(unsafe.SliceData(buf)))
+	dropSymbol(addr)
+
+	for i, ar := range a.arenas {
+		if addr < ar.backend.Addr() || addr >= ar.backend.Addr()+ar.reserved {
+			continue
+		}
+
+		ar.free(buf)
+
+		// Keep the first arena around, but release any others once
+		// they're empty.
+		if len(ar.allocs) == 0 && len(a.arenas) > 1 {
+			if ar.release() == nil {
+				a.arenas = append(a.arenas[:i], a.arenas[i+1:]...)
+			}
+		}
+		return
+	}
+
+	panic("Free called with memory from outside the allocator")
+}
+
+// Contains reports whether the value p points to is in one of the arenas.
+func (a *allocator) Contains(p any) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, ar := range a.arenas {
+		if ar.Contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAddr reports whether addr is in the committed part of one of the
+// arenas. Unlike Contains, it doesn't need a pointer.
+func (a *allocator) containsAddr(addr uintptr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, ar := range a.arenas {
+		start := ar.backend.Addr()
+		if start <= addr && addr < start+uintptr(ar.Size()) {
+			return true
+		}
+	}
+	return false
+}
+
+// stats returns statistics for each arena.
+func (a *allocator) stats() []ArenaStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := make([]ArenaStats, len(a.arenas))
+	for i, ar := range a.arenas {
+		stats[i] = ar.stats()
+	}
+	return stats
 }
 
+// cloneAllocator holds clones of functions in the module that contains this
+// package, which is usually the whole program.
 var cloneAllocator = &allocator{}
 
+var (
+	moduleAllocatorsMu sync.Mutex
+
+	// moduleAllocators holds the allocators for other modules, such as
+	// plugins and shared libraries.
+	moduleAllocators = map[*moduledata]*allocator{}
+)
+
+// allocatorFor returns the allocator for clones of the function at pc. Clones
+// need to be near the module they came from to reach the same code and data.
+func allocatorFor(pc uintptr) *allocator {
+	datap := findfunc(pc).datap
+	self, _, _, _ := runtime.Caller(0)
+	if datap == nil || datap == findfunc(self).datap {
+		return cloneAllocator
+	}
+
+	moduleAllocatorsMu.Lock()
+	defer moduleAllocatorsMu.Unlock()
+
+	a, ok := moduleAllocators[datap]
+	if !ok {
+		a = &allocator{datap: datap}
+		moduleAllocators[datap] = a
+	}
+	return a
+}
+
 // clonedFunc holds a copy of a function.
 type clonedFunc[T any] struct {
 	Func T
@@ -286,18 +493,198 @@ type clonedFunc[T any] struct {
 	// the cloneAllocator. Keep a reference in order to free it.
 	clonedCode []byte
 	ref        **byte
+	alloc      *allocator
 
 	originalCode []byte
+
+	// The code at the entry point after the last patch, to detect changes
+	// made by something else.
+	patched []byte
+
+	// For functions cloned with detourFunc, the moved prologue and where
+	// it came from. clonedCode is only filled in if something needs a
+	// full copy.
+	entry       uintptr
+	detour      []byte
+	prologueLen int
+	backJumps   []int
+
+	// Copies made by Original with options, see variant.
+	variants []*clonedVariant
+
+	// Trampolines made by addClosure and the closures they call.
+	trampolines [][]byte
+	closures    []any
+
+	// For functions written in assembly, the other entry point, which is
+	// redefined and restored along with this one. See findAsmFunc.
+	companion uintptr
+
+	// The name of the original function, for the symbols of the code
+	// that's written for it.
+	name string
+}
+
+// clonedVariant is a copy of a function made with options. ref is the same
+// as the one from makeFunc, so the copy can be called as any function type.
+type clonedVariant struct {
+	opts options
+
+	// For isolated variants, the functions the copy depends on, from
+	// isolatedClone, and the value of redefinedGen when they were last
+	// checked.
+	deps map[uintptr]bool
+	gen  uint64
+
+	code [][]byte
+	ref  **byte
+}
+
+// current reports whether the variant still matches the functions that are
+// redefined. Only isolated variants go stale, and only when one of the
+// functions they depend on is redefined or restored, so a variant can be
+// used again when things go back to the way they were.
+//
+// The caller must hold mu for writing.
+func (v *clonedVariant) current() bool {
+	if !v.opts.isolated || v.gen == redefinedGen {
+		return true
+	}
+	for fn, was := range v.deps {
+		if _, is := redefined[fn]; is != was {
+			return false
+		}
+	}
+	v.gen = redefinedGen
+	return true
+}
+
+// code returns the cloned machine instructions.
+//
+// The caller must hold mu.
+func (cf *clonedFunc[T]) code() ([]byte, error) {
+	if cf.clonedCode == nil && cf.detour != nil {
+		err := cf.fullClone()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cf.clonedCode, nil
+}
+
+// variant returns a reference to a copy of the original function made
+// according to opts, for funcFromRef. entry is the address of the function
+// that was cloned. Variants are kept until the cloned function is freed,
+// because they may still be running, but one is only made for each set of
+// options and, for isolated variants, each combination of the functions they
+// depend on being redefined.
+//
+// The caller must hold mu for writing.
+func (cf *clonedFunc[T]) variant(entry uintptr, opts options) (**byte, error) {
+	for _, v := range cf.variants {
+		if v.opts == opts && v.current() {
+			return v.ref, nil
+		}
+	}
+
+	src, err := cf.code()
+	if err != nil {
+		return nil, err
+	}
+	if src == nil {
+		return nil, errors.New("function was not cloned")
+	}
+
+	code, deps, err := copyWithOptions(cf.alloc, entry, src, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &clonedVariant{
+		opts: opts,
+		deps: deps,
+		gen:  redefinedGen,
+		code: code,
+	}
+	_, v.ref = makeFunc[T](code[0])
+	cf.variants = append(cf.variants, v)
+
+	return v.ref, nil
+}
+
+// addClosure writes a trampoline that calls newFn with its closure context and
+// returns the address of the trampoline. The trampoline and newFn are kept
+// until the cloned function is freed.
+//
+// The caller must hold mu.
+func (cf *clonedFunc[T]) addClosure(newFn any) (uintptr, error) {
+	// A func value is a pointer to a funcval, which starts with the code
+	// pointer.
+	ctx := (*[2]unsafe.Pointer)(unsafe.Pointer(&newFn))[1]
+
+	addr, err := cf.addTrampoline(closureTrampolineSize, func(buf []byte) error {
+		return writeClosureTrampoline(buf, uintptr(ctx), *(*uintptr)(ctx))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	cf.closures = append(cf.closures, newFn)
+	return addr, nil
+}
+
+// addTrampoline allocates size bytes, fills them in with write and returns the
+// address. The trampoline is kept until the cloned function is freed.
+//
+// The caller must hold mu.
+func (cf *clonedFunc[T]) addTrampoline(size int, write func([]byte) error) (uintptr, error) {
+	cf.alloc.BeginMutate()
+	defer cf.alloc.EndMutate()
+
+	buf, err := cf.alloc.Allocate(size)
+	if err != nil {
+		return 0, err
+	}
+
+	err = write(buf)
+	if err != nil {
+		cf.alloc.Free(buf)
+		return 0, err
+	}
+	cacheflush(buf)
+	addSymbol(buf, cf.name, "trampoline")
+
+	cf.trampolines = append(cf.trampolines, buf)
+
+	return uintptr(unsafe.Pointer(unsafe.SliceData(buf))), nil
 }
 
 // Free releases the memory associated with the cloned function.
 func (cf *clonedFunc[T]) Free() {
-	cloneAllocator.BeginMutate()
-	defer cloneAllocator.EndMutate()
+	cf.alloc.BeginMutate()
+	defer cf.alloc.EndMutate()
 
 	if cf.clonedCode != nil {
-		cloneAllocator.Free(cf.clonedCode)
+		cf.alloc.Free(cf.clonedCode)
+	}
+	if cf.detour != nil {
+		cf.alloc.Free(cf.detour)
+		cf.detour = nil
+	}
+
+	for _, v := range cf.variants {
+		for _, code := range v.code {
+			cf.alloc.Free(code)
+		}
+		*v.ref = nil
 	}
+	cf.variants = nil
+
+	for _, buf := range cf.trampolines {
+		cf.alloc.Free(buf)
+	}
+	cf.trampolines = nil
+	cf.closures = nil
 
 	cf.clonedCode = nil
 	if cf.ref != nil {
@@ -306,3 +693,34 @@ func (cf *clonedFunc[T]) Free() {
 	}
 	cf.originalCode = nil
 }
+
+// patchedCode is implemented by clonedFunc for any type.
+type patchedCode interface {
+	original() []byte
+	copied() (code []byte, n int)
+	written() []byte
+	companionEntry() uintptr
+	funcRef() **byte
+	variant(entry uintptr, opts options) (**byte, error)
+	Free()
+}
+
+// funcRef returns the reference from makeFunc for the code that Original
+// runs, or nil if there isn't any.
+func (cf *clonedFunc[T]) funcRef() **byte {
+	return cf.ref
+}
+
+// original returns the code at the entry point before it was patched.
+func (cf *clonedFunc[T]) original() []byte {
+	return cf.originalCode
+}
+
+// copied returns the code that Original runs, and how many bytes of the
+// original function it was copied from.
+func (cf *clonedFunc[T]) copied() ([]byte, int) {
+	if cf.detour != nil {
+		return cf.detour, cf.prologueLen
+	}
+	return cf.clonedCode, len(cf.originalCode)
+}
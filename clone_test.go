@@ -10,10 +10,12 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func testCloneFuncWithLotsOfCalls(v int) string {
@@ -659,3 +661,120 @@ func TestCloneFunc_VariousFunctions(t *testing.T) {
 		})
 	}
 }
+
+//go:noinline
+func testCloneTarget(v int) int {
+	return v + 1
+}
+
+func TestClone(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cloned, release, err := Clone(testCloneTarget)
+	require.NoError(err)
+	t.Cleanup(release)
+	assert.Equal(2, cloned(1))
+
+	require.NoError(Func(testCloneTarget, func(v int) int { return -v }))
+	t.Cleanup(func() { Restore(testCloneTarget) })
+
+	assert.Equal(-1, testCloneTarget(1))
+	assert.Equal(2, cloned(1))
+
+	// Cloning a redefined function copies the original.
+	cloned2, release2, err := Clone(testCloneTarget)
+	require.NoError(err)
+	assert.Equal(2, cloned2(1))
+	release2()
+	release2()
+
+	_, _, err = Clone("not a function")
+	assert.Error(err)
+}
+
+func TestClone_Recursive(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	require.NoError(Func(fib, func(n int) int { return 0 }))
+	t.Cleanup(func() { Restore(fib) })
+
+	cloned, release, err := Clone(fib, Recursive())
+	require.NoError(err)
+	t.Cleanup(release)
+	assert.Equal(55, cloned(10))
+}
+
+func TestAllocator(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	pageSize := syscall.Getpagesize()
+	a := &allocator{arenaSize: uintptr(4 * pageSize)}
+	require.NoError(a.BeginMutate())
+	defer a.EndMutate()
+
+	// Each arena can only hold one of these, so it has to grow.
+	var bufs [][]byte
+	for range 3 {
+		buf, err := a.Allocate(3 * pageSize)
+		require.NoError(err)
+		bufs = append(bufs, buf)
+	}
+	assert.Len(a.arenas, 3)
+
+	stats := a.stats()
+	if assert.Len(stats, 3) {
+		for _, s := range stats {
+			assert.Equal(uintptr(4*pageSize), s.Reserved)
+			assert.Equal(uintptr(3*pageSize), s.InUse)
+		}
+	}
+
+	// Empty arenas are released, except the first.
+	for _, buf := range bufs[1:] {
+		a.Free(buf)
+	}
+	assert.Len(a.arenas, 1)
+
+	// Leave a hole between two allocations.
+	small := make([][]byte, 3)
+	for i := range small {
+		buf, err := a.Allocate(pageSize / 4)
+		require.NoError(err)
+		small[i] = buf
+	}
+	a.Free(small[1])
+	assert.Greater(a.stats()[0].Fragmentation, 0.0)
+
+	// Whole pages in the free block are given back.
+	discarded := a.stats()[0].Discarded
+	a.Free(bufs[0])
+	assert.Greater(a.stats()[0].Discarded, discarded)
+	assert.Equal(uintptr(4*pageSize), a.stats()[0].Committed)
+
+	// And they can be used again.
+	buf, err := a.Allocate(3 * pageSize)
+	require.NoError(err)
+	assert.Len(a.arenas, 1)
+	assert.Zero(a.stats()[0].Discarded)
+	buf[len(buf)-1] = 1
+}
+
+func TestArenas(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cloned, release, err := Clone(testCloneTarget)
+	require.NoError(err)
+	t.Cleanup(release)
+	assert.Equal(2, cloned(1))
+
+	stats := Arenas()
+	if assert.NotEmpty(stats) {
+		assert.Greater(stats[0].Reserved, uintptr(0))
+		assert.GreaterOrEqual(stats[0].Committed, stats[0].InUse)
+		assert.Greater(stats[0].InUse, uintptr(0))
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/token"
+	"go/types"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/tools/go/packages"
+)
+
+const redefinePath = "github.com/pboyd/redefine"
+
+// target is a function or method named on the command line.
+type target struct {
+	expr     string
+	pkgPath  string
+	typeName string // "" for a function
+	name     string
+}
+
+// parseTarget parses a target like "time.Now", "net.Dialer.DialContext" or
+// "(*net.Dialer).DialContext".
+func parseTarget(expr string) (target, error) {
+	t := target{expr: expr}
+
+	s := expr
+	if rest, ok := strings.CutPrefix(s, "(*"); ok {
+		recv, name, ok := strings.Cut(rest, ").")
+		if !ok {
+			return t, fmt.Errorf("%s: missing ).", expr)
+		}
+		s = recv + "." + name
+	}
+
+	t.pkgPath = funcPackage(s)
+	if len(s) <= len(t.pkgPath) {
+		return t, fmt.Errorf("%s: not a function or method", expr)
+	}
+	parts := strings.Split(s[len(t.pkgPath)+1:], ".")
+	switch {
+	case len(parts) == 1 && !strings.HasPrefix(expr, "(*"):
+		t.name = parts[0]
+	case len(parts) == 2:
+		t.typeName, t.name = parts[0], parts[1]
+	default:
+		return t, fmt.Errorf("%s: not a function or method", expr)
+	}
+	if !token.IsIdentifier(t.name) || t.typeName != "" && !token.IsIdentifier(t.typeName) {
+		return t, fmt.Errorf("%s: not a function or method", expr)
+	}
+	return t, nil
+}
+
+// funcPackage returns the import path of the package of a function, given
+// its full name.
+func funcPackage(name string) string {
+	slash := strings.LastIndexByte(name, '/')
+	if i := strings.IndexByte(name[slash+1:], '.'); i >= 0 {
+		return name[:slash+1+i]
+	}
+	return name
+}
+
+// generate returns the source of a file in package pkgName with stubs for the
+// targets.
+func generate(pkgName string, exprs []string) ([]byte, error) {
+	var targets []target
+	var paths []string
+	for _, expr := range exprs {
+		t, err := parseTarget(expr)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+		if !slices.Contains(paths, t.pkgPath) {
+			paths = append(paths, t.pkgPath)
+		}
+	}
+
+	cfg := &packages.Config{Mode: packages.NeedName | packages.NeedTypes}
+	pkgs, err := packages.Load(cfg, paths...)
+	if err != nil {
+		return nil, err
+	}
+	byPath := map[string]*types.Package{}
+	var errs []error
+	for _, pkg := range pkgs {
+		for _, err := range pkg.Errors {
+			errs = append(errs, err)
+		}
+		byPath[pkg.PkgPath] = pkg.Types
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	g := newGenerator()
+	for _, t := range targets {
+		pkg := byPath[t.pkgPath]
+		if pkg == nil {
+			return nil, fmt.Errorf("%s: package %s not found", t.expr, t.pkgPath)
+		}
+		if err := g.target(pkg, t); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.expr, err)
+		}
+	}
+
+	return g.file(pkgName)
+}
+
+// generator writes the stubs.
+type generator struct {
+	body bytes.Buffer
+
+	// imports maps the import paths used by the stubs to their names, and
+	// importNames is the reverse.
+	imports     map[string]string
+	importNames map[string]string
+
+	// idents maps the names of the stubs to the targets they were written
+	// for.
+	idents map[string]string
+
+	// myTypes maps the names of the types written for method receivers to
+	// the types they're defined from.
+	myTypes map[string]*types.TypeName
+}
+
+func newGenerator() *generator {
+	g := &generator{
+		imports:     map[string]string{},
+		importNames: map[string]string{},
+		idents:      map[string]string{},
+		myTypes:     map[string]*types.TypeName{},
+	}
+	g.importName("testing", "testing")
+	g.importName(redefinePath, "redefine")
+	return g
+}
+
+// importName returns the name the file uses for the package at path, adding
+// it to the imports.
+func (g *generator) importName(path, name string) string {
+	if name, ok := g.imports[path]; ok {
+		return name
+	}
+	unique := name
+	for i := 2; g.importNames[unique] != ""; i++ {
+		unique = fmt.Sprintf("%s%d", name, i)
+	}
+	g.imports[path] = unique
+	g.importNames[unique] = path
+	return unique
+}
+
+func (g *generator) qualifier(pkg *types.Package) string {
+	return g.importName(pkg.Path(), pkg.Name())
+}
+
+func (g *generator) typeString(t types.Type) string {
+	return types.TypeString(t, g.qualifier)
+}
+
+// claim records that ident was written for expr, or returns an error if it
+// was already written for another target.
+func (g *generator) claim(ident, expr string) error {
+	if other, ok := g.idents[ident]; ok {
+		if other == expr {
+			return fmt.Errorf("listed twice")
+		}
+		return fmt.Errorf("%s was already written for %s", ident, other)
+	}
+	g.idents[ident] = expr
+	return nil
+}
+
+// target writes the stubs for t, which is in pkg.
+func (g *generator) target(pkg *types.Package, t target) error {
+	if t.typeName == "" {
+		fn, ok := pkg.Scope().Lookup(t.name).(*types.Func)
+		if !ok || !fn.Exported() {
+			return fmt.Errorf("no exported function %s in %s", t.name, pkg.Path())
+		}
+		return g.function(fn)
+	}
+
+	tn, ok := pkg.Scope().Lookup(t.typeName).(*types.TypeName)
+	if !ok || !tn.Exported() {
+		return fmt.Errorf("no exported type %s in %s", t.typeName, pkg.Path())
+	}
+	named, ok := tn.Type().(*types.Named)
+	if !ok || tn.IsAlias() {
+		return fmt.Errorf("%s is an alias", t.typeName)
+	}
+	if named.TypeParams().Len() > 0 {
+		return errors.New("methods of generic types can't be redefined")
+	}
+	if types.IsInterface(named) {
+		return fmt.Errorf("%s is an interface", t.typeName)
+	}
+
+	obj, index, _ := types.LookupFieldOrMethod(types.NewPointer(named), false, pkg, t.name)
+	fn, ok := obj.(*types.Func)
+	if !ok || !fn.Exported() {
+		return fmt.Errorf("no exported method %s on %s", t.name, t.typeName)
+	}
+	if len(index) > 1 {
+		return fmt.Errorf("promoted from an embedded field, redefine %s instead", fn.FullName())
+	}
+	return g.method(tn, fn)
+}
+
+// function writes the stubs for a function.
+func (g *generator) function(fn *types.Func) error {
+	sig := fn.Type().(*types.Signature)
+	if sig.TypeParams().Len() > 0 {
+		return errors.New("generic functions can't be redefined")
+	}
+	if err := checkExported(sig); err != nil {
+		return err
+	}
+
+	base := fn.Pkg().Name() + upperFirst(fn.Name())
+	fnVar := base + "Fn"
+	stub := "stub" + upperFirst(base)
+	helper := "redefine" + upperFirst(base)
+	for _, ident := range []string{fnVar, stub, helper} {
+		if err := g.claim(ident, fn.FullName()); err != nil {
+			return err
+		}
+	}
+
+	name := fn.Pkg().Name() + "." + fn.Name()
+	expr := g.qualifier(fn.Pkg()) + "." + fn.Name()
+	params := g.params(sig, []string{fnVar})
+	results := g.results(sig)
+	fnType := "func(" + joinParams(params) + ")" + results
+
+	fmt.Fprintf(&g.body, "// %s is called by %s.\n", fnVar, stub)
+	fmt.Fprintf(&g.body, "var %s %s\n\n", fnVar, fnType)
+
+	fmt.Fprintf(&g.body, "// %s replaces %s, and calls %s.\n", stub, name, fnVar)
+	fmt.Fprintf(&g.body, "func %s(%s)%s {\n", stub, joinParams(params), results)
+	g.writeCall(fnVar, "", params, results)
+	fmt.Fprintf(&g.body, "}\n\n")
+
+	g.writeHelper(helper, name, fnVar, fnType, fmt.Sprintf("redefine.Func(%s, %s)", expr, stub), expr)
+	return nil
+}
+
+// method writes the stubs for a method of the type tn.
+func (g *generator) method(tn *types.TypeName, fn *types.Func) error {
+	sig := fn.Type().(*types.Signature)
+	if err := checkExported(sig); err != nil {
+		return err
+	}
+	_, pointer := sig.Recv().Type().(*types.Pointer)
+
+	myType := "my" + tn.Name()
+	if other, ok := g.myTypes[myType]; ok && other != tn {
+		return fmt.Errorf("%s was already written for %s.%s", myType, other.Pkg().Path(), other.Name())
+	} else if !ok {
+		if err := g.claim(myType, tn.Pkg().Path()+"."+tn.Name()); err != nil {
+			return err
+		}
+		g.myTypes[myType] = tn
+		fmt.Fprintf(&g.body, "// %s is defined from %s.%s, for the methods that replace its methods.\n", myType, tn.Pkg().Name(), tn.Name())
+		fmt.Fprintf(&g.body, "type %s %s\n\n", myType, g.typeString(tn.Type()))
+	}
+
+	base := lowerFirst(tn.Name()) + upperFirst(fn.Name())
+	fnVar := base + "Fn"
+	helper := "redefine" + upperFirst(base)
+	for _, ident := range []string{fnVar, helper} {
+		if err := g.claim(ident, fn.FullName()); err != nil {
+			return err
+		}
+	}
+
+	recvType := g.typeString(tn.Type())
+	stubRecv := myType
+	name := fmt.Sprintf("%s.%s.%s", tn.Pkg().Name(), tn.Name(), fn.Name())
+	expr := fmt.Sprintf("%s.%s", recvType, fn.Name())
+	stubExpr := fmt.Sprintf("%s.%s", myType, fn.Name())
+	if pointer {
+		recvType = "*" + recvType
+		stubRecv = "*" + stubRecv
+		name = fmt.Sprintf("(*%s.%s).%s", tn.Pkg().Name(), tn.Name(), fn.Name())
+		expr = fmt.Sprintf("(%s).%s", recvType, fn.Name())
+		stubExpr = fmt.Sprintf("(%s).%s", stubRecv, fn.Name())
+	}
+
+	params := g.params(sig, []string{"recv", fnVar, g.qualifier(tn.Pkg())})
+	results := g.results(sig)
+	fnType := "func(recv " + recvType
+	if len(params) > 0 {
+		fnType += ", " + joinParams(params)
+	}
+	fnType += ")" + results
+
+	fmt.Fprintf(&g.body, "// %s is called by %s.\n", fnVar, stubExpr)
+	fmt.Fprintf(&g.body, "var %s %s\n\n", fnVar, fnType)
+
+	fmt.Fprintf(&g.body, "// %s replaces %s, and calls %s.\n", fn.Name(), name, fnVar)
+	fmt.Fprintf(&g.body, "func (recv %s) %s(%s)%s {\n", stubRecv, fn.Name(), joinParams(params), results)
+	g.writeCall(fnVar, fmt.Sprintf("(%s)(recv)", recvType), params, results)
+	fmt.Fprintf(&g.body, "}\n\n")
+
+	g.writeHelper(helper, name, fnVar, fnType, fmt.Sprintf("redefine.Method(%s, %s)", expr, stubExpr), expr)
+	return nil
+}
+
+// writeCall writes the body of a stub, which calls fnVar with recv, if it
+// isn't "", and the params.
+func (g *generator) writeCall(fnVar, recv string, params []param, results string) {
+	var args []string
+	if recv != "" {
+		args = append(args, recv)
+	}
+	for _, p := range params {
+		if strings.HasPrefix(p.typ, "...") {
+			args = append(args, p.name+"...")
+		} else {
+			args = append(args, p.name)
+		}
+	}
+
+	call := fmt.Sprintf("%s(%s)", fnVar, strings.Join(args, ", "))
+	if results == "" {
+		fmt.Fprintf(&g.body, "\t%s\n", call)
+	} else {
+		fmt.Fprintf(&g.body, "\treturn %s\n", call)
+	}
+}
+
+// writeHelper writes the function that sets fnVar and redefines the target
+// with the call, and restores expr when the test ends.
+func (g *generator) writeHelper(helper, name, fnVar, fnType, call, expr string) {
+	fmt.Fprintf(&g.body, "// %s redefines %s to call fn until the test ends.\n", helper, name)
+	fmt.Fprintf(&g.body, "func %s(tb testing.TB, fn %s) {\n", helper, fnType)
+	fmt.Fprintf(&g.body, "\ttb.Helper()\n")
+	fmt.Fprintf(&g.body, "\t%s = fn\n", fnVar)
+	fmt.Fprintf(&g.body, "\ttb.Cleanup(func() {\n")
+	fmt.Fprintf(&g.body, "\t\tredefine.Restore(%s)\n", expr)
+	fmt.Fprintf(&g.body, "\t\t%s = nil\n", fnVar)
+	fmt.Fprintf(&g.body, "\t})\n")
+	fmt.Fprintf(&g.body, "\tif err := %s; err != nil {\n", call)
+	fmt.Fprintf(&g.body, "\t\ttb.Fatalf(\"redefine %s: %%v\", err)\n", name)
+	fmt.Fprintf(&g.body, "\t}\n")
+	fmt.Fprintf(&g.body, "}\n\n")
+}
+
+// param is a parameter of a stub.
+type param struct {
+	name, typ string
+}
+
+// params returns the parameters of sig. Parameters without names, or with
+// names that are in reserved, are named after their position.
+func (g *generator) params(sig *types.Signature, reserved []string) []param {
+	params := make([]param, sig.Params().Len())
+	for i := range params {
+		v := sig.Params().At(i)
+		name := v.Name()
+		if name == "" || name == "_" || slices.Contains(reserved, name) {
+			name = fmt.Sprintf("p%d", i)
+		}
+
+		var typ string
+		if sig.Variadic() && i == len(params)-1 {
+			typ = "..." + g.typeString(v.Type().(*types.Slice).Elem())
+		} else {
+			typ = g.typeString(v.Type())
+		}
+		params[i] = param{name: name, typ: typ}
+	}
+	return params
+}
+
+// results returns the results of sig as they're written after the
+// parameters, with a leading space.
+func (g *generator) results(sig *types.Signature) string {
+	res := sig.Results()
+	switch res.Len() {
+	case 0:
+		return ""
+	case 1:
+		return " " + g.typeString(res.At(0).Type())
+	}
+
+	list := make([]string, res.Len())
+	for i := range list {
+		list[i] = g.typeString(res.At(i).Type())
+	}
+	return " (" + strings.Join(list, ", ") + ")"
+}
+
+func joinParams(params []param) string {
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.name + " " + p.typ
+	}
+	return strings.Join(parts, ", ")
+}
+
+// file returns the formatted source of the file.
+func (g *generator) file(pkgName string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by redefine-gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkgName)
+
+	// The standard library first, then everything else.
+	paths := slices.SortedFunc(maps.Keys(g.imports), func(a, b string) int {
+		if isStd(a) != isStd(b) {
+			if isStd(a) {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	fmt.Fprintf(&buf, "import (\n")
+	for i, path := range paths {
+		if i > 0 && isStd(paths[i-1]) != isStd(path) {
+			buf.WriteByte('\n')
+		}
+		name := g.imports[path]
+		if name == defaultName(path) {
+			fmt.Fprintf(&buf, "\t%q\n", path)
+		} else {
+			fmt.Fprintf(&buf, "\t%s %q\n", name, path)
+		}
+	}
+	fmt.Fprintf(&buf, ")\n\n")
+
+	buf.Write(bytes.TrimRight(g.body.Bytes(), "\n"))
+	buf.WriteByte('\n')
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting the output: %w", err)
+	}
+	return src, nil
+}
+
+// defaultName returns the name an import of path gets without one, assuming
+// that it matches the last element of the path.
+func defaultName(path string) string {
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
+
+// isStd reports whether path is in the standard library, which is assumed
+// when the first element doesn't have a dot.
+func isStd(path string) bool {
+	first, _, _ := strings.Cut(path, "/")
+	return !strings.Contains(first, ".")
+}
+
+// checkExported returns an error if the signature refers to an unexported
+// type, which a stub in another package can't.
+func checkExported(sig *types.Signature) error {
+	var check func(t types.Type) error
+	check = func(t types.Type) error {
+		switch t := t.(type) {
+		case *types.Named:
+			if obj := t.Obj(); obj.Pkg() != nil && !obj.Exported() {
+				return fmt.Errorf("the signature refers to the unexported type %s.%s", obj.Pkg().Path(), obj.Name())
+			}
+			for t := range t.TypeArgs().Types() {
+				if err := check(t); err != nil {
+					return err
+				}
+			}
+		case *types.Alias:
+			return check(types.Unalias(t))
+		case *types.Pointer:
+			return check(t.Elem())
+		case *types.Slice:
+			return check(t.Elem())
+		case *types.Array:
+			return check(t.Elem())
+		case *types.Chan:
+			return check(t.Elem())
+		case *types.Map:
+			if err := check(t.Key()); err != nil {
+				return err
+			}
+			return check(t.Elem())
+		case *types.Signature:
+			for _, tuple := range []*types.Tuple{t.Params(), t.Results()} {
+				for v := range tuple.Variables() {
+					if err := check(v.Type()); err != nil {
+						return err
+					}
+				}
+			}
+		case *types.Struct:
+			for f := range t.Fields() {
+				if err := check(f.Type()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	params := types.NewSignatureType(nil, nil, nil, sig.Params(), sig.Results(), sig.Variadic())
+	return check(params)
+}
+
+func upperFirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+func lowerFirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToLower(r)) + s[size:]
+}
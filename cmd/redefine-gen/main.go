@@ -0,0 +1,66 @@
+// Command redefine-gen writes typed stubs for functions and methods to redefine
+// in tests, so the signatures don't have to be copied by hand. It's meant for
+// go:generate:
+//
+//	//go:generate redefine-gen time.Now net.Dialer.DialContext
+//
+// Targets are named as in Go code, with the full import path of the package,
+// like net/http.Get, net/http.Client.Do or (*net/http.Client).Do. Whether a
+// method has a pointer receiver is looked up, so either form works.
+//
+// For time.Now it writes:
+//
+//	// timeNowFn is called by stubTimeNow.
+//	var timeNowFn func() time.Time
+//
+//	// stubTimeNow replaces time.Now, and calls timeNowFn.
+//	func stubTimeNow() time.Time {
+//		return timeNowFn()
+//	}
+//
+//	// redefineTimeNow redefines time.Now to call fn until the test ends.
+//	func redefineTimeNow(tb testing.TB, fn func() time.Time)
+//
+// A method is replaced by a method on a type defined from the receiver's, like
+// "type myDialer net.Dialer", and fn is called with the receiver as the first
+// argument.
+//
+// Since the stubs call a package variable, fn can be a closure, which
+// redefine.Func doesn't allow for a replacement. But tests that redefine the
+// same target can't run in parallel.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("redefine-gen: ")
+
+	out := flag.String("o", "redefine_stubs_test.go", "output file")
+	pkgName := flag.String("pkg", os.Getenv("GOPACKAGE"), "package of the output file (default: $GOPACKAGE)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] target...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 || *pkgName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, err := generate(*pkgName, flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = os.WriteFile(*out, src, 0o644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	cases := []struct {
+		expr string
+		want target
+	}{
+		{"time.Now", target{pkgPath: "time", name: "Now"}},
+		{"net/http.Get", target{pkgPath: "net/http", name: "Get"}},
+		{"net/http.Client.Do", target{pkgPath: "net/http", typeName: "Client", name: "Do"}},
+		{"(*net/http.Client).Do", target{pkgPath: "net/http", typeName: "Client", name: "Do"}},
+		{"example.com/app.Run", target{pkgPath: "example.com/app", name: "Run"}},
+	}
+	for _, c := range cases {
+		got, err := parseTarget(c.expr)
+		if assert.NoError(t, err, c.expr) {
+			c.want.expr = c.expr
+			assert.Equal(t, c.want, got)
+		}
+	}
+
+	for _, expr := range []string{"time", "(*time.Now", "(*time).Now", "a.B.C.D", "time.Now()"} {
+		_, err := parseTarget(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	src, err := generate("demo", []string{"time.Now", "strings.Builder.Len", "fmt.Sprintf", "time.Time.Unix"})
+	require.NoError(t, err)
+
+	_, err = parser.ParseFile(token.NewFileSet(), "", src, 0)
+	require.NoError(t, err, string(src))
+
+	for _, want := range []string{
+		"func stubTimeNow() time.Time {",
+		"func redefineTimeNow(tb testing.TB, fn func() time.Time) {",
+		"redefine.Func(time.Now, stubTimeNow)",
+		"type myBuilder strings.Builder",
+		"func (recv *myBuilder) Len() int {",
+		"return builderLenFn((*strings.Builder)(recv))",
+		"redefine.Method((*strings.Builder).Len, (*myBuilder).Len)",
+		"return fmtSprintfFn(format, a...)",
+		"type myTime time.Time",
+		"func (recv myTime) Unix() int64 {",
+		"redefine.Method(time.Time.Unix, myTime.Unix)",
+	} {
+		assert.Contains(t, string(src), want)
+	}
+}
+
+func TestGenerate_Errors(t *testing.T) {
+	cases := map[string]string{
+		"slices.Sort":           "generic functions can't be redefined",
+		"io.Reader.Read":        "Reader is an interface",
+		"bufio.ReadWriter.Read": "promoted from an embedded field",
+		"time.now":              "no exported function now in time",
+		"time.Now time.Now":     "listed twice",
+	}
+	for expr, want := range cases {
+		_, err := generate("demo", strings.Fields(expr))
+		if assert.Error(t, err, expr) {
+			assert.Contains(t, err.Error(), want)
+		}
+	}
+}
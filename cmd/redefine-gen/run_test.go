@@ -0,0 +1,106 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestGenerate_Run generates stubs for the functions in a package of a
+// temporary module, and runs a test there that uses them.
+func TestGenerate_Run(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping build in short mode")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skipf("go command not available: %v", err)
+	}
+
+	root, err := filepath.Abs("../..")
+	require.NoError(t, err)
+	sum, err := os.ReadFile(filepath.Join(root, "go.sum"))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	write("go.mod", "module demo\n\ngo 1.25.0\n\nrequire github.com/pboyd/redefine v0.0.0\n\nreplace github.com/pboyd/redefine => "+root+"\n")
+	write("go.sum", string(sum))
+	write("target/target.go", targetSource)
+	write("demo_test.go", demoTestSource)
+
+	t.Chdir(dir)
+	src, err := generate("demo", []string{"demo/target.Double", "demo/target.Counter.Add", "demo/target.Point.Sum"})
+	require.NoError(t, err)
+	write("redefine_stubs_test.go", string(src))
+
+	cmd := exec.Command(goBin, "test", "-mod=mod", ".")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, "%s\n%s", out, src)
+}
+
+const targetSource = `package target
+
+//go:noinline
+func Double(n int) int {
+	return 2 * n
+}
+
+type Counter struct{ n int }
+
+//go:noinline
+func (c *Counter) Add(n int) int {
+	c.n += n
+	return c.n
+}
+
+type Point struct{ X, Y int }
+
+//go:noinline
+func (p Point) Sum() int {
+	return p.X + p.Y
+}
+`
+
+const demoTestSource = `package demo
+
+import (
+	"testing"
+
+	"demo/target"
+)
+
+func TestStubs(t *testing.T) {
+	t.Run("redefined", func(t *testing.T) {
+		redefineTargetDouble(t, func(n int) int { return -n })
+		redefineCounterAdd(t, func(c *target.Counter, n int) int { return 100 + n })
+		redefinePointSum(t, func(p target.Point) int { return p.X * p.Y })
+
+		if got := target.Double(3); got != -3 {
+			t.Errorf("Double(3) = %d, want -3", got)
+		}
+		if got := new(target.Counter).Add(2); got != 102 {
+			t.Errorf("Add(2) = %d, want 102", got)
+		}
+		if got := (target.Point{X: 2, Y: 3}).Sum(); got != 6 {
+			t.Errorf("Sum() = %d, want 6", got)
+		}
+	})
+
+	if got := target.Double(3); got != 6 {
+		t.Errorf("Double(3) = %d after the test, want 6", got)
+	}
+	if got := new(target.Counter).Add(2); got != 2 {
+		t.Errorf("Add(2) = %d after the test, want 2", got)
+	}
+}
+`
@@ -0,0 +1,148 @@
+// Command redefine-inspect lists the functions in a compiled Go program and
+// whether they can be redefined.
+//
+// Usage:
+//
+//	redefine-inspect [flags] program [pattern]
+//
+// The pattern is a package path, or a pattern for the full names of the
+// functions, as redefine.Functions takes. The program has to be built for the
+// same architecture, and with the same Go release, as redefine-inspect.
+//
+// Position-independent programs (-buildmode=pie, which is the default on some
+// platforms) can only be read if the linker wrote the addresses into the file
+// and didn't leave them all for the loader. The entry points shown for them are
+// where they're linked, not where they're loaded when they run.
+//
+// For each function it shows the size of the code, the room for the jump to
+// the new function (the code plus padding), how many functions it was inlined
+// into, whether its instructions can be copied, whether it's a wrapper or the
+// shape of a generic function, and whether it can be redefined. Functions that
+// were inlined everywhere have no size. With -v, it shows where the function
+// was inlined, and why it can't be copied.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pboyd/redefine"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("redefine-inspect: ")
+
+	verbose := flag.Bool("v", false, "show where each function was inlined and why it can't be copied")
+	only := flag.Bool("redefinable", false, "only list functions that can be redefined")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] program [pattern]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	funcs, err := redefine.InspectBinary(flag.Arg(0), flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *only {
+		var redefinable []redefine.BinaryFunction
+		for _, f := range funcs {
+			if f.Redefinable {
+				redefinable = append(redefinable, f)
+			}
+		}
+		funcs = redefinable
+	}
+
+	if *verbose {
+		writeDetails(os.Stdout, funcs)
+	} else {
+		writeTable(os.Stdout, funcs)
+	}
+}
+
+// writeTable writes a line for each function.
+func writeTable(w io.Writer, funcs []redefine.BinaryFunction) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FUNCTION\tSIZE\tROOM\tINLINED\tCOPY\tKIND\tREDEFINE")
+	for _, f := range funcs {
+		size, room := "-", "-"
+		if f.Entry != 0 {
+			size, room = fmt.Sprint(f.Size), fmt.Sprint(f.Room)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", f.Name, size, room, inlined(f), copyable(f), kind(f), yesNo(f.Redefinable))
+	}
+	tw.Flush()
+}
+
+// writeDetails writes a paragraph for each function.
+func writeDetails(w io.Writer, funcs []redefine.BinaryFunction) {
+	for i, f := range funcs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, f.Name)
+		if f.Entry != 0 {
+			fmt.Fprintf(w, "\tentry: 0x%x\n", f.Entry)
+			fmt.Fprintf(w, "\tsize: %d, room: %d\n", f.Size, f.Room)
+			if f.CloneErr != nil {
+				fmt.Fprintf(w, "\tcopy: %v\n", f.CloneErr)
+			} else {
+				fmt.Fprintf(w, "\tcopy: yes\n")
+			}
+		}
+		if k := kind(f); k != "-" {
+			fmt.Fprintf(w, "\tkind: %s\n", k)
+		}
+		if len(f.InlinedInto) > 0 {
+			fmt.Fprintf(w, "\tinlined into: %s\n", strings.Join(f.InlinedInto, ", "))
+		}
+		fmt.Fprintf(w, "\tredefinable: %s\n", yesNo(f.Redefinable))
+	}
+}
+
+func inlined(f redefine.BinaryFunction) string {
+	switch {
+	case f.Entry == 0:
+		return "everywhere"
+	case len(f.InlinedInto) == 0:
+		return "-"
+	}
+	return fmt.Sprint(len(f.InlinedInto))
+}
+
+func copyable(f redefine.BinaryFunction) string {
+	if f.Entry == 0 {
+		return "-"
+	}
+	return yesNo(f.CloneErr == nil)
+}
+
+func kind(f redefine.BinaryFunction) string {
+	switch {
+	case f.Wrapper:
+		return "wrapper"
+	case f.Shape:
+		return "shape"
+	}
+	return "-"
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
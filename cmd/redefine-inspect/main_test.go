@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pboyd/redefine"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTable(t *testing.T) {
+	funcs := []redefine.BinaryFunction{
+		{
+			Function:    redefine.Function{Name: "example.com/app.Run", Entry: 0x1000, Size: 90},
+			Room:        96,
+			InlinedInto: []string{"example.com/app.main"},
+			Redefinable: true,
+		},
+		{
+			Function: redefine.Function{Name: "example.com/app.(*T).Get", Entry: 0x1060, Size: 30},
+			Room:     32,
+			CloneErr: errors.New("decode error at offset 4"),
+			Wrapper:  true,
+		},
+		{
+			Function:    redefine.Function{Name: "example.com/app.small"},
+			InlinedInto: []string{"example.com/app.Run"},
+		},
+	}
+
+	var b strings.Builder
+	writeTable(&b, funcs)
+	assert.Equal(t, strings.Join([]string{
+		"FUNCTION                  SIZE  ROOM  INLINED     COPY  KIND     REDEFINE",
+		"example.com/app.Run       90    96    1           yes   -        yes",
+		"example.com/app.(*T).Get  30    32    -           no    wrapper  no",
+		"example.com/app.small     -     -     everywhere  -     -        no",
+		"",
+	}, "\n"), b.String())
+
+	b.Reset()
+	writeDetails(&b, funcs[1:2])
+	assert.Equal(t, strings.Join([]string{
+		"example.com/app.(*T).Get",
+		"\tentry: 0x1060",
+		"\tsize: 30, room: 32",
+		"\tcopy: decode error at offset 4",
+		"\tkind: wrapper",
+		"\tredefinable: no",
+		"",
+	}, "\n"), b.String())
+}
@@ -0,0 +1,259 @@
+// Command redefine-live rebuilds a directory of replacement functions as a
+// plugin whenever it changes, and sends each build to a running program that
+// serves a socket with hotswap.ServePlugins.
+//
+// Usage:
+//
+//	redefine-live [flags] -socket path [dir] [-- build flags]
+//
+// dir is a main package, in the same module as the program, with a
+// Redefinitions variable as described by hotswap.LoadPlugin. It defaults to
+// the current directory. Test files are left out. Flags after "--" are passed
+// to go build, and must match the ones the program was built with.
+//
+// The program only needs to call ServePlugins once:
+//
+//	stop, err := hotswap.ServePlugins("/tmp/myservice.sock")
+//
+// When redefine-live exits, it asks the program to restore the original
+// functions.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pboyd/redefine/hotswap"
+)
+
+func main() {
+	socket := flag.String("socket", "", "unix socket the program serves")
+	interval := flag.Duration("interval", 500*time.Millisecond, "how often to check for changes")
+	outDir := flag.String("out", "", "directory for the plugins (default: a temporary directory)")
+	keep := flag.Bool("keep", false, "leave the functions redefined on exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] -socket path [dir] [-- build flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	var buildFlags []string
+	if i := slices.Index(args, "--"); i >= 0 {
+		args, buildFlags = args[:i], args[i+1:]
+	}
+	if *socket == "" || len(args) > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dir := "."
+	if len(args) == 1 {
+		dir = args[0]
+	}
+
+	if *outDir == "" {
+		tmp, err := os.MkdirTemp("", "redefine-live")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		*outDir = tmp
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	w := &watcher{
+		dir:        dir,
+		socket:     *socket,
+		outDir:     *outDir,
+		buildFlags: buildFlags,
+	}
+	err := w.run(ctx, *interval)
+	if err != nil {
+		log.Print(err)
+	}
+
+	if !*keep {
+		if err := hotswap.SendRestore(*socket); err != nil {
+			log.Printf("restore: %v", err)
+		}
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// watcher rebuilds the plugin when the files in dir change.
+type watcher struct {
+	dir, socket, outDir string
+	buildFlags          []string
+
+	// builds counts the plugins built so far. Each one needs its own
+	// plugin path, since a program can't load the same one twice.
+	builds int
+}
+
+// run checks for changes every interval until ctx is done.
+func (w *watcher) run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last string
+	for {
+		sum, err := snapshot(w.dir)
+		if err != nil {
+			return err
+		}
+		if sum != last {
+			last = sum
+			if err := w.reload(); err != nil {
+				log.Print(err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// reload builds the plugin and sends it to the program.
+func (w *watcher) reload() error {
+	w.builds++
+	name := fmt.Sprintf("live-%d", w.builds)
+	plugin, err := filepath.Abs(filepath.Join(w.outDir, name+".so"))
+	if err != nil {
+		return err
+	}
+
+	files, err := goFiles(w.dir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no Go files in %s", w.dir)
+	}
+
+	// The go command names plugins built from a list of files after a
+	// hash of the build, and a program can't load two plugins with the
+	// same name. So the build is made different each time by an overlay
+	// that adds a comment to one of the files, which leaves the files in
+	// dir alone.
+	overlay, err := w.writeOverlay(name, files[0])
+	if err != nil {
+		return err
+	}
+
+	args := []string{"build", "-buildmode=plugin", "-o", plugin, "-overlay", overlay}
+	args = append(args, w.buildFlags...)
+	args = append(args, files...)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = w.dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("build failed: %v\n%s", err, out)
+	}
+
+	err = hotswap.SendPlugin(w.socket, plugin)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	log.Printf("loaded %s", name)
+	return nil
+}
+
+// writeOverlay writes an overlay for go build to outDir that replaces file in
+// dir with a copy that has a comment naming the build, and returns its path.
+func (w *watcher) writeOverlay(name, file string) (string, error) {
+	src, err := filepath.Abs(filepath.Join(w.dir, file))
+	if err != nil {
+		return "", err
+	}
+	code, err := os.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+
+	dst, err := filepath.Abs(filepath.Join(w.outDir, name+".go"))
+	if err != nil {
+		return "", err
+	}
+	// The time keeps the builds of an earlier run, which the program may
+	// still have loaded, from matching.
+	code = fmt.Appendf(code, "\n// Build %d of redefine-live, at %s.\n", w.builds, time.Now().Format(time.RFC3339Nano))
+	if err := os.WriteFile(dst, code, 0o644); err != nil {
+		return "", err
+	}
+
+	overlay, err := json.Marshal(map[string]any{
+		"Replace": map[string]string{src: dst},
+	})
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(w.outDir, name+".json")
+	return path, os.WriteFile(path, overlay, 0o644)
+}
+
+// goFiles returns the names of the files in dir that go in the plugin, sorted.
+func goFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		name := filepath.Base(file)
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// snapshot returns a hash of the names and contents of the Go files in dir,
+// which changes whenever one of them does.
+func snapshot(dir string) (string, error) {
+	files, err := goFiles(dir)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, file := range files {
+		f, err := os.Open(filepath.Join(dir, file))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed since the glob.
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", file)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	write("a.go", "package main")
+	first, err := snapshot(dir)
+	require.NoError(t, err)
+
+	// Other files don't matter.
+	write("notes.txt", "hello")
+	second, err := snapshot(dir)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	write("a.go", "package main\n")
+	third, err := snapshot(dir)
+	require.NoError(t, err)
+	assert.NotEqual(t, first, third)
+}
@@ -0,0 +1,60 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pboyd/redefine/internal/buildtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestReload sends two builds of testdata/plugin to testdata/host, which can
+// only load them both if their plugin paths differ.
+func TestReload(t *testing.T) {
+	buildtest.RequireCgo(t)
+
+	host := buildtest.Build(t, "./testdata/host")
+	socket := filepath.Join(t.TempDir(), "live.sock")
+	cmd := exec.Command(host, socket)
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	lines := bufio.NewScanner(stdout)
+	require.True(t, lines.Scan(), stderr.String())
+	require.Equal(t, "ready", lines.Text())
+
+	dir := "./testdata/plugin"
+	before, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	w := &watcher{
+		dir:    dir,
+		socket: socket,
+		outDir: t.TempDir(),
+	}
+	require.NoError(t, w.reload())
+	require.NoError(t, w.reload())
+
+	// Nothing was written next to the source.
+	after, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	stdin.Close()
+	require.True(t, lines.Scan(), stderr.String())
+	assert.Equal(t, "ok", lines.Text())
+	assert.NoError(t, cmd.Wait(), stderr.String())
+}
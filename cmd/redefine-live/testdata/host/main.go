@@ -0,0 +1,48 @@
+// Command host serves the socket given as its argument with ServePlugins until
+// its input is closed, then checks that greeting was redefined by the plugin
+// in ../plugin.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pboyd/redefine/hotswap"
+)
+
+//go:noinline
+func greeting(name string) string {
+	return "hello " + name
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s socket\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	if err := run(os.Args[1]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
+func run(socket string) error {
+	stop, err := hotswap.ServePlugins(socket)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	fmt.Println("ready")
+
+	if _, err := io.Copy(io.Discard, os.Stdin); err != nil {
+		return err
+	}
+
+	if got, want := greeting("world"), "live hi world"; got != want {
+		return fmt.Errorf("greeting returned %q, want %q", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+// Package main redefines greeting in ../host.
+package main
+
+var Redefinitions = map[string]string{
+	"main.greeting": "Greeting",
+}
+
+func Greeting(name string) string {
+	return "live hi " + name
+}
+
+func main() {}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// cachedTargets returns the same packages as loadTargets, but saves them
+// between runs. The go command starts the tool for every package it compiles,
+// and parsing each test file every time would add up in a large module. The
+// saved packages are used while none of the files they came from have
+// changed, which only takes a stat of each one to check.
+func cachedTargets(file, dir string) (map[string]bool, error) {
+	cacheFile, err := targetsCacheFile(file, dir)
+	if err != nil {
+		return loadTargets(file, dir)
+	}
+
+	sum, err := targetsFingerprint(file, dir)
+	if err != nil {
+		return loadTargets(file, dir)
+	}
+
+	if content, err := os.ReadFile(cacheFile); err == nil {
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		if lines[0] == sum {
+			pkgs := map[string]bool{}
+			for _, pkg := range lines[1:] {
+				pkgs[pkg] = true
+			}
+			return pkgs, nil
+		}
+	}
+
+	pkgs, err := loadTargets(file, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Failing to save them only costs time on the next run.
+	var b strings.Builder
+	fmt.Fprintln(&b, sum)
+	for _, pkg := range slices.Sorted(maps.Keys(pkgs)) {
+		fmt.Fprintln(&b, pkg)
+	}
+	_ = writeFileAtomic(cacheFile, []byte(b.String()))
+
+	return pkgs, nil
+}
+
+// targetsCacheFile returns the file the packages for file and dir are saved
+// in.
+func targetsCacheFile(file, dir string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(file + "\x00" + dir))
+	return filepath.Join(cacheDir, "redefine-toolexec", hex.EncodeToString(h[:])[:16]), nil
+}
+
+// targetsFingerprint returns a hash of the names, sizes and modification
+// times of the files the packages are read from: the targets file, and the
+// test and go.mod files under dir and the go.mod above it. The tool itself is
+// included, since a new version may find different packages.
+func targetsFingerprint(file, dir string) (string, error) {
+	h := sha256.New()
+
+	if exe, err := os.Executable(); err == nil {
+		statFile(h, exe)
+	}
+
+	if file != "" {
+		if err := statFile(h, file); err != nil {
+			return "", err
+		}
+	}
+
+	if dir != "" {
+		for root := filepath.Dir(dir); ; root = filepath.Dir(root) {
+			if statFile(h, filepath.Join(root, "go.mod")) == nil || filepath.Dir(root) == root {
+				break
+			}
+		}
+
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != dir && skipDir(d.Name()) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.HasSuffix(path, "_test.go") || d.Name() == "go.mod" {
+				return statFile(h, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// statFile writes the name, size and modification time of path to h.
+func statFile(h hash.Hash, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+	return nil
+}
+
+// writeFileAtomic writes a file through a temporary one, so the compiles the
+// go command runs in parallel don't see it half written.
+func writeFileAtomic(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
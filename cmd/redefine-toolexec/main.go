@@ -0,0 +1,202 @@
+// Command redefine-toolexec turns off inlining in the packages with functions
+// that will be redefined, and leaves the rest of the build alone. It runs
+// under go build or go test:
+//
+//	go test -toolexec="redefine-toolexec -scan $PWD" ./...
+//
+// The compiler copies small functions into their callers, and the copies
+// aren't affected when the function is redefined. //go:noinline prevents that,
+// but it can't be added to the standard library or a dependency. So the
+// compiler is run with -l for the packages that have targets. It doesn't
+// inline anything in them, and doesn't export their bodies for other packages
+// to inline either.
+//
+// With -scan, the targets are found in calls to redefine.Func, Method and the
+// others in the test files under a directory. Only targets named through a
+// package, like strings.ToUpper or (*bytes.Buffer).Len, are found that way,
+// and anything else is taken to be in the package of the test. With -targets,
+// they're read from a file with a function name, as redefine.Functions reports
+// it, or an import path on each line:
+//
+//	# Comments and blank lines are ignored.
+//	strings.ToUpper
+//	bytes.(*Buffer).Len
+//	example.com/app/internal/clock
+//
+// Both can be used. The paths must be absolute, since the go command runs the
+// compiler in the directory of each package.
+//
+// The go command runs the tool once for each package, so the packages are
+// saved in the user's cache directory and only found again when the targets
+// file or one of the test files has changed.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("redefine-toolexec: ")
+
+	targetsFile := flag.String("targets", "", "file listing the functions to redefine")
+	scanDir := flag.String("scan", "", "directory to scan for redefined functions in test files")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: go build -toolexec=\"%s [flags]\"\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 || *targetsFile == "" && *scanDir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if toolName(args[0]) == "compile" {
+		pkgs, err := cachedTargets(*targetsFile, *scanDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if slices.Contains(args[1:], "-V=full") {
+			out, err := exec.Command(args[0], args[1:]...).Output()
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(versionLine(string(out), pkgs))
+			return
+		}
+
+		args = compileArgs(args, pkgs)
+	}
+
+	os.Exit(run(args))
+}
+
+// run runs the tool and returns its exit code.
+func run(args []string) int {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// toolName returns the name of the tool at path, such as "compile".
+func toolName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".exe")
+}
+
+// loadTargets returns the import paths of the packages with targets, from the
+// file and the test files under dir. Either can be "".
+func loadTargets(file, dir string) (map[string]bool, error) {
+	pkgs := map[string]bool{}
+
+	if file != "" {
+		if !filepath.IsAbs(file) {
+			return nil, fmt.Errorf("-targets %s: the path must be absolute", file)
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			pkgs[funcPackage(line)] = true
+		}
+	}
+
+	if dir != "" {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("-scan %s: the path must be absolute", dir)
+		}
+		if err := scanTests(dir, pkgs); err != nil {
+			return nil, err
+		}
+	}
+
+	return pkgs, nil
+}
+
+// funcPackage returns the import path of the package of a function, given
+// its full name. A name without a function is returned as is.
+func funcPackage(name string) string {
+	if i := strings.IndexByte(name, '['); i >= 0 {
+		name = name[:i]
+	}
+
+	slash := strings.LastIndexByte(name, '/')
+	if i := strings.IndexByte(name[slash+1:], '.'); i >= 0 {
+		return name[:slash+1+i]
+	}
+	return name
+}
+
+// compileArgs adds -l to the arguments of the compiler when it's compiling
+// one of pkgs.
+func compileArgs(args []string, pkgs map[string]bool) []string {
+	var pkg string
+	for i, arg := range args[1:] {
+		if arg == "-p" && i+2 < len(args) {
+			pkg = args[i+2]
+			break
+		}
+		if p, ok := strings.CutPrefix(arg, "-p="); ok {
+			pkg = p
+			break
+		}
+	}
+	if !pkgs[pkg] {
+		return args
+	}
+
+	// Each -l counts, and a second one turns inlining back on.
+	if slices.Contains(args[1:], "-l") {
+		return args
+	}
+
+	return slices.Insert(slices.Clone(args), 1, "-l")
+}
+
+// versionLine adds a hash of the packages to the compiler's -V=full output.
+// The go command caches what it builds under the compiler's version, so the
+// packages have to be part of it, or a changed list would go unnoticed.
+func versionLine(line string, pkgs map[string]bool) string {
+	h := sha256.New()
+	for _, pkg := range slices.Sorted(maps.Keys(pkgs)) {
+		fmt.Fprintf(h, "%s\n", pkg)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))[:16]
+
+	// Development versions of Go only look at the build ID, which is
+	// last.
+	line = strings.TrimSpace(line)
+	if f := strings.Fields(line); len(f) > 0 && strings.HasPrefix(f[len(f)-1], "buildID=") {
+		return line + "+redefine-" + sum
+	}
+	return line + " redefine-" + sum
+}
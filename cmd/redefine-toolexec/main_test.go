@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanTests(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	write("go.mod", "module example.com/app\n")
+	write("server/server_test.go", `package server
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pboyd/redefine"
+	yaml "gopkg.in/yaml.v3"
+	"example.com/lib/v2"
+)
+
+func TestX(t *testing.T) {
+	redefine.Func(strings.ToUpper, func(string) string { return "" })
+	redefine.Method((*bytes.Buffer).Len, func(*bytes.Buffer) int { return 0 })
+	redefine.MethodByName(reflect.TypeFor[*yaml.Node](), "Decode", nil)
+	redefine.FuncByName("net/http.Get", nil)
+	redefine.Func(lib.F, nil)
+	redefine.Func(local, nil)
+
+	// Not redefined.
+	strings.ToLower("")
+}
+`)
+	write("client/client_test.go", `package client_test
+
+import (
+	"testing"
+
+	r "github.com/pboyd/redefine"
+)
+
+func TestY(t *testing.T) {
+	r.Func(local, nil)
+}
+`)
+	// Not scanned.
+	write("testdata/x_test.go", `package x
+
+import (
+	"os"
+
+	"github.com/pboyd/redefine"
+)
+
+func init() { redefine.Func(os.Exit, nil) }
+`)
+
+	pkgs := map[string]bool{}
+	require.NoError(t, scanTests(dir, pkgs))
+	assert.Equal(t, map[string]bool{
+		"strings":                     true,
+		"bytes":                       true,
+		"gopkg.in/yaml.v3":            true,
+		"net/http":                    true,
+		"example.com/lib/v2":          true,
+		"example.com/app/server":      true,
+		"example.com/app/client_test": true,
+	}, pkgs)
+}
+
+func TestLoadTargets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "targets")
+	require.NoError(t, os.WriteFile(file, []byte(`
+# Comment
+strings.ToUpper
+  bytes.(*Buffer).Len
+example.com/app/internal/clock
+example.com/app.Run[...]
+`), 0o644))
+
+	pkgs, err := loadTargets(file, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		"strings":                        true,
+		"bytes":                          true,
+		"example.com/app/internal/clock": true,
+		"example.com/app":                true,
+	}, pkgs)
+
+	_, err = loadTargets("targets", "")
+	assert.Error(t, err)
+}
+
+func TestCachedTargets(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LocalAppData", t.TempDir())
+
+	file := filepath.Join(t.TempDir(), "targets")
+	require.NoError(t, os.WriteFile(file, []byte("strings.ToUpper\n"), 0o644))
+
+	pkgs, err := cachedTargets(file, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"strings": true}, pkgs)
+
+	cacheFile, err := targetsCacheFile(file, "")
+	require.NoError(t, err)
+	assert.FileExists(t, cacheFile)
+
+	pkgs, err = cachedTargets(file, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"strings": true}, pkgs)
+
+	require.NoError(t, os.WriteFile(file, []byte("strings.ToUpper\nbytes.Equal\n"), 0o644))
+	pkgs, err = cachedTargets(file, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"strings": true, "bytes": true}, pkgs)
+}
+
+func TestCompileArgs(t *testing.T) {
+	pkgs := map[string]bool{"strings": true}
+
+	assert.Equal(t,
+		[]string{"/go/compile", "-l", "-o", "out.a", "-p", "strings", "a.go"},
+		compileArgs([]string{"/go/compile", "-o", "out.a", "-p", "strings", "a.go"}, pkgs),
+	)
+	assert.Equal(t,
+		[]string{"/go/compile", "-o", "out.a", "-p", "bytes", "a.go"},
+		compileArgs([]string{"/go/compile", "-o", "out.a", "-p", "bytes", "a.go"}, pkgs),
+	)
+	assert.Equal(t,
+		[]string{"/go/compile", "-p", "strings", "-l", "a.go"},
+		compileArgs([]string{"/go/compile", "-p", "strings", "-l", "a.go"}, pkgs),
+	)
+}
+
+func TestVersionLine(t *testing.T) {
+	a := versionLine("compile version go1.25.0\n", map[string]bool{"strings": true})
+	b := versionLine("compile version go1.25.0\n", map[string]bool{"bytes": true})
+	assert.Regexp(t, `^compile version go1.25.0 redefine-[0-9a-f]+$`, a)
+	assert.NotEqual(t, a, b)
+
+	assert.Regexp(t, `^compile version devel buildID=abc/def\+redefine-[0-9a-f]+$`,
+		versionLine("compile version devel buildID=abc/def\n", map[string]bool{"strings": true}))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+const redefinePath = "github.com/pboyd/redefine"
+
+// scanTests adds the packages of the functions redefined in the test files
+// under dir to pkgs.
+func scanTests(dir string, pkgs map[string]bool) error {
+	fset := token.NewFileSet()
+	return filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if file != dir && skipDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(file, "_test.go") {
+			return nil
+		}
+
+		f, err := parser.ParseFile(fset, file, nil, parser.SkipObjectResolution)
+		if err != nil {
+			return err
+		}
+		own, err := importPath(filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+		if own != "" && strings.HasSuffix(f.Name.Name, "_test") {
+			own += "_test"
+		}
+		scanFile(f, own, pkgs)
+		return nil
+	})
+}
+
+// skipDir reports whether a directory named name is left out of a scan, like
+// the go command leaves it out of ./...
+func skipDir(name string) bool {
+	return name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// scanFile adds the packages of the functions redefined in f to pkgs. own is
+// the import path of f's package.
+func scanFile(f *ast.File, own string, pkgs map[string]bool) {
+	imports := map[string]string{}
+	for _, imp := range f.Imports {
+		p, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		name := importName(p)
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		imports[name] = p
+	}
+
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+
+		fun := call.Fun
+		var typeArgs []ast.Expr
+		switch x := fun.(type) {
+		case *ast.IndexExpr:
+			fun, typeArgs = x.X, []ast.Expr{x.Index}
+		case *ast.IndexListExpr:
+			fun, typeArgs = x.X, x.Indices
+		}
+		sel, ok := fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); !ok || imports[x.Name] != redefinePath {
+			return true
+		}
+
+		arg := func(i int) ast.Expr {
+			if i < len(call.Args) {
+				return call.Args[i]
+			}
+			return nil
+		}
+
+		var target ast.Expr
+		switch sel.Sel.Name {
+		case "Func", "Method", "MethodByName":
+			target = arg(0)
+		case "MethodFor", "Itab":
+			target = arg(1)
+		case "MethodSet":
+			if len(typeArgs) > 0 {
+				target = typeArgs[0]
+			}
+		case "FuncByName", "Package":
+			if lit, ok := arg(0).(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if name, err := strconv.Unquote(lit.Value); err == nil {
+					pkgs[funcPackage(name)] = true
+				}
+			}
+			return true
+		}
+		if target != nil {
+			for _, pkg := range exprPackages(target, imports, own) {
+				pkgs[pkg] = true
+			}
+		}
+		return true
+	})
+}
+
+// importName returns the default name of the package imported from p, which is
+// the last element of the path that isn't a major version.
+func importName(p string) string {
+	name := path.Base(p)
+	if dir := path.Dir(p); dir != "." && len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		name = path.Base(dir)
+	}
+	return name
+}
+
+// exprPackages returns the packages that e refers to, other than reflect, or
+// own if it doesn't refer to any and isn't "".
+func exprPackages(e ast.Expr, imports map[string]string, own string) []string {
+	var pkgs []string
+	ast.Inspect(e, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); ok {
+			if p, ok := imports[x.Name]; ok && p != "reflect" {
+				pkgs = append(pkgs, p)
+			}
+		}
+		return true
+	})
+	if len(pkgs) == 0 && own != "" {
+		return []string{own}
+	}
+	return pkgs
+}
+
+// importPath returns the import path of the package in dir, from the go.mod
+// file of its module.
+func importPath(dir string) (string, error) {
+	for root := dir; ; {
+		content, err := os.ReadFile(filepath.Join(root, "go.mod"))
+		if err == nil {
+			rel, err := filepath.Rel(root, dir)
+			if err != nil {
+				return "", err
+			}
+			return path.Join(modfile.ModulePath(content), filepath.ToSlash(rel)), nil
+		}
+
+		parent := filepath.Dir(root)
+		if parent == root {
+			// Not in a module. Unqualified targets won't be found.
+			return "", nil
+		}
+		root = parent
+	}
+}
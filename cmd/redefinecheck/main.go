@@ -0,0 +1,16 @@
+// Command redefinecheck reports misuse of the redefine package. See package
+// redefinecheck for what it checks.
+//
+// It can run on its own, or through go vet:
+//
+//	go vet -vettool=$(which redefinecheck) ./...
+package main
+
+import (
+	"github.com/pboyd/redefine/redefinecheck"
+	"golang.org/x/tools/go/analysis/singlechecker"
+)
+
+func main() {
+	singlechecker.Main(redefinecheck.Analyzer)
+}
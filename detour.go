@@ -0,0 +1,139 @@
+package redefine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// detourFunc makes a copy of a function by moving only the instructions that
+// the jump to the new function will overwrite. The copy runs those, then jumps
+// back to the rest of the original function. That's faster and smaller than
+// relocating the whole function, and the body keeps running from its original
+// address.
+//
+// An error is returned if the prologue can't be moved safely. cloneFunc still
+// works in that case.
+func detourFunc[T any](fn T) (*clonedFunc[T], error) {
+	fnv := reflect.ValueOf(fn)
+	if fnv.Kind() != reflect.Func {
+		return nil, fmt.Errorf("not a function, kind: %v", fnv.Kind())
+	}
+
+	code, err := funcSlice(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	n, backJumps, err := detourPrologue(code)
+	if err != nil {
+		return nil, err
+	}
+
+	alloc := allocatorFor(fnv.Pointer())
+	alloc.BeginMutate()
+	defer alloc.EndMutate()
+
+	buf, err := alloc.Allocate(detourSize(n))
+	if err != nil {
+		return nil, err
+	}
+
+	detour, err := writeDetour(code, n, buf)
+	if err != nil {
+		alloc.Free(buf)
+		return nil, err
+	}
+
+	// Make sure the jumps back to the start of the function can reach the
+	// detour before committing to it.
+	start := uintptr(unsafe.Pointer(unsafe.SliceData(detour)))
+	for _, offset := range backJumps {
+		_, err = encodeRedirect(code, offset, start)
+		if err != nil {
+			alloc.Free(buf)
+			return nil, err
+		}
+	}
+
+	cacheflush(detour)
+
+	cf := clonedFunc[T]{
+		alloc:        alloc,
+		originalCode: bytes.Clone(code),
+		entry:        fnv.Pointer(),
+		detour:       detour,
+		prologueLen:  n,
+		backJumps:    backJumps,
+		name:         symbolName(fnv.Pointer()),
+	}
+	addSymbol(detour, cf.name, "detour")
+	cf.Func, cf.ref = makeFunc[T](detour)
+
+	return &cf, nil
+}
+
+// fullClone makes a complete copy of a function that was cloned with
+// detourFunc, for callers that need all the instructions in one place.
+//
+// The caller must hold mu.
+func (cf *clonedFunc[T]) fullClone() error {
+	cf.alloc.BeginMutate()
+	defer cf.alloc.EndMutate()
+
+	buf, err := cf.alloc.Allocate(relocatedSize(cf.originalCode))
+	if err != nil {
+		return err
+	}
+
+	code, err := relocateFuncAt(cf.originalCode, cf.entry, buf, nil)
+	if err != nil {
+		cf.alloc.Free(buf)
+		return fmt.Errorf("unable to clone function: %w", err)
+	}
+	cacheflush(code)
+	addSymbol(code, cf.name, "copy")
+
+	cf.clonedCode = code
+	return nil
+}
+
+// patch writes a jump to dest at the start of code, which is the function
+// that was cloned. For detours, only the prologue is overwritten and the jumps
+// back to the start of the function are sent to the detour instead.
+//
+// If dest is too far away for the jump to fit, such as a function in a plugin
+// loaded far from the program, the jump goes through a trampoline in the
+// arena, which is always close.
+//
+// The caller must hold mu and make code writable.
+func (cf *clonedFunc[T]) patch(code []byte, dest uintptr) error {
+	if cf.detour != nil {
+		start := uintptr(unsafe.Pointer(unsafe.SliceData(cf.detour)))
+		for _, offset := range cf.backJumps {
+			raw, err := encodeRedirect(code, offset, start)
+			if err != nil {
+				return err
+			}
+			copy(code[offset:], raw)
+		}
+
+		code = code[:cf.prologueLen]
+	}
+
+	err := insertJump(code, dest)
+	if errors.Is(err, errAddressOutOfRange) && cf.alloc != nil {
+		// There's no room for a long jump, so take a short one to a
+		// trampoline that makes the long jump.
+		dest, err = cf.addTrampoline(absJumpSize, func(buf []byte) error {
+			return insertJump(buf, dest)
+		})
+		if err != nil {
+			return err
+		}
+		err = insertJump(code, dest)
+	}
+	return err
+}
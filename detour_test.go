@@ -0,0 +1,64 @@
+//go:build amd64 || arm64
+
+package redefine
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDetourTarget has a frame that's bigger than a new goroutine's stack, so
+// calling it from one always goes through runtime.morestack.
+//
+//go:noinline
+func testDetourTarget(n int) int {
+	var buf [16 << 10]byte
+	buf[n%len(buf)] = byte(n)
+	return int(buf[n%len(buf)]) + 1
+}
+
+func TestDetourFunc(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cf, err := detourFunc(testDetourTarget)
+	require.NoError(err)
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		cf.Free()
+	})
+
+	assert.NotNil(cf.detour)
+	assert.Less(len(cf.detour), len(cf.originalCode))
+	assert.Equal(8, cf.Func(7))
+
+	require.NoError(Func(testDetourTarget, func(int) int { return -1 }))
+	t.Cleanup(func() { Restore(testDetourTarget) })
+	assert.Equal(-1, testDetourTarget(7))
+
+	mu.RLock()
+	cloned := redefined[reflect.ValueOf(testDetourTarget).Pointer()].(*clonedFunc[func(int) int])
+	assert.NotNil(cloned.detour)
+	mu.RUnlock()
+
+	original := Original(testDetourTarget)
+	assert.Equal(8, original(7))
+
+	// Grow the stack from the detour.
+	done := make(chan int)
+	go func() { done <- original(7) }()
+	assert.Equal(8, <-done)
+
+	// The rest of the function still needs to be copied for options.
+	recursive := Original(testDetourTarget, Recursive())
+	require.NotNil(recursive)
+	assert.Equal(8, recursive(7))
+
+	require.NoError(Restore(testDetourTarget))
+	go func() { done <- testDetourTarget(7) }()
+	assert.Equal(8, <-done)
+}
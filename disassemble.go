@@ -0,0 +1,357 @@
+package redefine
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+// Disassembly is a listing of machine code, along with how it differs from
+// the original function.
+type Disassembly struct {
+	// Name is the name of the function.
+	Name string
+
+	// Addr is where the listed code runs from.
+	Addr uintptr
+
+	// Code is the listing.
+	Code []Instruction
+
+	// Changes are the differences from the original function, in order.
+	Changes []Change
+}
+
+// Instruction is one machine instruction.
+type Instruction struct {
+	// Addr is where the instruction runs from.
+	Addr uintptr
+
+	// Offset is the distance from the start of the listing.
+	Offset int
+
+	Bytes []byte
+
+	// Text is the instruction in Go assembler syntax, or "?" if it
+	// couldn't be decoded.
+	Text string
+}
+
+// Change is a difference between a function and a patched or relocated
+// version of it. Before and After are the instructions that differ, side by
+// side.
+type Change struct {
+	Kind ChangeKind
+
+	// Offset is the distance from the start of the original function.
+	Offset int
+
+	Before []Instruction
+	After  []Instruction
+}
+
+// ChangeKind describes why code was changed.
+type ChangeKind int
+
+const (
+	// ChangeJump is the jump to the new function written at the entry
+	// point.
+	ChangeJump ChangeKind = iota + 1
+
+	// ChangeRedirect is a jump back to the start of the function, like the
+	// one after a stack check, that was sent to the copy of the prologue.
+	ChangeRedirect
+
+	// ChangeRelocated is an instruction in a copy with a relative address
+	// that was rewritten to reach the same target.
+	ChangeRelocated
+
+	// ChangeAdded is code in a copy that isn't in the original, like the
+	// jump back to the function after a moved prologue.
+	ChangeAdded
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeJump:
+		return "jump"
+	case ChangeRedirect:
+		return "redirect"
+	case ChangeRelocated:
+		return "relocated"
+	case ChangeAdded:
+		return "added"
+	default:
+		return fmt.Sprintf("ChangeKind(%d)", int(k))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (k ChangeKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Disassemble returns the code currently at the entry point of fn. If fn has
+// been redefined, the changes show the jump that was inserted, side by side
+// with the instructions it replaced.
+func Disassemble(fn any) (*Disassembly, error) {
+	entry, err := disassemblyEntry(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return disassembleEntry(entry)
+}
+
+// DisassembleOriginal returns the code that runs when the function returned
+// by Original is called. If fn has been redefined that's a copy, and the
+// changes show every instruction that was rewritten to run from the new
+// address. Otherwise, it's the same as Disassemble.
+func DisassembleOriginal(fn any) (*Disassembly, error) {
+	entry, err := disassemblyEntry(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	pc, ok := redefined[entry].(patchedCode)
+	if !ok {
+		return disassembleEntry(entry)
+	}
+
+	copied, n := pc.copied()
+	if copied == nil {
+		return nil, errors.New("redefined function has no clone")
+	}
+
+	info := findfunc(entry)
+	f := makeFunction(info)
+	original := pc.original()
+	before := decodeInstructions(original[:min(n, int(f.Size), len(original))], entry)
+
+	d := &Disassembly{
+		Name: f.Name,
+		Addr: uintptr(unsafe.Pointer(unsafe.SliceData(copied))),
+	}
+	d.Code, d.Changes = diffCopy(before, copied)
+
+	return d, nil
+}
+
+// disassemblyEntry returns the entry point of fn, which must be a function.
+func disassemblyEntry(fn any) (uintptr, error) {
+	fnv := reflect.ValueOf(fn)
+	if fnv.Kind() != reflect.Func || fnv.IsNil() {
+		return 0, fmt.Errorf("not a function, kind: %v", fnv.Kind())
+	}
+	return fnv.Pointer(), nil
+}
+
+// diffCopy decodes copied and compares it with before, the instructions it was
+// copied from.
+func diffCopy(before []Instruction, copied []byte) ([]Instruction, []Change) {
+	after := decodeInstructions(copied, uintptr(unsafe.Pointer(unsafe.SliceData(copied))))
+
+	// Drop the padding at the end. Relocated code has the same padding as
+	// the original.
+	for len(after) > len(before) && isPadding(after[len(after)-1]) {
+		after = after[:len(after)-1]
+	}
+
+	// Instructions are copied one for one, although they may change
+	// size. Anything extra is at the end.
+	var changes []Change
+	for i := range min(len(before), len(after)) {
+		if bytes.Equal(before[i].Bytes, after[i].Bytes) {
+			continue
+		}
+		changes = append(changes, Change{
+			Kind:   ChangeRelocated,
+			Offset: before[i].Offset,
+			Before: before[i : i+1],
+			After:  after[i : i+1],
+		})
+	}
+	if len(after) > len(before) {
+		end := 0
+		if len(before) > 0 {
+			last := before[len(before)-1]
+			end = last.Offset + len(last.Bytes)
+		}
+		changes = append(changes, Change{
+			Kind:   ChangeAdded,
+			Offset: end,
+			After:  after[len(before):],
+		})
+	}
+
+	return after, changes
+}
+
+// disassembleEntry returns the code at entry, compared with the code that was
+// there before it was patched.
+//
+// The caller must hold mu.
+func disassembleEntry(entry uintptr) (*Disassembly, error) {
+	info := findfunc(entry)
+	if info._func == nil {
+		return nil, fmt.Errorf("no function found at 0x%x", entry)
+	}
+	f := makeFunction(info)
+
+	code, err := funcSliceAt(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Disassembly{
+		Name: f.Name,
+		Addr: entry,
+	}
+
+	size := min(int(f.Size), len(code))
+	if pc, ok := redefined[entry].(patchedCode); ok {
+		d.Changes = diffPatch(pc.original(), code, entry)
+
+		// A jump can be longer than a small function.
+		for _, c := range d.Changes {
+			last := c.After[len(c.After)-1]
+			size = max(size, last.Offset+len(last.Bytes))
+		}
+	}
+
+	d.Code = decodeInstructions(code[:size], entry)
+
+	return d, nil
+}
+
+// diffPatch compares the code at entry before and after it was patched. The
+// patch can overwrite part of an instruction, so each change is extended until
+// the instructions line up again.
+func diffPatch(original, current []byte, entry uintptr) []Change {
+	n := min(len(original), len(current))
+	before := decodeInstructions(original[:n], entry)
+	after := decodeInstructions(current[:n], entry)
+
+	// Offsets where an instruction starts in both versions.
+	starts := map[int]int{n: 2}
+	for _, inst := range before {
+		starts[inst.Offset]++
+	}
+	for _, inst := range after {
+		starts[inst.Offset]++
+	}
+	aligned := func(offset int) bool {
+		return starts[offset] == 2
+	}
+
+	var changes []Change
+	for i := 0; i < n; i++ {
+		if original[i] == current[i] {
+			continue
+		}
+
+		start := i
+		for !aligned(start) {
+			start--
+		}
+		end := i + 1
+		for !aligned(end) {
+			end++
+		}
+
+		kind := ChangeRedirect
+		if start == 0 {
+			kind = ChangeJump
+		}
+		changes = append(changes, Change{
+			Kind:   kind,
+			Offset: start,
+			Before: instructionsBetween(before, start, end),
+			After:  instructionsBetween(after, start, end),
+		})
+
+		i = end - 1
+	}
+
+	return changes
+}
+
+// instructionsBetween returns the instructions that start in [start, end).
+func instructionsBetween(insts []Instruction, start, end int) []Instruction {
+	var between []Instruction
+	for _, inst := range insts {
+		if inst.Offset >= start && inst.Offset < end {
+			between = append(between, inst)
+		}
+	}
+	return between
+}
+
+// isPadding reports whether inst is padding between functions.
+func isPadding(inst Instruction) bool {
+	for _, b := range inst.Bytes {
+		if b != codePadding {
+			return false
+		}
+	}
+	return true
+}
+
+// symbolize returns the name and entry point of the function that contains
+// addr, for the disassemblers.
+func symbolize(addr uint64) (string, uint64) {
+	info := findfunc(uintptr(addr))
+	if info._func == nil {
+		return "", 0
+	}
+	return funcName(info), uint64(info.datap.text + uintptr(info.entryOff))
+}
+
+// String returns the listing, followed by the changes side by side.
+func (d *Disassembly) String() string {
+	var buf strings.Builder
+
+	fmt.Fprintf(&buf, "%s at 0x%x:\n", d.Name, d.Addr)
+	for _, inst := range d.Code {
+		buf.WriteString(inst.String())
+		buf.WriteByte('\n')
+	}
+
+	width := 0
+	for _, c := range d.Changes {
+		for _, inst := range c.Before {
+			width = max(width, len(inst.String()))
+		}
+	}
+
+	for _, c := range d.Changes {
+		fmt.Fprintf(&buf, "\n%s at +0x%x:\n", c.Kind, c.Offset)
+		for i := range max(len(c.Before), len(c.After)) {
+			var before, after string
+			if i < len(c.Before) {
+				before = c.Before[i].String()
+			}
+			if i < len(c.After) {
+				after = c.After[i].String()
+			}
+			fmt.Fprintf(&buf, "%-*s | %s\n", width, before, after)
+		}
+	}
+
+	return buf.String()
+}
+
+// String formats the instruction as address, bytes and text.
+func (inst Instruction) String() string {
+	return fmt.Sprintf("0x%08x  %-20s  %s", inst.Addr, hex.EncodeToString(inst.Bytes), inst.Text)
+}
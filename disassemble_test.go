@@ -0,0 +1,78 @@
+package redefine
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisassemble(t *testing.T) {
+	d, err := Disassemble(a)
+	require.NoError(t, err)
+	assert.Equal(t, "github.com/pboyd/redefine.a", d.Name)
+	assert.Equal(t, reflect.ValueOf(a).Pointer(), d.Addr)
+	assert.NotEmpty(t, d.Code)
+	assert.Empty(t, d.Changes)
+
+	original, err := DisassembleOriginal(a)
+	require.NoError(t, err)
+	assert.Equal(t, d, original)
+
+	require.NoError(t, Func(a, b))
+	t.Cleanup(func() { Restore(a) })
+
+	d, err = Disassemble(a)
+	require.NoError(t, err)
+	require.NotEmpty(t, d.Changes)
+	jump := d.Changes[0]
+	assert.Equal(t, ChangeJump, jump.Kind)
+	assert.Equal(t, 0, jump.Offset)
+	assert.NotEmpty(t, jump.Before)
+	assert.Contains(t, jump.After[0].Text, "redefine.b")
+	assert.Equal(t, d.Code[0], jump.After[0])
+	assert.Contains(t, d.String(), "jump at +0x0:")
+
+	original, err = DisassembleOriginal(a)
+	require.NoError(t, err)
+	assert.Equal(t, reflect.ValueOf(Original(a)).Pointer(), original.Addr)
+	assert.Equal(t, strings.Fields(jump.Before[0].Text)[0], strings.Fields(original.Code[0].Text)[0])
+
+	out, err := json.Marshal(d)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `"Kind":"jump"`)
+
+	_, err = Disassemble(42)
+	assert.Error(t, err)
+}
+
+func TestDiffCopy(t *testing.T) {
+	cf, err := cloneFunc(testCloneFuncWithLotsOfCalls)
+	require.NoError(t, err)
+	t.Cleanup(cf.Free)
+
+	entry := reflect.ValueOf(testCloneFuncWithLotsOfCalls).Pointer()
+	before := decodeInstructions(cf.originalCode, entry)
+	code, changes := diffCopy(before, cf.clonedCode)
+	require.NotEmpty(t, code)
+	require.NotEmpty(t, changes)
+
+	// The calls out of the function have new displacements, but still go
+	// to the same place.
+	sameTarget := 0
+	for _, c := range changes {
+		if c.Kind != ChangeRelocated {
+			continue
+		}
+		require.Len(t, c.Before, 1)
+		require.Len(t, c.After, 1)
+		assert.NotEqual(t, c.Before[0].Bytes, c.After[0].Bytes)
+		if c.Before[0].Text == c.After[0].Text && strings.Contains(c.After[0].Text, "(SB)") {
+			sameTarget++
+		}
+	}
+	assert.NotZero(t, sameTarget)
+}
@@ -9,6 +9,9 @@
 //   - Might work (untested, but it compiles): FreeBSD/amd64, OpenBSD/amd64, NetBSD/amd64
 //   - Known broken: Darwin/arm64 (EACCES errors from mprotect)
 //
+// Functions can be redefined in programs built with -buildmode=exe, pie,
+// c-shared and plugin, including functions in plugins and shared libraries.
+//
 // Other limitations:
 //   - Relies on internal Go APIs that can break at any time
 //   - Silently fails to redefine inline and generic functions
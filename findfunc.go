@@ -1,6 +1,14 @@
 package redefine
 
-import _ "unsafe"
+import (
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"sync"
+	"unsafe"
+)
 
 type funcInfo struct {
 	*_func
@@ -28,34 +36,35 @@ type _func struct {
 	nfuncdata uint8   // must be last, must end on a uint32-aligned boundary
 }
 
-// moduledata records information about the layout of the executable
-// image. It is written by the linker. Any changes here must be
-// matched changes to the code in cmd/link/internal/ld/symtab.go:symtab.
-// moduledata is stored in statically allocated non-pointer memory;
-// none of the pointers here are visible to the garbage collector.
-type moduledata struct {
-	pcHeader     *pcHeader
-	funcnametab  []byte
-	cutab        []uint32
-	filetab      []byte
-	pctab        []byte
-	pclntable    []byte
-	ftab         []functab
-	findfunctab  uintptr
-	minpc, maxpc uintptr
-
-	text, etext           uintptr
-	noptrdata, enoptrdata uintptr
-	data, edata           uintptr
-	bss, ebss             uintptr
-	noptrbss, enoptrbss   uintptr
-	covctrs, ecovctrs     uintptr
-	end, gcdata, gcbss    uintptr
-	types, etypes         uintptr
-	rodata                uintptr
-	gofunc                uintptr // go.func.*
-
-	// Struct continues, omitting unused fields.
+// moduledata changes between versions of Go, so it's in moduledata_go*.go.
+// The types below are the parts of it that don't.
+
+type textsect struct {
+	vaddr    uintptr
+	end      uintptr
+	baseaddr uintptr
+}
+
+type ptabEntry struct {
+	name int32
+	typ  int32
+}
+
+type modulehash struct {
+	modulename   string
+	linktimehash string
+	runtimehash  *string
+}
+
+type bitvector struct {
+	n        int32
+	bytedata *uint8
+}
+
+// stackmap mirrors the header of runtime.stackmap. The bitmaps follow it.
+type stackmap struct {
+	n    int32 // number of bitmaps
+	nbit int32 // number of bits in each bitmap
 }
 
 // pcHeader holds data used by the pclntab lookups.
@@ -81,3 +90,219 @@ type functab struct {
 
 //go:linkname findfunc runtime.findfunc
 func findfunc(pc uintptr) funcInfo
+
+// lastmoduledatap is the most recently loaded module.
+//
+//go:linkname lastmoduledatap runtime.lastmoduledatap
+var lastmoduledatap *moduledata
+
+// typelinks returns the start of the types section for every active module,
+// in order, along with the offsets of the types in each one.
+//
+//go:linkname typelinks reflect.typelinks
+func typelinks() ([]unsafe.Pointer, [][]int32)
+
+// modules returns every loaded module, starting with the one that contains
+// the runtime.
+func modules() []*moduledata {
+	first := findfunc(reflect.ValueOf(runtime.GC).Pointer()).datap
+	sections, _ := typelinks()
+
+	// Walk the list of modules, as long as it matches what the runtime
+	// reports. A different version of Go may have moved next.
+	var mods []*moduledata
+	ok := func() (ok bool) {
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer func() {
+			if recover() != nil {
+				ok = false
+			}
+		}()
+
+		for md := first; md != nil; md = md.next {
+			if md.bad {
+				continue
+			}
+			if len(mods) == len(sections) || md.types != uintptr(sections[len(mods)]) {
+				return false
+			}
+			mods = append(mods, md)
+		}
+		return len(mods) == len(sections)
+	}()
+	if ok {
+		return mods
+	}
+
+	// Settle for the modules that can be found without the list.
+	pc, _, _, _ := runtime.Caller(0)
+	mods = []*moduledata{first}
+	for _, md := range []*moduledata{findfunc(pc).datap, lastmoduledatap} {
+		if md != nil && !slices.Contains(mods, md) {
+			mods = append(mods, md)
+		}
+	}
+	return mods
+}
+
+// funcIndex caches the sizes of functions in one module.
+type funcIndex struct {
+	mu sync.Mutex
+
+	// Whether ftab is sorted by entry, which it should always be. If not,
+	// it has to be searched linearly.
+	sorted bool
+
+	lengths map[uint32]uint32
+}
+
+var (
+	funcIndexesMu sync.Mutex
+	funcIndexes   = map[*moduledata]*funcIndex{}
+)
+
+// funcIndexFor returns the index for datap, creating it if necessary.
+func funcIndexFor(datap *moduledata) *funcIndex {
+	funcIndexesMu.Lock()
+	defer funcIndexesMu.Unlock()
+
+	idx, ok := funcIndexes[datap]
+	if !ok {
+		idx = &funcIndex{
+			sorted: slices.IsSortedFunc(datap.ftab, func(a, b functab) int {
+				return int(a.entryoff) - int(b.entryoff)
+			}),
+			lengths: map[uint32]uint32{},
+		}
+		funcIndexes[datap] = idx
+	}
+	return idx
+}
+
+// funcLength returns the length in bytes of the function that starts at
+// start, including any padding after it. Small functions need the padding to
+// fit the jump.
+func funcLength(info funcInfo, start unsafe.Pointer) uint32 {
+	idx := funcIndexFor(info.datap)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	// The function may have been redefined since it was first seen, and
+	// then the padding would look different, so this has to be cached.
+	if length, ok := idx.lengths[info.entryOff]; ok {
+		return length
+	}
+
+	next := nextEntry(info, idx.sorted)
+
+	// There may be something other than Go functions before the next
+	// entry, like C code in a cgo program, so stop after the function's
+	// instructions and padding if the end is known.
+	length := next - info.entryOff
+	if end, ok := funcCodeEnd(info); ok && end > info.entryOff && end < next {
+		code := unsafe.Slice((*byte)(start), length)
+		length = end - info.entryOff
+		for length < uint32(len(code)) && code[length] == codePadding {
+			length++
+		}
+	}
+
+	idx.lengths[info.entryOff] = length
+	return length
+}
+
+// nextEntry returns the offset from text of whatever comes after the
+// function, which may be another function or the end of the text segment.
+// Entries at the same offset are skipped, since ftab can list several names
+// for the same code, like the aliases of C functions in a race build.
+func nextEntry(info funcInfo, sorted bool) uint32 {
+	// Nothing can go past the end of the text segment. The last entry in
+	// ftab marks the end too, so this only matters if it's missing.
+	next := uint32(info.datap.etext - info.datap.text)
+
+	ftab := info.datap.ftab
+	if sorted {
+		i := sort.Search(len(ftab), func(i int) bool {
+			return ftab[i].entryoff > info.entryOff
+		})
+		if i < len(ftab) {
+			next = min(next, ftab[i].entryoff)
+		}
+	} else {
+		for _, ft := range ftab {
+			if ft.entryoff > info.entryOff && ft.entryoff < next {
+				next = ft.entryoff
+			}
+		}
+	}
+
+	return next
+}
+
+// funcCodeEnd returns the offset from text of the end of the function's
+// instructions, according to its stack pointer delta table. The table covers
+// every instruction in the function.
+func funcCodeEnd(info funcInfo) (uint32, bool) {
+	var end uint32
+	ok := walkPCValue(info, info.pcsp, func(pc uint32, _ int32) bool {
+		end = pc
+		return true
+	})
+	return end, ok && end != 0
+}
+
+// walkPCValue reads the table at off in pctab, which maps PCs in the function
+// to values, the same way runtime.pcvalue does. fn is called with the end of
+// each range of PCs, as an offset from text, and its value until it returns
+// false. walkPCValue returns false if the table is missing or malformed.
+func walkPCValue(info funcInfo, off uint32, fn func(end uint32, val int32) bool) bool {
+	if off == 0 || int(off) >= len(info.datap.pctab) {
+		return false
+	}
+
+	// The table is a series of value and PC deltas.
+	p := info.datap.pctab[off:]
+	pc := info.entryOff
+	val := int32(-1)
+	for first := true; ; first = false {
+		if len(p) == 0 {
+			return false
+		}
+		if p[0] == 0 && !first {
+			return true
+		}
+
+		n, uvdelta := readvarint(p)
+		if n == 0 || int(n) >= len(p) {
+			return false
+		}
+		p = p[n:]
+		val += int32(-(uvdelta & 1) ^ (uvdelta >> 1))
+
+		n, pcdelta := readvarint(p)
+		if n == 0 {
+			return false
+		}
+		p = p[n:]
+		pc += pcdelta * pcQuantum
+
+		if !fn(pc, val) {
+			return true
+		}
+	}
+}
+
+// readvarint reads a varint from p. It returns the number of bytes read, or 0
+// if p ends first.
+func readvarint(p []byte) (read uint32, val uint32) {
+	var shift uint32
+	for i, b := range p {
+		val |= uint32(b&0x7f) << (shift & 31)
+		if b&0x80 == 0 {
+			return uint32(i + 1), val
+		}
+		shift += 7
+	}
+	return 0, 0
+}
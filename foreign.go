@@ -0,0 +1,196 @@
+package redefine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"unsafe"
+)
+
+// ErrForeignPatch is wrapped by ForeignPatchError.
+var ErrForeignPatch = errors.New("function was patched by something else")
+
+// ForeignPatchError is returned when a function starts with a jump that
+// another patching library wrote, like bouk/monkey, gomonkey or another copy
+// of this package.
+type ForeignPatchError struct {
+	// Name and Entry identify the function.
+	Name  string
+	Entry uintptr
+
+	// Target is where the jump goes. TargetName is the function at Target,
+	// if there is one.
+	Target     uintptr
+	TargetName string
+}
+
+func (e *ForeignPatchError) Error() string {
+	target := fmt.Sprintf("0x%x", e.Target)
+	if e.TargetName != "" {
+		target += " (" + e.TargetName + ")"
+	}
+	return fmt.Sprintf("%s at 0x%x: %v: it jumps to %s", e.Name, e.Entry, ErrForeignPatch, target)
+}
+
+func (e *ForeignPatchError) Unwrap() error {
+	return ErrForeignPatch
+}
+
+// foreignJump is a jump at the start of a function that this package didn't
+// write.
+type foreignJump struct {
+	// target is the address the jump goes to.
+	target uintptr
+
+	// ctx is the closure context the jump sets, or 0.
+	ctx uintptr
+
+	// size is the length of the jump in bytes.
+	size int
+
+	// relative is true for a plain relative branch, which the compiler
+	// could also have written.
+	relative bool
+}
+
+// detectForeignJump returns the jump at the start of code, which is the
+// function at entry, if it was written over the function by something else.
+func detectForeignJump(entry uintptr, code []byte) (foreignJump, bool) {
+	fj, ok := decodeEntryJump(code)
+	if !ok || !fj.relative {
+		return fj, ok
+	}
+
+	// A function can start with a branch, for instance a wrapper that only
+	// makes a tail call. But if there's more code after it, nothing can
+	// reach it, so the branch was written over the function.
+	info := findfunc(entry)
+	if info._func == nil {
+		return foreignJump{}, false
+	}
+	end, ok := funcCodeEnd(info)
+	if !ok {
+		return foreignJump{}, false
+	}
+	size := min(int(end-info.entryOff), len(code))
+	if size <= fj.size || inSlice(code[:size], fj.target) {
+		return foreignJump{}, false
+	}
+
+	return fj, true
+}
+
+// newForeignPatchError returns a ForeignPatchError for the function at entry.
+func newForeignPatchError(entry uintptr, fj foreignJump) error {
+	e := &ForeignPatchError{
+		Entry:  entry,
+		Target: fj.target,
+	}
+	if info := findfunc(entry); info._func != nil {
+		e.Name = funcName(info)
+	}
+	if info := findfunc(fj.target); info._func != nil {
+		e.TargetName = funcName(info)
+	}
+	return e
+}
+
+// foreignLayerFunc treats the jump at the start of fn as the original
+// function. The copy jumps wherever it went, with the same closure context.
+func foreignLayerFunc[T any](fn T, code []byte, fj foreignJump) (*clonedFunc[T], error) {
+	entry := reflect.ValueOf(fn).Pointer()
+
+	alloc := allocatorFor(entry)
+	alloc.BeginMutate()
+	defer alloc.EndMutate()
+
+	size := absJumpSize
+	if fj.ctx != 0 {
+		size = closureTrampolineSize
+	}
+	buf, err := alloc.Allocate(size)
+	if err != nil {
+		return nil, err
+	}
+
+	if fj.ctx != 0 {
+		err = writeClosureTrampoline(buf, fj.ctx, fj.target)
+	} else {
+		err = insertJump(buf, fj.target)
+	}
+	if err != nil {
+		alloc.Free(buf)
+		return nil, err
+	}
+	cacheflush(buf)
+
+	// The other library's code is the original now, and it calls
+	// different functions.
+	forgetCallGraphs()
+
+	cf := clonedFunc[T]{
+		alloc:        alloc,
+		clonedCode:   buf,
+		originalCode: bytes.Clone(code),
+		name:         symbolName(entry),
+	}
+	addSymbol(buf, cf.name, "trampoline")
+	cf.Func, cf.ref = makeFunc[T](buf)
+
+	return &cf, nil
+}
+
+// funcvalAt returns the code pointer from the funcval at addr, which was found
+// in machine code that something else wrote. ok is false if addr can't be
+// read.
+func funcvalAt(addr uintptr) (fn uintptr, ok bool) {
+	if addr == 0 || addr%unsafe.Alignof(uintptr(0)) != 0 {
+		return 0, false
+	}
+
+	if !inKnownData(addr) {
+		// Closures are on the heap, which can't be checked, so just
+		// try it.
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer func() {
+			if recover() != nil {
+				ok = false
+			}
+		}()
+	}
+
+	return *pointerAt(addr), true
+}
+
+// inKnownData reports whether addr is in the data or read-only data of a
+// loaded module, or in one of the arenas.
+func inKnownData(addr uintptr) bool {
+	for _, datap := range modules() {
+		if (datap.noptrdata <= addr && addr < datap.end) || (datap.types <= addr && addr < datap.etypes) {
+			return true
+		}
+	}
+
+	if cloneAllocator.containsAddr(addr) {
+		return true
+	}
+
+	moduleAllocatorsMu.Lock()
+	defer moduleAllocatorsMu.Unlock()
+
+	for _, a := range moduleAllocators {
+		if a.containsAddr(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// pointerAt converts an address found in machine code to a pointer.
+func pointerAt(addr uintptr) *uintptr {
+	var p *uintptr
+	*(*uintptr)(unsafe.Pointer(&p)) = addr
+	return p
+}
@@ -0,0 +1,22 @@
+package redefine
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// writeMonkeyPatch writes the jump that bouk/monkey and gomonkey use to
+// replace a function.
+func writeMonkeyPatch(code []byte, replacement any) {
+	fv := (*[2]unsafe.Pointer)(unsafe.Pointer(&replacement))[1]
+	writeMonkeyJump(code, uintptr(fv))
+}
+
+// writeMonkeyJump writes the jump from writeMonkeyPatch with the funcval at
+// fv.
+func writeMonkeyJump(code []byte, fv uintptr) {
+	// MOVQ $fv, DX; JMP (DX)
+	code[0], code[1] = 0x48, 0xba
+	binary.LittleEndian.PutUint64(code[2:], uint64(fv))
+	code[10], code[11] = 0xff, 0x22
+}
@@ -0,0 +1,25 @@
+package redefine
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// writeMonkeyPatch writes the jump that gomonkey uses to replace a function.
+func writeMonkeyPatch(code []byte, replacement any) {
+	fv := (*[2]unsafe.Pointer)(unsafe.Pointer(&replacement))[1]
+	writeMonkeyJump(code, uintptr(fv))
+}
+
+// writeMonkeyJump writes the jump from writeMonkeyPatch with the funcval at
+// fv.
+func writeMonkeyJump(code []byte, fv uintptr) {
+	encodeMov(code, true, 0, uint16(fv), contextRegister)
+	encodeMov(code[4:], false, 16, uint16(fv>>16), contextRegister)
+	encodeMov(code[8:], false, 32, uint16(fv>>32), contextRegister)
+	encodeMov(code[12:], false, 48, uint16(fv>>48), contextRegister)
+
+	// LDR x27, [x26]; BR x27
+	binary.LittleEndian.PutUint32(code[16:], 0xf9400000|contextRegister<<5|27)
+	binary.LittleEndian.PutUint32(code[20:], _BR|27<<5)
+}
@@ -0,0 +1,119 @@
+package redefine
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/pboyd/malloc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//go:noinline
+func testForeignTarget(n int) string {
+	return fmt.Sprintf("original %d", n)
+}
+
+func TestForeignPatch(t *testing.T) {
+	prefix := "foreign"
+	replacement := func(n int) string {
+		return fmt.Sprintf("%s %d", prefix, n)
+	}
+
+	code, err := funcSlice(testForeignTarget)
+	require.NoError(t, err)
+	original := bytes.Clone(code)
+
+	write := func(fn func([]byte)) {
+		require.NoError(t, mprotect(code, mprotectRWX))
+		defer mprotect(code, mprotectRX)
+		fn(code)
+		cacheflush(code)
+	}
+
+	// Patch it the way the other library would, and unpatch at the end.
+	write(func(code []byte) {
+		writeMonkeyPatch(code, replacement)
+	})
+	t.Cleanup(func() {
+		write(func(code []byte) {
+			copy(code, original)
+		})
+	})
+	require.Equal(t, "foreign 1", testForeignTarget(1))
+
+	newFn := func(n int) string {
+		return fmt.Sprintf("new %d", n)
+	}
+
+	err = Func(testForeignTarget, newFn)
+	assert.ErrorIs(t, err, ErrForeignPatch)
+	var foreignErr *ForeignPatchError
+	if assert.ErrorAs(t, err, &foreignErr) {
+		assert.Equal(t, reflect.ValueOf(testForeignTarget).Pointer(), foreignErr.Entry)
+		assert.Equal(t, reflect.ValueOf(replacement).Pointer(), foreignErr.Target)
+		assert.Contains(t, err.Error(), fmt.Sprintf("0x%x", foreignErr.Target))
+	}
+	assert.Equal(t, "foreign 1", testForeignTarget(1))
+
+	require.NoError(t, Func(testForeignTarget, newFn, ForeignLayer()))
+	assert.Equal(t, "new 1", testForeignTarget(1))
+	assert.Equal(t, "foreign 2", Original(testForeignTarget)(2))
+
+	// The other library patches it again.
+	patched := bytes.Clone(code)
+	write(func(code []byte) {
+		writeMonkeyPatch(code, replacement)
+	})
+	var tamperErr *TamperError
+	if assert.ErrorAs(t, Verify(), &tamperErr) {
+		assert.Equal(t, reflect.ValueOf(replacement).Pointer(), tamperErr.Target)
+	}
+	assert.ErrorIs(t, Restore(testForeignTarget), ErrTampered)
+
+	write(func(code []byte) {
+		copy(code, patched)
+	})
+	require.NoError(t, Restore(testForeignTarget))
+	assert.Equal(t, "foreign 3", testForeignTarget(3))
+}
+
+func TestDetectForeignJump(t *testing.T) {
+	for f := range Functions("github.com/pboyd/redefine") {
+		mu.RLock()
+		_, ok := redefined[f.Entry]
+		mu.RUnlock()
+		if ok {
+			continue
+		}
+
+		code, err := funcSliceAt(f.Entry)
+		require.NoError(t, err)
+
+		_, ok = detectForeignJump(f.Entry, code)
+		assert.False(t, ok, f.Name)
+	}
+}
+
+func TestDecodeEntryJump_Unmapped(t *testing.T) {
+	// Reserved, but never committed, so reading it faults.
+	be, err := malloc.VirtBackend(1 << 20)
+	require.NoError(t, err)
+	t.Cleanup(func() { be.Release() })
+
+	code := make([]byte, 32)
+	writeMonkeyJump(code, be.Addr())
+	_, ok := decodeEntryJump(code)
+	assert.False(t, ok)
+
+	// Closures on the heap are still read.
+	n := 1
+	replacement := func() int { return n }
+	writeMonkeyPatch(code, replacement)
+	fj, ok := decodeEntryJump(code)
+	if assert.True(t, ok) {
+		assert.Equal(t, reflect.ValueOf(replacement).Pointer(), fj.target)
+	}
+}
@@ -14,7 +14,9 @@ type funcDifferences struct {
 func (d *funcDifferences) Error() error {
 	errs := []error{}
 	for i, arg := range d.In {
-		if arg != nil {
+		if arg != nil && arg.Layout != nil {
+			errs = append(errs, fmt.Errorf("argument %d: %v != %v: %w", i, arg.A, arg.B, arg.Layout))
+		} else if arg != nil {
 			errs = append(errs, fmt.Errorf("argument %d: %v != %v", i, arg.A, arg.B))
 		}
 	}
@@ -27,14 +29,56 @@ func (d *funcDifferences) Error() error {
 	return errors.Join(errs...)
 }
 
+// ignoreEquivalentReceiver clears the difference in the first argument if the
+// types are laid out the same way in memory. Otherwise the difference records
+// where the layouts diverge. If unsafeReceiver is true, only the kind and size
+// are compared.
+func (d *funcDifferences) ignoreEquivalentReceiver(unsafeReceiver bool) {
+	if len(d.In) == 0 || d.In[0] == nil {
+		return
+	}
+
+	ta := d.In[0].A
+	tb := d.In[0].B
+	if ta == nil || tb == nil || ta.Kind() != tb.Kind() {
+		return
+	}
+
+	// If the types are pointers then check the size of what they point to
+	// instead of the size of the pointers.
+	if ta.Kind() == reflect.Pointer {
+		ta = ta.Elem()
+		tb = tb.Elem()
+	}
+
+	if unsafeReceiver {
+		if ta.Size() == tb.Size() {
+			d.In[0] = nil
+		}
+		return
+	}
+
+	if ld := diffLayouts(ta, tb); ld != nil {
+		d.In[0].Layout = ld
+		return
+	}
+	d.In[0] = nil
+}
+
 type argDifference struct {
 	A reflect.Type
 	B reflect.Type
+
+	// Layout is where the memory layouts of a receiver and its replacement
+	// diverge.
+	Layout *layoutDifference
 }
 
 func diffFuncs(a, b reflect.Value) *funcDifferences {
-	at := a.Type()
-	bt := b.Type()
+	return diffFuncTypes(a.Type(), b.Type())
+}
+
+func diffFuncTypes(at, bt reflect.Type) *funcDifferences {
 	diff := funcDifferences{}
 
 	var inMax int
@@ -105,3 +149,155 @@ func diffFuncs(a, b reflect.Value) *funcDifferences {
 
 	return &diff
 }
+
+// diffReceivers compares only the receiver of a method, for when the rest of
+// the signature isn't known.
+func diffReceivers(recv, bt reflect.Type) *funcDifferences {
+	diff := funcDifferences{In: make([]*argDifference, 1)}
+	if bt.NumIn() == 0 {
+		diff.In[0] = &argDifference{A: recv}
+	} else if bt.In(0) != recv {
+		diff.In[0] = &argDifference{A: recv, B: bt.In(0)}
+	}
+	return &diff
+}
+
+// compareLayouts returns an error if values of a and b aren't laid out the
+// same way in memory, so code compiled for one can't work on the other. The
+// error is a *layoutDifference.
+func compareLayouts(a, b reflect.Type) error {
+	if ld := diffLayouts(a, b); ld != nil {
+		return ld
+	}
+	return nil
+}
+
+// layoutDifference is the first place where two types are laid out
+// differently in memory.
+type layoutDifference struct {
+	// Field is the path from the start of the value to the part that
+	// differs, written like a Go expression on a variable called v. It's
+	// empty if the types themselves differ.
+	Field string
+
+	// A and B are the types of the part that differs.
+	A, B reflect.Type
+
+	Reason string
+}
+
+func (d *layoutDifference) Error() string {
+	if d.Field == "" {
+		return d.Reason
+	}
+	return fmt.Sprintf("%s %v != %v: %s", d.Field, d.A, d.B, d.Reason)
+}
+
+// diffLayouts compares the memory layouts of a and b, and the types their
+// fields point to, and returns the first difference. Besides the offsets and
+// kinds of the fields, the words that hold pointers have to match, or the
+// garbage collector would misread one of them.
+func diffLayouts(a, b reflect.Type) *layoutDifference {
+	return layoutDiffer{seen: map[[2]reflect.Type]bool{}}.diff(a, b, "")
+}
+
+type layoutDiffer struct {
+	// seen has the pairs of types that are already being compared, so
+	// recursive types end.
+	seen map[[2]reflect.Type]bool
+}
+
+func (ld layoutDiffer) diff(a, b reflect.Type, field string) *layoutDifference {
+	if a == b || ld.seen[[2]reflect.Type{a, b}] {
+		return nil
+	}
+	ld.seen[[2]reflect.Type{a, b}] = true
+
+	differ := func(format string, args ...any) *layoutDifference {
+		return &layoutDifference{
+			Field:  field,
+			A:      a,
+			B:      b,
+			Reason: fmt.Sprintf(format, args...),
+		}
+	}
+
+	if a.Kind() != b.Kind() {
+		return differ("kind %v != %v", a.Kind(), b.Kind())
+	}
+	if a.Size() != b.Size() {
+		return differ("size %d != %d", a.Size(), b.Size())
+	}
+
+	v := field
+	if v == "" {
+		v = "v"
+	}
+
+	switch a.Kind() {
+	case reflect.Struct:
+		for i := range min(a.NumField(), b.NumField()) {
+			fa, fb := a.Field(i), b.Field(i)
+			path := v + "." + fa.Name
+			if fa.Offset != fb.Offset {
+				return &layoutDifference{
+					Field:  path,
+					A:      fa.Type,
+					B:      fb.Type,
+					Reason: fmt.Sprintf("offset %d != %d", fa.Offset, fb.Offset),
+				}
+			}
+			if fd := ld.diff(fa.Type, fb.Type, path); fd != nil {
+				return fd
+			}
+		}
+		if a.NumField() != b.NumField() {
+			return differ("%d fields != %d", a.NumField(), b.NumField())
+		}
+	case reflect.Array:
+		if a.Len() != b.Len() {
+			return differ("%d elements != %d", a.Len(), b.Len())
+		}
+		if ed := ld.diff(a.Elem(), b.Elem(), v+"[0]"); ed != nil {
+			return ed
+		}
+	case reflect.Slice:
+		if ed := ld.diff(a.Elem(), b.Elem(), v+"[0]"); ed != nil {
+			return ed
+		}
+	case reflect.Pointer:
+		if ed := ld.diff(a.Elem(), b.Elem(), "(*"+v+")"); ed != nil {
+			return ed
+		}
+	case reflect.Chan:
+		if ed := ld.diff(a.Elem(), b.Elem(), "<-"+v); ed != nil {
+			return ed
+		}
+	case reflect.Map:
+		if kd := ld.diff(a.Key(), b.Key(), "key of "+v); kd != nil {
+			return kd
+		}
+		if ed := ld.diff(a.Elem(), b.Elem(), v+"[k]"); ed != nil {
+			return ed
+		}
+	case reflect.Interface:
+		// Interfaces with methods start with an itab instead of a type.
+		if (a.NumMethod() == 0) != (b.NumMethod() == 0) {
+			return differ("only one is the empty interface")
+		}
+	}
+
+	// The parts can match while the whole doesn't, for instance with a
+	// trailing zero-sized field.
+	if a.Align() != b.Align() {
+		return differ("alignment %d != %d", a.Align(), b.Align())
+	}
+
+	// The garbage collector only scans up to the last pointer.
+	pa, pb := (*abiType)(typePointer(a)).ptrBytes, (*abiType)(typePointer(b)).ptrBytes
+	if pa != pb {
+		return differ("pointers in the first %d bytes != %d", pa, pb)
+	}
+
+	return nil
+}
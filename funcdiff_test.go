@@ -0,0 +1,95 @@
+package redefine
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type layoutNode struct {
+	val  int
+	next *layoutNode
+}
+
+type layoutNodeCopy struct {
+	val  int
+	next *layoutNodeCopy
+}
+
+type layoutNodeBad struct {
+	val  int
+	next *struct {
+		val  uint64
+		next uintptr
+	}
+}
+
+func TestDiffLayouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     reflect.Type
+		field    string
+		contains string
+	}{
+		{
+			name: "recursive",
+			a:    reflect.TypeFor[layoutNode](),
+			b:    reflect.TypeFor[layoutNodeCopy](),
+		},
+		{
+			name:     "pointee",
+			a:        reflect.TypeFor[layoutNode](),
+			b:        reflect.TypeFor[layoutNodeBad](),
+			field:    "(*v.next).val",
+			contains: "kind int != uint64",
+		},
+		{
+			name: "offset",
+			a:    reflect.TypeFor[struct{ a, b int32 }](),
+			b: reflect.TypeFor[struct {
+				a int32
+				b [4]byte
+			}](),
+			field:    "v.b",
+			contains: "kind int32 != array",
+		},
+		{
+			name:     "pointer words",
+			a:        reflect.TypeFor[struct{ p *int }](),
+			b:        reflect.TypeFor[struct{ p uintptr }](),
+			field:    "v.p",
+			contains: "kind ptr != uintptr",
+		},
+		{
+			name: "array element",
+			a:    reflect.TypeFor[[2]struct{ a, b int }](),
+			b: reflect.TypeFor[[2]struct {
+				a int
+				b string
+			}](),
+			contains: "size",
+		},
+		{
+			name:     "interfaces",
+			a:        reflect.TypeFor[struct{ v any }](),
+			b:        reflect.TypeFor[struct{ v error }](),
+			field:    "v.v",
+			contains: "empty interface",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ld := diffLayouts(tt.a, tt.b)
+			if tt.contains == "" {
+				assert.Nil(t, ld)
+				return
+			}
+			require.NotNil(t, ld)
+			assert.Equal(t, tt.field, ld.Field)
+			assert.Contains(t, ld.Error(), tt.contains)
+		})
+	}
+}
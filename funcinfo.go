@@ -0,0 +1,208 @@
+package redefine
+
+import (
+	"bytes"
+	"fmt"
+	"iter"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Function describes a function in the program, as recorded by the linker.
+type Function struct {
+	// Name is the fully qualified name, such as "net/http.(*Client).Do".
+	Name string
+
+	// Entry is the address of the first instruction.
+	Entry uintptr
+
+	// Size is the length of the machine code in bytes, not including any
+	// padding after it.
+	Size uintptr
+
+	// File and Line are where the function starts in the source.
+	File string
+	Line int
+
+	// Args is the size of the arguments and results on the stack.
+	Args int
+
+	// FuncID identifies special functions in the runtime. It's 0 for
+	// normal functions.
+	FuncID uint8
+}
+
+// FuncInfo returns information about fn, which must be a function.
+func FuncInfo(fn any) (Function, error) {
+	fnv := reflect.ValueOf(fn)
+	if fnv.Kind() != reflect.Func || fnv.IsNil() {
+		return Function{}, fmt.Errorf("not a function, kind: %v", fnv.Kind())
+	}
+
+	info := findfunc(fnv.Pointer())
+	if info._func == nil {
+		return Function{}, fmt.Errorf("no function found at 0x%x", fnv.Pointer())
+	}
+
+	return makeFunction(info), nil
+}
+
+// Functions returns every function in every loaded module that matches
+// pattern. pattern is either a package path or a pattern for the whole name,
+// in the syntax used by path.Match. For example, "net/http" and "net/*" match
+// every function in net/http, and "net/http.(*Client).*" matches the methods
+// of http.Client. An empty pattern matches everything.
+//
+// Functions that were inlined everywhere they're called aren't included.
+func Functions(pattern string) iter.Seq[Function] {
+	return func(yield func(Function) bool) {
+		for _, datap := range modules() {
+			// The last entry in ftab marks the end of the text
+			// segment.
+			for _, ft := range datap.ftab[:max(len(datap.ftab)-1, 0)] {
+				info := funcInfo{
+					_func: (*_func)(unsafe.Pointer(&datap.pclntable[ft.funcoff])),
+					datap: datap,
+				}
+				if !matchFunc(pattern, funcName(info)) {
+					continue
+				}
+				if !yield(makeFunction(info)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+var (
+	nameIndexesMu sync.Mutex
+
+	// nameIndexes maps each module to the entry points of its functions,
+	// by name. A name can have more than one, like an assembly function
+	// and its wrapper.
+	nameIndexes = map[*moduledata]map[string][]uintptr{}
+)
+
+// nameIndexFor returns the functions in datap by name, indexing them the
+// first time.
+func nameIndexFor(datap *moduledata) map[string][]uintptr {
+	nameIndexesMu.Lock()
+	defer nameIndexesMu.Unlock()
+
+	if idx, ok := nameIndexes[datap]; ok {
+		return idx
+	}
+
+	idx := map[string][]uintptr{}
+	for _, ft := range datap.ftab[:max(len(datap.ftab)-1, 0)] {
+		info := funcInfo{
+			_func: (*_func)(unsafe.Pointer(&datap.pclntable[ft.funcoff])),
+			datap: datap,
+		}
+		name := funcName(info)
+		idx[name] = append(idx[name], datap.text+uintptr(info.entryOff))
+	}
+	nameIndexes[datap] = idx
+
+	return idx
+}
+
+// funcByName returns the entry point of the function called name.
+func funcByName(name string) (uintptr, bool) {
+	for _, datap := range modules() {
+		if entries := nameIndexFor(datap)[name]; len(entries) > 0 {
+			return entries[0], true
+		}
+	}
+	return 0, false
+}
+
+// makeFunction fills in a Function from the runtime's information.
+func makeFunction(info funcInfo) Function {
+	f := Function{
+		Name:   funcName(info),
+		Entry:  info.datap.text + uintptr(info.entryOff),
+		File:   funcFile(info),
+		Line:   int(info.startLine),
+		Args:   int(info.args),
+		FuncID: info.funcID,
+	}
+
+	end, ok := funcCodeEnd(info)
+	if !ok || end <= info.entryOff {
+		end = nextEntry(info, true)
+	}
+	f.Size = uintptr(end - info.entryOff)
+
+	return f
+}
+
+// funcName returns the name of the function.
+func funcName(info funcInfo) string {
+	if info.nameOff <= 0 || int(info.nameOff) >= len(info.datap.funcnametab) {
+		return ""
+	}
+	return cstring(info.datap.funcnametab[info.nameOff:])
+}
+
+// funcFile returns the source file that contains the start of the function.
+func funcFile(info funcInfo) string {
+	fileno := int32(-1)
+	walkPCValue(info, info.pcfile, func(_ uint32, val int32) bool {
+		fileno = val
+		return false
+	})
+	if fileno < 0 {
+		return "?"
+	}
+
+	cu := int(info.cuOffset) + int(fileno)
+	if cu >= len(info.datap.cutab) {
+		return "?"
+	}
+	off := info.datap.cutab[cu]
+	if off == ^uint32(0) || int(off) >= len(info.datap.filetab) {
+		return "?"
+	}
+	return cstring(info.datap.filetab[off:])
+}
+
+// cstring returns the null-terminated string at the start of b.
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// matchFunc reports whether the function name matches pattern. See
+// Functions.
+func matchFunc(pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+	if ok, _ := path.Match(pattern, funcPackage(name)); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// funcPackage returns the package path from a function name. Like the
+// runtime, it assumes the path ends at the first dot after the last slash.
+func funcPackage(name string) string {
+	// Type parameters can contain anything.
+	if i := strings.IndexByte(name, '['); i >= 0 {
+		name = name[:i]
+	}
+
+	slash := strings.LastIndexByte(name, '/')
+	if i := strings.IndexByte(name[slash+1:], '.'); i >= 0 {
+		return name[:slash+1+i]
+	}
+	return name
+}
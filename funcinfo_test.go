@@ -0,0 +1,65 @@
+package redefine
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFuncInfo(t *testing.T) {
+	f, err := FuncInfo(a)
+	require.NoError(t, err)
+
+	assert.Equal(t, "github.com/pboyd/redefine.a", f.Name)
+	assert.Equal(t, "redefine_test.go", filepath.Base(f.File))
+	assert.Equal(t, 13, f.Line)
+	assert.NotZero(t, f.Entry)
+	assert.NotZero(t, f.Size)
+
+	code, err := funcSlice(a)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, f.Size, uintptr(len(code)))
+
+	_, err = FuncInfo(42)
+	assert.Error(t, err)
+}
+
+func TestFunctions(t *testing.T) {
+	want, err := FuncInfo(a)
+	require.NoError(t, err)
+
+	tests := []struct {
+		pattern string
+		name    string
+		found   bool
+	}{
+		{"", "github.com/pboyd/redefine.a", true},
+		{"github.com/pboyd/redefine", "github.com/pboyd/redefine.a", true},
+		{"github.com/pboyd/*", "github.com/pboyd/redefine.a", true},
+		{"github.com/pboyd/redefine.Test*", "github.com/pboyd/redefine.TestFunctions", true},
+		{"github.com/pboyd/redefine.Test*", "github.com/pboyd/redefine.a", false},
+		{"strings", "strings.ToUpper", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			found := false
+			for f := range Functions(tt.pattern) {
+				if f.Name == tt.name {
+					found = true
+					if f.Name == want.Name {
+						assert.Equal(t, want, f)
+					}
+					break
+				}
+			}
+			assert.Equal(t, tt.found, found)
+		})
+	}
+
+	for range Functions("example.com/does/not/exist") {
+		t.Error("matched a package that doesn't exist")
+	}
+}
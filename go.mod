@@ -6,12 +6,15 @@ require (
 	github.com/pboyd/malloc v1.2.1
 	github.com/stretchr/testify v1.11.1
 	golang.org/x/arch v0.23.0
-	golang.org/x/sys v0.41.0
+	golang.org/x/mod v0.35.0
+	golang.org/x/sys v0.43.0
+	golang.org/x/tools v0.44.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/exp v0.0.0-20260218203240-3dfff04db8fa // indirect
+	golang.org/x/sync v0.20.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
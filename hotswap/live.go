@@ -0,0 +1,134 @@
+package hotswap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pboyd/redefine"
+)
+
+// liveRequestTimeout limits how long ServePlugins waits for a request after a
+// connection is made.
+const liveRequestTimeout = 10 * time.Second
+
+// maxAcceptDelay is the longest ServePlugins waits to accept a connection
+// again after an error.
+const maxAcceptDelay = time.Second
+
+// ServePlugins listens on a unix socket at path for plugins to load with
+// LoadPlugin, so a tool like cmd/redefine-live can send new versions of the
+// replacements to a running program. The options are passed to LoadPlugin.
+// The returned function stops listening and removes the socket.
+//
+// Each connection carries one request, as a line of text, and one response.
+// The requests are "load" followed by the absolute path of a plugin, and
+// "restore" to call RestorePlugin. The response is "ok", or "error:" followed
+// by the message. SendPlugin and SendRestore make the requests.
+//
+// Anything that can connect to the socket can run code in the program, so
+// only put it where the user running the program can reach it.
+func ServePlugins(path string, opts ...redefine.Option) (func() error, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		var delay time.Duration
+		for {
+			conn, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				// Errors like EMFILE can last a while, so don't
+				// spin on them.
+				delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+
+			// One at a time, since LoadPlugin is anyway.
+			servePluginRequest(conn, opts)
+		}
+	}()
+
+	return l.Close, nil
+}
+
+// servePluginRequest handles one request made to ServePlugins.
+func servePluginRequest(conn net.Conn, opts []redefine.Option) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(liveRequestTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	switch cmd {
+	case "load":
+		err = LoadPlugin(arg, opts...)
+	case "restore":
+		err = RestorePlugin()
+	default:
+		err = fmt.Errorf("unknown request %q", cmd)
+	}
+
+	if err != nil {
+		// The response is one line.
+		fmt.Fprintf(conn, "error: %s\n", strings.ReplaceAll(err.Error(), "\n", "; "))
+		return
+	}
+	fmt.Fprintln(conn, "ok")
+}
+
+// SendPlugin asks the program serving the unix socket at socket with
+// ServePlugins to load the plugin at path.
+func SendPlugin(socket, path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	return sendPluginRequest(socket, "load "+path)
+}
+
+// SendRestore asks the program serving the unix socket at socket with
+// ServePlugins to restore the functions its last plugin redefined.
+func SendRestore(socket string) error {
+	return sendPluginRequest(socket, "restore")
+}
+
+// sendPluginRequest makes a request to ServePlugins and waits for the
+// response.
+func sendPluginRequest(socket, request string) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintln(conn, request)
+	if err != nil {
+		return err
+	}
+
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no response from %s: %w", socket, err)
+	}
+	response = strings.TrimSpace(response)
+	if msg, ok := strings.CutPrefix(response, "error: "); ok {
+		return errors.New(msg)
+	}
+	if response != "ok" {
+		return fmt.Errorf("unexpected response from %s: %q", socket, response)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package hotswap
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServePlugins(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "live.sock")
+	stop, err := ServePlugins(socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { stop() })
+
+	// Errors come back to the sender.
+	err = SendPlugin(socket, filepath.Join(t.TempDir(), "missing.so"))
+	assert.ErrorContains(t, err, "missing.so")
+
+	assert.NoError(t, SendRestore(socket))
+
+	err = sendPluginRequest(socket, "unload")
+	assert.ErrorContains(t, err, `unknown request "unload"`)
+
+	require.NoError(t, stop())
+	assert.Error(t, SendRestore(socket))
+}
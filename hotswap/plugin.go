@@ -0,0 +1,129 @@
+// Package hotswap redefines functions with replacements loaded from Go
+// plugins, so a running program can pick up new versions of them without a
+// restart.
+//
+// It's separate from redefine because the plugin package needs cgo and a
+// dynamically linked program.
+package hotswap
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"plugin"
+	"slices"
+	"sync"
+
+	"github.com/pboyd/redefine"
+)
+
+// manifestSymbol is the name of the variable that lists what a plugin
+// redefines. See LoadPlugin.
+const manifestSymbol = "Redefinitions"
+
+var (
+	// mu serializes LoadPlugin and RestorePlugin.
+	mu sync.Mutex
+
+	// current maps the names of the functions redefined by the last plugin
+	// to their replacements.
+	current = map[string]any{}
+)
+
+// LoadPlugin opens a Go plugin, built with -buildmode=plugin, and redefines
+// the functions it lists. The plugin lists them in an exported variable called
+// Redefinitions, which maps the full names of the functions to redefine, as
+// redefine.Functions reports them, to the names of the replacements in the
+// plugin:
+//
+//	var Redefinitions = map[string]string{
+//		"example.com/app/server.(*Server).render": "Render",
+//	}
+//
+//	func Render(s *server.Server, page string) error {
+//		...
+//	}
+//
+// Each function is redefined with redefine.FuncByName, which has the details
+// of what's checked.
+//
+// Loading another plugin replaces the redefinitions of the last one, with
+// redefine.SwapByName. Functions that both list are sent to the new
+// replacements, and functions that only the last one listed are restored, with
+// no other redefinition in between. If any of that fails, the functions that
+// were changed are put back the way the last plugin left them, and the error
+// includes anything that couldn't be put back.
+//
+// Go can't unload plugins, or load the same one twice. Each version of a
+// plugin needs its own file and plugin path, which can be set with
+// -ldflags=-pluginpath=NAME.
+//
+// Use RestorePlugin to restore every function the last plugin redefined.
+func LoadPlugin(path string, opts ...redefine.Option) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+
+	next, err := readManifest(p)
+	if err != nil {
+		return fmt.Errorf("plugin %s: %w", path, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	err = redefine.SwapByName(current, next, opts...)
+	if err != nil {
+		return fmt.Errorf("plugin %s: %w", path, err)
+	}
+	current = next
+
+	return nil
+}
+
+// RestorePlugin restores the functions redefined by the last plugin that
+// LoadPlugin loaded.
+func RestorePlugin() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(current)) {
+		if err := redefine.RestoreFuncByName(name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		delete(current, name)
+	}
+	return errors.Join(errs...)
+}
+
+// readManifest finds the functions that the plugin redefines and their
+// replacements.
+func readManifest(p *plugin.Plugin) (map[string]any, error) {
+	sym, err := p.Lookup(manifestSymbol)
+	if err != nil {
+		return nil, err
+	}
+	manifest, ok := sym.(*map[string]string)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %T, not a map[string]string", manifestSymbol, sym)
+	}
+
+	funcs := map[string]any{}
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(*manifest)) {
+		fake, err := p.Lookup((*manifest)[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		funcs[name] = fake
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return funcs, nil
+}
@@ -0,0 +1,30 @@
+//go:build linux && (amd64 || arm64)
+
+package hotswap
+
+import (
+	"testing"
+
+	"github.com/pboyd/redefine/internal/buildtest"
+)
+
+// TestLoadPlugin runs testdata/host, which loads each version of a plugin in
+// turn.
+func TestLoadPlugin(t *testing.T) {
+	buildtest.RequireCgo(t)
+
+	var plugins []string
+	for _, v := range []string{"v1", "v2", "bad", "unpatchable"} {
+		plugins = append(plugins, buildtest.Build(t, "./testdata/"+v, "-buildmode=plugin"))
+	}
+	buildtest.BuildAndRun(t, "./testdata/host", plugins...)
+}
+
+// TestServePlugins_Live runs testdata/live, which sends a plugin to itself
+// over the socket.
+func TestServePlugins_Live(t *testing.T) {
+	buildtest.RequireCgo(t)
+
+	v1 := buildtest.Build(t, "./testdata/v1", "-buildmode=plugin")
+	buildtest.BuildAndRun(t, "./testdata/live", v1)
+}
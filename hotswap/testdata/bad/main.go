@@ -0,0 +1,17 @@
+// Package main is a plugin for ../host with a replacement that doesn't match.
+package main
+
+var Redefinitions = map[string]string{
+	"main.greeting": "Greeting",
+	"main.farewell": "Farewell",
+}
+
+func Greeting(name string) string {
+	return "bad hi " + name
+}
+
+func Farewell(name string, times int) string {
+	return "bad bye " + name
+}
+
+func main() {}
@@ -0,0 +1,84 @@
+// Command host loads the plugins built from ../v1, ../v2, ../bad and
+// ../unpatchable with LoadPlugin and checks that each one replaces the last.
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/pboyd/redefine/hotswap"
+)
+
+//go:noinline
+func greeting(name string) string {
+	return "hello " + name
+}
+
+//go:noinline
+func farewell(name string) string {
+	return "goodbye " + name
+}
+
+func main() {
+	if len(os.Args) != 5 {
+		fmt.Fprintf(os.Stderr, "usage: %s v1 v2 bad unpatchable\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	if err := run(os.Args[1], os.Args[2], os.Args[3], os.Args[4]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
+func run(v1, v2, bad, unpatchable string) error {
+	if err := hotswap.LoadPlugin(v1); err != nil {
+		return fmt.Errorf("v1: %w", err)
+	}
+	if err := expect("v1 hi world", "v1 bye world"); err != nil {
+		return err
+	}
+
+	// v2 doesn't redefine farewell.
+	if err := hotswap.LoadPlugin(v2); err != nil {
+		return fmt.Errorf("v2: %w", err)
+	}
+	if err := expect("v2 hi world", "goodbye world"); err != nil {
+		return err
+	}
+
+	if err := hotswap.LoadPlugin(bad); err == nil {
+		return fmt.Errorf("loaded a plugin with a mismatched function")
+	}
+	if err := expect("v2 hi world", "goodbye world"); err != nil {
+		return err
+	}
+
+	// farewell and greeting are changed before math.archFloor fails.
+	if err := hotswap.LoadPlugin(unpatchable); err == nil {
+		return fmt.Errorf("loaded a plugin with a function that can't be patched")
+	}
+	if err := expect("v2 hi world", "goodbye world"); err != nil {
+		return err
+	}
+	if got := math.Floor(1.5); got != 1 {
+		return fmt.Errorf("math.Floor returned %v, want 1", got)
+	}
+
+	if err := hotswap.RestorePlugin(); err != nil {
+		return fmt.Errorf("RestorePlugin: %w", err)
+	}
+	return expect("hello world", "goodbye world")
+}
+
+func expect(wantGreeting, wantFarewell string) error {
+	if got := greeting("world"); got != wantGreeting {
+		return fmt.Errorf("greeting returned %q, want %q", got, wantGreeting)
+	}
+	if got := farewell("world"); got != wantFarewell {
+		return fmt.Errorf("farewell returned %q, want %q", got, wantFarewell)
+	}
+	return nil
+}
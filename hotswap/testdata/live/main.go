@@ -0,0 +1,72 @@
+// Command live serves a socket with ServePlugins and sends the plugin built
+// from ../v1 to it with SendPlugin, then checks that the functions were
+// redefined.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pboyd/redefine/hotswap"
+)
+
+//go:noinline
+func greeting(name string) string {
+	return "hello " + name
+}
+
+//go:noinline
+func farewell(name string) string {
+	return "goodbye " + name
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s v1\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	if err := run(os.Args[1]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
+func run(v1 string) error {
+	dir, err := os.MkdirTemp("", "live")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "live.sock")
+	stop, err := hotswap.ServePlugins(socket)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	if err := hotswap.SendPlugin(socket, v1); err != nil {
+		return fmt.Errorf("SendPlugin: %w", err)
+	}
+	if err := expect("v1 hi world", "v1 bye world"); err != nil {
+		return err
+	}
+
+	if err := hotswap.SendRestore(socket); err != nil {
+		return fmt.Errorf("SendRestore: %w", err)
+	}
+	return expect("hello world", "goodbye world")
+}
+
+func expect(wantGreeting, wantFarewell string) error {
+	if got := greeting("world"); got != wantGreeting {
+		return fmt.Errorf("greeting returned %q, want %q", got, wantGreeting)
+	}
+	if got := farewell("world"); got != wantFarewell {
+		return fmt.Errorf("farewell returned %q, want %q", got, wantFarewell)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+// Package main is a plugin for ../host that can't be loaded, because the last
+// function it redefines can't be patched. The others have to be put back.
+package main
+
+var Redefinitions = map[string]string{
+	"main.farewell":  "Farewell",
+	"main.greeting":  "Greeting",
+	"math.archFloor": "Floor",
+}
+
+func Greeting(name string) string {
+	return "unpatchable hi " + name
+}
+
+func Farewell(name string) string {
+	return "unpatchable bye " + name
+}
+
+// Floor is the same size as math.archFloor, which is assembly without a
+// wrapper. It can't be redefined without the ABI0Adapter option, and even
+// with it, the array is passed on the stack, which the adapter can't handle.
+func Floor(x [2]uint32) float64 {
+	return 0
+}
+
+func main() {}
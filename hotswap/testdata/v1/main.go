@@ -0,0 +1,17 @@
+// Package main is the first version of a plugin for ../host and ../live.
+package main
+
+var Redefinitions = map[string]string{
+	"main.greeting": "Greeting",
+	"main.farewell": "Farewell",
+}
+
+func Greeting(name string) string {
+	return "v1 hi " + name
+}
+
+func Farewell(name string) string {
+	return "v1 bye " + name
+}
+
+func main() {}
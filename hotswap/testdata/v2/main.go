@@ -0,0 +1,12 @@
+// Package main is the second version of a plugin for ../host.
+package main
+
+var Redefinitions = map[string]string{
+	"main.greeting": "Greeting",
+}
+
+func Greeting(name string) string {
+	return "v2 hi " + name
+}
+
+func main() {}
@@ -0,0 +1,421 @@
+package redefine
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go/version"
+	"maps"
+	"runtime"
+	"slices"
+	"strings"
+	"unsafe"
+)
+
+// BinaryFunction describes a function in a compiled program, as InspectBinary
+// reports it.
+type BinaryFunction struct {
+	Function
+
+	// Room is the number of bytes at the entry point that a jump can
+	// overwrite, which includes any padding after the function.
+	Room uintptr
+
+	// InlinedInto lists the functions that have a copy of this one inlined
+	// into them. The copies aren't redefined along with it.
+	InlinedInto []string
+
+	// CloneErr is why the instructions can't be relocated to make a copy
+	// of the function, or nil if they can. The copy is what Original
+	// returns, unless only the prologue needs to be moved.
+	CloneErr error
+
+	// Wrapper is true for code the compiler generates, such as method
+	// wrappers.
+	Wrapper bool
+
+	// Shape is true for the code shared by instances of a generic
+	// function. Neither shapes nor instances can be redefined.
+	Shape bool
+
+	// Redefinable reports whether Func would be able to redefine it.
+	Redefinable bool
+}
+
+// pcHeaderMagic starts the pclntab of Go 1.20 and later.
+const pcHeaderMagic = 0xFFFFFFF1
+
+// InspectBinary reads the program at path, which must be built for the same
+// architecture as the caller, and describes its functions that match pattern.
+// The pattern is the same as for Functions. Entry is the address in the
+// program, as it would be loaded without relocation.
+//
+// The program must be built with the same Go release as the caller, since the
+// runtime's tables are read with the caller's layout of them.
+//
+// Unlike Functions, functions that were inlined everywhere they're called are
+// included, after the others, with only Name, InlinedInto and Shape set.
+//
+// Only ELF, Mach-O and PE files are read. Position-independent programs can
+// only be read if the linker wrote the addresses into the file, and then Entry
+// is relative to where the program is linked, not where it's loaded.
+func InspectBinary(path, pattern string) ([]BinaryFunction, error) {
+	img, err := openImage(path)
+	if err != nil {
+		return nil, err
+	}
+	if img.arch != runtime.GOARCH {
+		return nil, fmt.Errorf("%s is for %s, not %s", path, img.arch, runtime.GOARCH)
+	}
+	if err := checkGoVersion(path); err != nil {
+		return nil, err
+	}
+
+	datap, textAddr, err := img.moduledata()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	// The addresses in datap point into img.
+	defer runtime.KeepAlive(img)
+	defer func() {
+		funcIndexesMu.Lock()
+		delete(funcIndexes, datap)
+		funcIndexesMu.Unlock()
+	}()
+
+	ftab := datap.ftab[:max(len(datap.ftab)-1, 0)]
+	infos := make([]funcInfo, len(ftab))
+	inlinedInto := map[string][]string{}
+	for i, ft := range ftab {
+		infos[i] = funcInfo{
+			_func: (*_func)(unsafe.Pointer(&datap.pclntable[ft.funcoff])),
+			datap: datap,
+		}
+		for _, inlined := range inlinedFuncs(infos[i]) {
+			inlinedInto[inlined] = append(inlinedInto[inlined], funcName(infos[i]))
+		}
+	}
+
+	var funcs []BinaryFunction
+	for _, info := range infos {
+		name := funcName(info)
+		if !matchFunc(pattern, name) {
+			continue
+		}
+
+		bf := BinaryFunction{
+			Function:    makeFunction(info),
+			InlinedInto: inlinedInto[name],
+			Wrapper:     info.funcID == funcIDWrapper,
+			Shape:       strings.Contains(name, "[go.shape."),
+		}
+		bf.Entry = bf.Entry - datap.text + textAddr
+
+		start := unsafe.Pointer(pointerAt(datap.text + uintptr(info.entryOff)))
+		code := unsafe.Slice((*byte)(start), funcLength(info, start))
+		bf.Room = uintptr(len(code))
+		bf.CloneErr = checkRelocate(code)
+
+		_, _, detourErr := detourPrologue(code)
+		canCopy := detourErr == nil || bf.CloneErr == nil || errors.Is(bf.CloneErr, errAddressOutOfRange)
+		generic := strings.ContainsRune(name, '[')
+		bf.Redefinable = !generic && bf.Room >= minJumpSize && canCopy
+
+		funcs = append(funcs, bf)
+		delete(inlinedInto, name)
+	}
+
+	// What's left was inlined everywhere it was called.
+	for _, name := range slices.Sorted(maps.Keys(inlinedInto)) {
+		if matchFunc(pattern, name) {
+			funcs = append(funcs, BinaryFunction{
+				Function:    Function{Name: name},
+				InlinedInto: inlinedInto[name],
+				Shape:       strings.Contains(name, "[go.shape."),
+			})
+		}
+	}
+
+	return funcs, nil
+}
+
+// checkGoVersion returns an error if the program at path wasn't built with the
+// same Go release as this one.
+func checkGoVersion(path string) error {
+	bi, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: unable to read the Go version: %w", path, err)
+	}
+
+	// Devel versions have no release, so they have to match exactly.
+	want, got := version.Lang(runtime.Version()), version.Lang(bi.GoVersion)
+	if want == "" || got == "" {
+		want, got = runtime.Version(), bi.GoVersion
+	}
+	if want != got {
+		return fmt.Errorf("%s was built with %s, but only programs built with %s can be read", path, bi.GoVersion, want)
+	}
+	return nil
+}
+
+// checkRelocate returns the error from relocating code, if any.
+func checkRelocate(code []byte) error {
+	if len(code) == 0 {
+		return errors.New("no instructions")
+	}
+
+	// Like copyCode, leave room for trampolines.
+	var err error
+	for size := len(code); size < len(code)*3; size += len(code) {
+		_, err = relocateFunc(code, make([]byte, size), nil)
+		if !errors.Is(err, errAddressOutOfRange) {
+			break
+		}
+	}
+	return err
+}
+
+// image is the contents of a program file, at the addresses the program
+// would be loaded at.
+type image struct {
+	arch     string
+	sections []imageSection
+}
+
+type imageSection struct {
+	addr uint64
+	data []byte
+}
+
+// openImage reads the sections of the program at path.
+func openImage(path string) (*image, error) {
+	if f, err := elf.Open(path); err == nil {
+		defer f.Close()
+		return elfImage(f)
+	}
+	if f, err := macho.Open(path); err == nil {
+		defer f.Close()
+		return machoImage(f)
+	}
+	if f, err := pe.Open(path); err == nil {
+		defer f.Close()
+		return peImage(f)
+	}
+	return nil, fmt.Errorf("%s is not an ELF, Mach-O or PE file", path)
+}
+
+func elfImage(f *elf.File) (*image, error) {
+	img := &image{}
+	switch f.Machine {
+	case elf.EM_X86_64:
+		img.arch = "amd64"
+	case elf.EM_AARCH64:
+		img.arch = "arm64"
+	default:
+		img.arch = f.Machine.String()
+	}
+
+	for _, s := range f.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Type == elf.SHT_NOBITS {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, fmt.Errorf("section %s: %w", s.Name, err)
+		}
+		img.sections = append(img.sections, imageSection{addr: s.Addr, data: data})
+	}
+	return img, nil
+}
+
+func machoImage(f *macho.File) (*image, error) {
+	img := &image{}
+	switch f.Cpu {
+	case macho.CpuAmd64:
+		img.arch = "amd64"
+	case macho.CpuArm64:
+		img.arch = "arm64"
+	default:
+		img.arch = f.Cpu.String()
+	}
+
+	const zeroFill = 1
+	for _, s := range f.Sections {
+		if s.Flags&0xff == zeroFill {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, fmt.Errorf("section %s: %w", s.Name, err)
+		}
+		img.sections = append(img.sections, imageSection{addr: s.Addr, data: data})
+	}
+	return img, nil
+}
+
+func peImage(f *pe.File) (*image, error) {
+	img := &image{}
+	switch f.Machine {
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		img.arch = "amd64"
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		img.arch = "arm64"
+	default:
+		img.arch = fmt.Sprintf("machine 0x%x", f.Machine)
+	}
+
+	var base uint64
+	if oh, ok := f.OptionalHeader.(*pe.OptionalHeader64); ok {
+		base = oh.ImageBase
+	}
+	for _, s := range f.Sections {
+		data, err := s.Data()
+		if err != nil {
+			return nil, fmt.Errorf("section %s: %w", s.Name, err)
+		}
+		data = data[:min(len(data), int(s.VirtualSize))]
+		img.sections = append(img.sections, imageSection{addr: base + uint64(s.VirtualAddress), data: data})
+	}
+	return img, nil
+}
+
+// at returns the bytes from addr to the end of its section, or nil if addr
+// isn't in one.
+func (img *image) at(addr uint64) []byte {
+	for _, s := range img.sections {
+		if addr >= s.addr && addr < s.addr+uint64(len(s.data)) {
+			return s.data[addr-s.addr:]
+		}
+	}
+	return nil
+}
+
+// slice returns the n bytes at addr, or nil if they aren't all in one
+// section.
+func (img *image) slice(addr, n uint64) []byte {
+	b := img.at(addr)
+	if uint64(len(b)) < n {
+		return nil
+	}
+	return b[:n]
+}
+
+// moduledata finds the program's moduledata and makes a copy of it that
+// points into img, so the functions that read the runtime's can read it too.
+// It also returns the address of the text segment in the program.
+func (img *image) moduledata() (*moduledata, uintptr, error) {
+	// The linker writes a moduledata that points to the pcHeader, so look
+	// for every pcHeader, then for a pointer to it.
+	magic := binary.LittleEndian.AppendUint32(nil, pcHeaderMagic)
+	for _, s := range img.sections {
+		for i := 0; i < len(s.data); i += 8 {
+			j := bytes.Index(s.data[i:], magic)
+			if j < 0 {
+				break
+			}
+			i += j &^ 7
+
+			// The header is followed by the minimum instruction
+			// size and the size of a pointer.
+			if j%8 != 0 || i+int(unsafe.Sizeof(pcHeader{})) > len(s.data) || s.data[i+7] != 8 {
+				continue
+			}
+
+			hdrAddr := s.addr + uint64(i)
+			for _, raw := range img.pointersTo(hdrAddr) {
+				datap, textAddr, ok := img.rebase(hdrAddr, raw)
+				if ok {
+					return datap, textAddr, nil
+				}
+			}
+		}
+	}
+	return nil, 0, errors.New("no moduledata found, it may not be a Go program or it may be position-independent")
+}
+
+// pointersTo returns the bytes at each 8-byte aligned address in img that
+// holds addr, through the end of the section.
+func (img *image) pointersTo(addr uint64) [][]byte {
+	want := binary.LittleEndian.AppendUint64(nil, addr)
+	var found [][]byte
+	for _, s := range img.sections {
+		for i := 0; i < len(s.data); i += 8 {
+			j := bytes.Index(s.data[i:], want)
+			if j < 0 {
+				break
+			}
+			i += j &^ 7
+			if j%8 == 0 {
+				found = append(found, s.data[i:])
+			}
+		}
+	}
+	return found
+}
+
+// rebase makes a moduledata from the raw one in the program, which starts
+// with the address of the pcHeader at hdrAddr, that points into img instead.
+// It returns false if raw isn't a moduledata.
+func (img *image) rebase(hdrAddr uint64, raw []byte) (*moduledata, uintptr, bool) {
+	var md moduledata
+	if len(raw) < int(unsafe.Offsetof(md.textsectmap)) {
+		return nil, 0, false
+	}
+	word := func(off uintptr) uint64 {
+		return binary.LittleEndian.Uint64(raw[off:])
+	}
+
+	hdrBytes := img.slice(hdrAddr, uint64(unsafe.Sizeof(pcHeader{})))
+	if hdrBytes == nil {
+		return nil, 0, false
+	}
+	hdr := (*pcHeader)(unsafe.Pointer(unsafe.SliceData(hdrBytes)))
+	if word(unsafe.Offsetof(md.funcnametab)) != hdrAddr+uint64(hdr.funcnameOffset) ||
+		word(unsafe.Offsetof(md.pctab)) != hdrAddr+uint64(hdr.pctabOffset) {
+		return nil, 0, false
+	}
+
+	// The slices, as the bytes they cover.
+	sliceAt := func(off, elemSize uintptr) ([]byte, bool) {
+		n := word(off + unsafe.Sizeof(uintptr(0)))
+		b := img.slice(word(off), n*uint64(elemSize))
+		return b, b != nil || n == 0
+	}
+	var ok [7]bool
+	var cutab, ftab []byte
+	md.funcnametab, ok[0] = sliceAt(unsafe.Offsetof(md.funcnametab), 1)
+	cutab, ok[1] = sliceAt(unsafe.Offsetof(md.cutab), 4)
+	md.filetab, ok[2] = sliceAt(unsafe.Offsetof(md.filetab), 1)
+	md.pctab, ok[3] = sliceAt(unsafe.Offsetof(md.pctab), 1)
+	md.pclntable, ok[4] = sliceAt(unsafe.Offsetof(md.pclntable), 1)
+	ftab, ok[5] = sliceAt(unsafe.Offsetof(md.ftab), unsafe.Sizeof(functab{}))
+	ok[6] = len(ftab) > 0
+	for _, ok := range ok {
+		if !ok {
+			return nil, 0, false
+		}
+	}
+	md.cutab = unsafe.Slice((*uint32)(unsafe.Pointer(unsafe.SliceData(cutab))), len(cutab)/4)
+	md.ftab = unsafe.Slice((*functab)(unsafe.Pointer(unsafe.SliceData(ftab))), len(ftab)/int(unsafe.Sizeof(functab{})))
+	md.pcHeader = hdr
+
+	textAddr := word(unsafe.Offsetof(md.text))
+	etextAddr := word(unsafe.Offsetof(md.etext))
+	text := img.slice(textAddr, etextAddr-textAddr)
+	gofunc := img.at(word(unsafe.Offsetof(md.gofunc)))
+	if etextAddr <= textAddr || text == nil || gofunc == nil {
+		return nil, 0, false
+	}
+	md.text = uintptr(unsafe.Pointer(unsafe.SliceData(text)))
+	md.etext = md.text + uintptr(len(text))
+	md.minpc = md.text + uintptr(word(unsafe.Offsetof(md.minpc))-textAddr)
+	md.maxpc = md.text + uintptr(word(unsafe.Offsetof(md.maxpc))-textAddr)
+	md.gofunc = uintptr(unsafe.Pointer(unsafe.SliceData(gofunc)))
+
+	return &md, uintptr(textAddr), true
+}
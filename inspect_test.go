@@ -0,0 +1,158 @@
+package redefine
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"go/version"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var inspectInput = 21
+
+func inspectInlined(n int) int {
+	return n * 2
+}
+
+func TestInspectBinary(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("test binaries are position-independent")
+	}
+	assert.Equal(t, 42, inspectInlined(inspectInput))
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	funcs, err := InspectBinary(exe, "github.com/pboyd/redefine")
+	require.NoError(t, err)
+	byName := map[string]BinaryFunction{}
+	for _, f := range funcs {
+		byName[f.Name] = f
+	}
+
+	// A position-independent test binary, from -buildmode=pie, isn't
+	// loaded at its link-time addresses.
+	var slide uintptr
+	if isPIE(t, exe) {
+		name := "github.com/pboyd/redefine.noArgsNoReturn"
+		slide = reflect.ValueOf(noArgsNoReturn).Pointer() - byName[name].Entry
+	}
+
+	// It matches what the runtime says about the running copy.
+	for f := range Functions("github.com/pboyd/redefine") {
+		bf, ok := byName[f.Name]
+		if assert.True(t, ok, f.Name) {
+			assert.Equal(t, f.Entry, bf.Entry+slide, f.Name)
+			assert.Equal(t, f.Size, bf.Size, f.Name)
+		}
+	}
+
+	bf := byName["github.com/pboyd/redefine.noArgsNoReturn"]
+	assert.True(t, bf.Redefinable)
+	assert.NoError(t, bf.CloneErr)
+	assert.GreaterOrEqual(t, bf.Room, bf.Size)
+
+	bf = byName["github.com/pboyd/redefine.(*wrapperOuter).Sum"]
+	assert.True(t, bf.Wrapper)
+	assert.Contains(t, byName["github.com/pboyd/redefine.wrapperTarget.Sum"].InlinedInto, bf.Name)
+
+	bf = byName["github.com/pboyd/redefine.inspectInlined"]
+	assert.Zero(t, bf.Entry)
+	assert.False(t, bf.Redefinable)
+	assert.Contains(t, bf.InlinedInto, "github.com/pboyd/redefine.TestInspectBinary")
+
+	funcs, err = InspectBinary(exe, "github.com/pboyd/redefine.genericToString*")
+	require.NoError(t, err)
+	shapes := 0
+	for _, f := range funcs {
+		if strings.Contains(f.Name, "[go.shape.") {
+			assert.True(t, f.Shape, f.Name)
+			shapes++
+		}
+		assert.False(t, f.Redefinable, f.Name)
+	}
+	assert.NotZero(t, shapes)
+
+	_, err = InspectBinary("inspect_test.go", "")
+	assert.Error(t, err)
+}
+
+func TestInspectBinary_GoVersion(t *testing.T) {
+	lang := version.Lang(runtime.Version())
+	if lang == "" {
+		t.Skip("devel toolchain")
+	}
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	data, err := os.ReadFile(exe)
+	require.NoError(t, err)
+
+	// Change the version in the build info, without changing its length.
+	i := buildInfoVersion(data)
+	require.GreaterOrEqual(t, i, 0)
+	require.True(t, bytes.HasPrefix(data[i:], []byte(lang)))
+	old := "go1.20"
+	if lang == old {
+		old = "go1.21"
+	}
+	copy(data[i:], old[:len(lang)])
+
+	path := filepath.Join(t.TempDir(), "old")
+	require.NoError(t, os.WriteFile(path, data, 0o755))
+
+	_, err = InspectBinary(path, "github.com/pboyd/redefine")
+	assert.ErrorContains(t, err, "was built with "+old)
+}
+
+// buildInfoVersion returns the offset of the Go version in the build info of
+// the program in data, or -1 if it isn't found.
+func buildInfoVersion(data []byte) int {
+	// The header is 32 bytes, aligned to 16, and starts with the magic
+	// string. The string can appear elsewhere too, such as in the code
+	// of debug/buildinfo.
+	const (
+		magic        = "\xff Go buildinf:"
+		headerSize   = 32
+		flagsOffset  = 15
+		flagsInlined = 0x2
+	)
+	for off := 0; ; off++ {
+		i := bytes.Index(data[off:], []byte(magic))
+		if i < 0 {
+			return -1
+		}
+		off += i
+		if off%16 != 0 || off+headerSize > len(data) || data[off+flagsOffset]&flagsInlined == 0 {
+			continue
+		}
+
+		// The version follows the header, as a string prefixed by its
+		// length.
+		rest := data[off+headerSize:]
+		n, size := binary.Uvarint(rest)
+		if size <= 0 || n > uint64(len(rest)-size) {
+			continue
+		}
+		if string(rest[size:size+int(n)]) == runtime.Version() {
+			return off + headerSize + size
+		}
+	}
+}
+
+// isPIE reports whether the ELF program at path is position-independent.
+func isPIE(t *testing.T, path string) bool {
+	f, err := elf.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	return f.Type == elf.ET_DYN
+}
@@ -0,0 +1,264 @@
+package redefine
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"unsafe"
+	"weak"
+)
+
+// instanceMethod dispatches calls to a method based on the receiver.
+type instanceMethod struct {
+	original reflect.Value
+	restore  func() error
+
+	// The clonedFunc that was created when the dispatcher was installed.
+	// If it changes the method was restored behind our back.
+	cloned any
+
+	mu        sync.RWMutex
+	instances map[uintptr]instanceFunc
+}
+
+type instanceFunc struct {
+	fn      reflect.Value
+	cleanup runtime.Cleanup
+
+	// instance is a weak.Pointer to the receiver, and receiver returns
+	// what it points to. Once the receiver is collected, another object
+	// can be allocated at the same address before the cleanup runs, and
+	// it mustn't get the redefinition.
+	instance any
+	receiver func() unsafe.Pointer
+}
+
+var (
+	// instanceMu serializes changes to instanceMethods. It's always
+	// acquired before mu.
+	instanceMu sync.Mutex
+
+	// instanceMethods maps method entry points to their dispatchers.
+	instanceMethods = map[uintptr]*instanceMethod{}
+)
+
+// MethodFor redefines a method for a single instance of a type. Calls with any
+// other receiver run the original method. fn must be a method expression with
+// a pointer receiver, and newFn has the same requirements as in Method. For
+// example:
+//
+//	type myResolver net.Resolver
+//
+//	func (*myResolver) LookupHost(context.Context, string) ([]string, error) {
+//		return []string{"127.0.0.1"}, nil
+//	}
+//
+//	resolver := &net.Resolver{}
+//	redefine.MethodFor(resolver, (*net.Resolver).LookupHost, (*myResolver).LookupHost)
+//
+// The redefinition is removed when instance is garbage collected, or by
+// RestoreFor. The method is restored once no instances are left. Calling
+// Restore on the method removes every instance.
+//
+// While any instance is registered, every call to the method goes through
+// reflection, which is slow.
+func MethodFor[R, T1, T2 any](instance *R, fn T1, newFn T2) error {
+	if instance == nil {
+		return errors.New("instance is nil")
+	}
+
+	fnv := reflect.ValueOf(fn)
+	if fnv.Kind() != reflect.Func || fnv.IsNil() {
+		return fmt.Errorf("not a function, kind: %v", fnv.Kind())
+	}
+	newFnv := reflect.ValueOf(newFn)
+	if newFnv.Kind() != reflect.Func || newFnv.IsNil() {
+		return fmt.Errorf("not a function, kind: %v", newFnv.Kind())
+	}
+
+	fnType := fnv.Type()
+	if fnType.NumIn() == 0 || fnType.In(0) != reflect.TypeFor[*R]() {
+		return fmt.Errorf("%v is not a method of %v", fnType, reflect.TypeFor[*R]())
+	}
+
+	diff := diffFuncs(fnv, newFnv)
+	diff.ignoreEquivalentReceiver(false)
+	if err := diff.Error(); err != nil {
+		return fmt.Errorf("function signatures do not match: %w", err)
+	}
+
+	instanceMu.Lock()
+	defer instanceMu.Unlock()
+
+	entry := fnv.Pointer()
+	im, ok := instanceMethods[entry]
+	if ok && !im.installed(entry) {
+		im.stop()
+		ok = false
+	}
+	if !ok {
+		im = &instanceMethod{
+			restore: func() error {
+				return Restore(fn)
+			},
+			instances: map[uintptr]instanceFunc{},
+		}
+
+		dispatch := reflect.MakeFunc(fnType, im.call)
+		err := unsafeFunc(fn, dispatch.Interface(), true, options{})
+		if err != nil {
+			return err
+		}
+
+		// Original would return nil without a copy.
+		var ref **byte
+		mu.RLock()
+		im.cloned = redefined[entry]
+		if pc, ok := im.cloned.(patchedCode); ok {
+			ref = pc.funcRef()
+		}
+		mu.RUnlock()
+		if ref == nil {
+			Restore(fn)
+			return fmt.Errorf("unable to clone function: %w", noOriginalError(entry))
+		}
+		im.original = reflect.ValueOf(funcFromRef[T1](ref))
+
+		instanceMethods[entry] = im
+	}
+
+	key := uintptr(unsafe.Pointer(instance))
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	if old, ok := im.instances[key]; ok {
+		old.cleanup.Stop()
+	}
+	wp := weak.Make(instance)
+	im.instances[key] = instanceFunc{
+		fn: newFnv,
+		cleanup: runtime.AddCleanup(instance, func(wp weak.Pointer[R]) {
+			removeInstance(entry, key, wp)
+		}, wp),
+		instance: wp,
+		receiver: func() unsafe.Pointer {
+			return unsafe.Pointer(wp.Value())
+		},
+	}
+
+	return nil
+}
+
+// RestoreFor reverses the effect of MethodFor for one instance.
+func RestoreFor[R, T any](instance *R, fn T) error {
+	fnv := reflect.ValueOf(fn)
+	if fnv.Kind() != reflect.Func {
+		return fmt.Errorf("not a function, kind: %v", fnv.Kind())
+	}
+
+	key := uintptr(unsafe.Pointer(instance))
+
+	instanceMu.Lock()
+	defer instanceMu.Unlock()
+
+	im, ok := instanceMethods[fnv.Pointer()]
+	if !ok {
+		// Not redefined, this is a no-op
+		return nil
+	}
+
+	im.mu.Lock()
+	if f, ok := im.instances[key]; ok {
+		f.cleanup.Stop()
+	}
+	im.mu.Unlock()
+
+	return removeInstanceLocked(fnv.Pointer(), key, weak.Make(instance))
+}
+
+// removeInstance removes the redefinition for one instance of the method at
+// entry. It's called when the instance is garbage collected.
+func removeInstance(entry, key uintptr, instance any) {
+	instanceMu.Lock()
+	defer instanceMu.Unlock()
+
+	removeInstanceLocked(entry, key, instance)
+}
+
+// removeInstanceLocked removes the redefinition for one instance of the method
+// at entry, and restores the method if it was the last one. instance is the
+// weak.Pointer to it, so a new object at the same address is left alone. The
+// caller must hold instanceMu.
+func removeInstanceLocked(entry, key uintptr, instance any) error {
+	im, ok := instanceMethods[entry]
+	if !ok {
+		return nil
+	}
+
+	im.mu.Lock()
+	if f, ok := im.instances[key]; ok && f.instance == instance {
+		delete(im.instances, key)
+	}
+	remaining := len(im.instances)
+	im.mu.Unlock()
+
+	if remaining > 0 {
+		return nil
+	}
+
+	delete(instanceMethods, entry)
+	if !im.installed(entry) {
+		return nil
+	}
+	return im.restore()
+}
+
+// call is the implementation of the dispatcher that replaces the method.
+func (im *instanceMethod) call(args []reflect.Value) []reflect.Value {
+	im.mu.RLock()
+	f, ok := im.instances[args[0].Pointer()]
+	im.mu.RUnlock()
+
+	// The receiver may only have the address of a collected instance.
+	ok = ok && f.receiver() == args[0].UnsafePointer()
+
+	fn := im.original
+	if ok {
+		fn = f.fn
+
+		// The receiver for newFn may be a different but equivalent
+		// type.
+		if recv := fn.Type().In(0); recv != args[0].Type() {
+			args[0] = reflect.NewAt(recv.Elem(), args[0].UnsafePointer())
+		}
+	}
+
+	if fn.Type().IsVariadic() {
+		return fn.CallSlice(args)
+	}
+	return fn.Call(args)
+}
+
+// installed reports whether the dispatcher is still the redefinition for the
+// method at entry.
+func (im *instanceMethod) installed(entry uintptr) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	cloned, ok := redefined[entry]
+	return ok && cloned == im.cloned
+}
+
+// stop cancels the cleanups for every instance.
+func (im *instanceMethod) stop() {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	for _, f := range im.instances {
+		f.cleanup.Stop()
+	}
+	im.instances = nil
+}
@@ -0,0 +1,150 @@
+package redefine
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+	"unsafe"
+	"weak"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type instanceStruct struct {
+	name string
+	n    int
+}
+
+//go:noinline
+func (s *instanceStruct) Greet(greeting string) string {
+	return greeting + " " + s.name
+}
+
+type instanceFake instanceStruct
+
+func (s *instanceFake) Greet(greeting string) string {
+	return "fake " + greeting + " " + s.name
+}
+
+//go:noinline
+func (s *instanceStruct) Sum(nums ...int) int {
+	for _, n := range nums {
+		s.n += n
+	}
+	return s.n
+}
+
+func TestMethodFor(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	a := &instanceStruct{name: "a"}
+	b := &instanceStruct{name: "b"}
+
+	require.NoError(MethodFor(a, (*instanceStruct).Greet, (*instanceFake).Greet))
+
+	assert.Equal("fake hi a", a.Greet("hi"))
+	assert.Equal("hi b", b.Greet("hi"))
+
+	require.NoError(MethodFor(b, (*instanceStruct).Greet, func(s *instanceStruct, greeting string) string {
+		return "closure " + s.name
+	}))
+	assert.Equal("fake hi a", a.Greet("hi"))
+	assert.Equal("closure b", b.Greet("hi"))
+
+	require.NoError(RestoreFor(a, (*instanceStruct).Greet))
+	assert.Equal("hi a", a.Greet("hi"))
+	assert.Equal("closure b", b.Greet("hi"))
+
+	require.NoError(RestoreFor(b, (*instanceStruct).Greet))
+	assert.Equal("hi b", b.Greet("hi"))
+}
+
+func TestMethodFor_Variadic(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	a := &instanceStruct{}
+	b := &instanceStruct{}
+
+	require.NoError(MethodFor(a, (*instanceStruct).Sum, func(s *instanceStruct, nums ...int) int {
+		return -len(nums)
+	}))
+	t.Cleanup(func() { RestoreFor(a, (*instanceStruct).Sum) })
+
+	assert.Equal(-3, a.Sum(1, 2, 3))
+	assert.Equal(6, b.Sum(1, 2, 3))
+}
+
+func TestMethodFor_GC(t *testing.T) {
+	require := require.New(t)
+
+	func() {
+		instance := &instanceStruct{name: "temporary"}
+		require.NoError(MethodFor(instance, (*instanceStruct).Greet, (*instanceFake).Greet))
+		require.Equal("fake hi temporary", instance.Greet("hi"))
+	}()
+
+	registered := func() bool {
+		instanceMu.Lock()
+		defer instanceMu.Unlock()
+		_, ok := instanceMethods[reflect.ValueOf((*instanceStruct).Greet).Pointer()]
+		return ok
+	}
+
+	for i := 0; i < 100 && registered(); i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.False(registered())
+
+	mu.RLock()
+	_, ok := redefined[reflect.ValueOf((*instanceStruct).Greet).Pointer()]
+	mu.RUnlock()
+	require.False(ok)
+}
+
+func TestMethodFor_ReusedAddress(t *testing.T) {
+	require := require.New(t)
+
+	kept := &instanceStruct{name: "kept"}
+	require.NoError(MethodFor(kept, (*instanceStruct).Greet, (*instanceFake).Greet))
+	t.Cleanup(func() { RestoreFor(kept, (*instanceStruct).Greet) })
+
+	// Pretend other was allocated where a collected instance used to be,
+	// before its cleanup ran.
+	entry := reflect.ValueOf((*instanceStruct).Greet).Pointer()
+	other := &instanceStruct{name: "other"}
+	otherKey := uintptr(unsafe.Pointer(other))
+	instanceMu.Lock()
+	im := instanceMethods[entry]
+	instanceMu.Unlock()
+	im.mu.Lock()
+	im.instances[otherKey] = im.instances[uintptr(unsafe.Pointer(kept))]
+	im.mu.Unlock()
+
+	require.Equal("hi other", other.Greet("hi"))
+	require.Equal("fake hi kept", kept.Greet("hi"))
+
+	// Likewise, removing other leaves the entry for another instance.
+	removeInstance(entry, otherKey, weak.Make(other))
+	im.mu.RLock()
+	_, ok := im.instances[otherKey]
+	im.mu.RUnlock()
+	require.True(ok)
+
+	im.mu.Lock()
+	delete(im.instances, otherKey)
+	im.mu.Unlock()
+}
+
+func TestMethodFor_Errors(t *testing.T) {
+	assert := assert.New(t)
+
+	var nilInstance *instanceStruct
+	assert.Error(MethodFor(nilInstance, (*instanceStruct).Greet, (*instanceFake).Greet))
+	assert.Error(MethodFor(&instanceStruct{}, (*testStruct).Inc, (*testStruct2).Double))
+	assert.Error(MethodFor(&instanceStruct{}, (*instanceStruct).Greet, (*instanceStruct).Sum))
+}
@@ -0,0 +1,73 @@
+// Package buildtest builds and runs the test programs under testdata.
+package buildtest
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Build runs "go build" on pkg with flags and returns the path to the output,
+// which is in a temporary directory. It skips the test in short mode or if the
+// go command isn't available.
+func Build(t testing.TB, pkg string, flags ...string) string {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("skipping build in short mode")
+	}
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skipf("go command not available: %v", err)
+	}
+
+	prog := filepath.Join(t.TempDir(), path.Base(pkg))
+	args := append([]string{"build", "-o", prog}, flags...)
+	out, err := exec.Command(goBin, append(args, pkg)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build %s: %v\n%s", strings.Join(append(flags, pkg), " "), err, out)
+	}
+	return prog
+}
+
+// Run runs prog with args. The test fails unless it exits successfully and
+// prints "ok".
+func Run(t testing.TB, prog string, args ...string) {
+	t.Helper()
+
+	out, err := exec.Command(prog, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", prog, err, out)
+	}
+	if strings.TrimSpace(string(out)) != "ok" {
+		t.Fatalf("%s: unexpected output:\n%s", prog, out)
+	}
+}
+
+// BuildAndRun builds pkg and runs it with args, the same as Build and Run.
+func BuildAndRun(t testing.TB, pkg string, args ...string) {
+	t.Helper()
+	Run(t, Build(t, pkg), args...)
+}
+
+// RequireCgo skips the test if cgo isn't available and returns the C compiler.
+func RequireCgo(t testing.TB) string {
+	t.Helper()
+
+	if os.Getenv("CGO_ENABLED") == "0" {
+		t.Skip("cgo is disabled")
+	}
+
+	cc := os.Getenv("CC")
+	if cc == "" {
+		cc = "cc"
+	}
+	if _, err := exec.LookPath(cc); err != nil {
+		t.Skipf("no C compiler: %v", err)
+	}
+	return cc
+}
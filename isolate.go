@@ -0,0 +1,227 @@
+package redefine
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+)
+
+// isolatedClone copies the function at entry along with every function it
+// calls, directly or indirectly, that leads to a redefined function. Calls
+// between the copies are redirected so the whole tree runs the original code.
+// The first buffer returned is the copy of entry.
+//
+// It also returns every function in the call tree, and whether it was
+// redefined. The copies only need to be made again if that changes.
+//
+// The caller must hold mu and call alloc.BeginMutate first.
+func isolatedClone(alloc *allocator, entry uintptr) ([][]byte, map[uintptr]bool, error) {
+	graph, err := callGraph(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deps := make(map[uintptr]bool, len(graph))
+	for fn := range graph {
+		_, deps[fn] = redefined[fn]
+	}
+
+	// Work backwards from the redefined functions to find everything
+	// that can reach them.
+	callers := map[uintptr][]uintptr{}
+	for caller, callees := range graph {
+		for _, callee := range callees {
+			callers[callee] = append(callers[callee], caller)
+		}
+	}
+
+	tainted := map[uintptr]bool{entry: true}
+	var queue []uintptr
+	for fn := range graph {
+		if _, ok := redefined[fn]; ok {
+			tainted[fn] = true
+			queue = append(queue, fn)
+		}
+	}
+	for len(queue) > 0 {
+		fn := queue[0]
+		queue = queue[1:]
+		for _, caller := range callers[fn] {
+			if !tainted[caller] {
+				tainted[caller] = true
+				queue = append(queue, caller)
+			}
+		}
+	}
+
+	// Allocate everything up front so the addresses are known before any
+	// of the calls are relocated.
+	order := []uintptr{entry}
+	for fn := range tainted {
+		if fn != entry {
+			order = append(order, fn)
+		}
+	}
+
+	copies := make([][]byte, 0, len(order))
+	addrs := make(map[uintptr]uintptr, len(order))
+
+	freeAll := func() {
+		for _, c := range copies {
+			alloc.Free(c)
+		}
+	}
+
+	for _, fn := range order {
+		src, err := originalSource(fn)
+		if err != nil {
+			freeAll()
+			return nil, nil, err
+		}
+
+		buf, err := alloc.Allocate(relocatedSize(src))
+		if err != nil {
+			freeAll()
+			return nil, nil, err
+		}
+		copies = append(copies, buf)
+		addrs[fn] = uintptr(unsafe.Pointer(unsafe.SliceData(buf)))
+	}
+
+	resolve := func(target uintptr) uintptr {
+		if addr, ok := addrs[target]; ok {
+			return addr
+		}
+		return target
+	}
+
+	for i, fn := range order {
+		src, _ := originalSource(fn)
+		code, err := relocateFunc(src, copies[i], resolve)
+		if err != nil {
+			freeAll()
+			return nil, nil, err
+		}
+		copies[i] = code
+		cacheflush(code)
+		addSymbol(code, symbolName(fn), "copy")
+	}
+
+	return copies, deps, nil
+}
+
+// originalSource returns the original machine instructions for the function
+// at entry. For redefined functions that's the existing clone.
+//
+// The caller must hold mu.
+func originalSource(entry uintptr) ([]byte, error) {
+	if cloned, ok := redefined[entry]; ok {
+		cc, ok := cloned.(codeCopy)
+		if !ok {
+			return nil, errors.New("redefined function has no clone")
+		}
+
+		code, err := cc.code()
+		if err != nil {
+			return nil, err
+		}
+		if code == nil {
+			return nil, noOriginalError(entry)
+		}
+		return code, nil
+	}
+
+	return funcSliceAt(entry)
+}
+
+var (
+	callGraphsMu sync.Mutex
+
+	// callGraphs caches the result of callGraph for each entry. The
+	// original code of a function only changes when ForeignLayer makes
+	// another library's code the original, see forgetCallGraphs.
+	callGraphs = map[uintptr]map[uintptr][]uintptr{}
+)
+
+// forgetCallGraphs empties the cache of call graphs.
+func forgetCallGraphs() {
+	callGraphsMu.Lock()
+	defer callGraphsMu.Unlock()
+
+	clear(callGraphs)
+}
+
+// callGraph returns every function reachable from entry through direct calls,
+// mapped to the functions it calls. The result is cached and must not be
+// modified.
+//
+// The caller must hold mu.
+func callGraph(entry uintptr) (map[uintptr][]uintptr, error) {
+	callGraphsMu.Lock()
+	defer callGraphsMu.Unlock()
+
+	if graph, ok := callGraphs[entry]; ok {
+		return graph, nil
+	}
+
+	graph, err := walkCallGraph(entry)
+	if err != nil {
+		return nil, err
+	}
+	callGraphs[entry] = graph
+
+	return graph, nil
+}
+
+// walkCallGraph decodes the functions reachable from entry for callGraph.
+func walkCallGraph(entry uintptr) (map[uintptr][]uintptr, error) {
+	graph := map[uintptr][]uintptr{}
+
+	queue := []uintptr{entry}
+	for len(queue) > 0 {
+		fn := queue[0]
+		queue = queue[1:]
+		if _, ok := graph[fn]; ok {
+			continue
+		}
+
+		src, err := originalSource(fn)
+		if err != nil {
+			return nil, err
+		}
+
+		targets, err := callTargets(src)
+		if err != nil {
+			if fn == entry {
+				return nil, err
+			}
+
+			// Treat anything that can't be decoded as a leaf.
+			// Calls it makes to redefined functions will be
+			// missed.
+			targets = nil
+		}
+
+		callees := make([]uintptr, 0, len(targets))
+		for _, target := range targets {
+			// Only follow calls to the start of a known function.
+			info := findfunc(target)
+			if info._func == nil || info.datap.text+uintptr(info.entryOff) != target {
+				continue
+			}
+
+			callees = append(callees, target)
+			if _, ok := graph[target]; !ok {
+				queue = append(queue, target)
+			}
+		}
+		graph[fn] = callees
+	}
+
+	return graph, nil
+}
+
+// codeCopy is implemented by clonedFunc for any type.
+type codeCopy interface {
+	code() ([]byte, error)
+}
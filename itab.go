@@ -0,0 +1,263 @@
+package redefine
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"unsafe"
+)
+
+// itab mirrors the runtime's interface table (internal/abi.ITab).
+type itab struct {
+	inter unsafe.Pointer
+	typ   unsafe.Pointer
+	hash  uint32
+	fun   [1]uintptr // variable sized
+}
+
+// getitab returns the itab for an interface and concrete type, creating it if
+// it doesn't exist yet.
+//
+//go:linkname getitab runtime.getitab
+func getitab(inter, typ unsafe.Pointer, canfail bool) *itab
+
+type itabMethod struct {
+	tab   *itab
+	index int
+}
+
+// itabPatch is a patched itab entry.
+type itabPatch struct {
+	// original is the function the entry held before it was patched.
+	original uintptr
+
+	// trampoline sets the closure context for newFn, which is kept so
+	// the garbage collector doesn't free its funcval.
+	alloc      *allocator
+	trampoline []byte
+	newFn      any
+}
+
+// itabPatches maps every patched itab entry to how it was patched.
+var itabPatches = map[itabMethod]*itabPatch{}
+
+// Itab redefines a method for calls made through an interface. Only the
+// function pointer in the runtime's table for iface and concrete is changed,
+// so direct calls to the method and calls made through other interfaces still
+// use the original. Nothing is written to the program's machine code.
+//
+// newFn must have the signature of the method with the receiver as the first
+// argument. The receiver is the concrete type if it's stored directly in
+// interface values (pointers, maps, channels and functions), otherwise it's a
+// pointer to the concrete type. As with Method, the receiver may be a
+// different type of the same kind and size. Unlike Func, newFn may be a
+// closure, since it's called through a trampoline that sets its context. For
+// example:
+//
+//	type myReader bytes.Reader
+//
+//	func (*myReader) Read([]byte) (int, error) {
+//		return 0, io.EOF
+//	}
+//
+//	redefine.Itab(reflect.TypeFor[io.Reader](), reflect.TypeFor[*bytes.Reader](), "Read", (*myReader).Read)
+//
+// The table is created if the program hasn't needed it yet, so values
+// converted to the interface later are affected too. Calls the compiler
+// devirtualized are not affected.
+func Itab(iface, concrete reflect.Type, method string, newFn any) error {
+	tab, index, err := findItab(iface, concrete, method)
+	if err != nil {
+		return err
+	}
+
+	newFnv := reflect.ValueOf(newFn)
+	if newFnv.Kind() != reflect.Func || newFnv.IsNil() {
+		return fmt.Errorf("not a function, kind: %v", newFnv.Kind())
+	}
+
+	recv := concrete
+	if !isDirectIface(concrete) {
+		recv = reflect.PointerTo(concrete)
+	}
+	mt := iface.Method(index).Type
+	in := []reflect.Type{recv}
+	for i := 0; i < mt.NumIn(); i++ {
+		in = append(in, mt.In(i))
+	}
+	out := make([]reflect.Type, mt.NumOut())
+	for i := range out {
+		out[i] = mt.Out(i)
+	}
+	want := reflect.FuncOf(in, out, mt.IsVariadic())
+
+	diff := diffFuncs(reflect.Zero(want), newFnv)
+	diff.ignoreEquivalentReceiver(false)
+	if err := diff.Error(); err != nil {
+		return fmt.Errorf("function signatures do not match: %w", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// A call through an itab doesn't load the closure context, so newFn
+	// is called through a trampoline that does.
+	alloc := allocatorFor(newFnv.Pointer())
+	alloc.BeginMutate()
+	defer alloc.EndMutate()
+
+	buf, err := alloc.Allocate(closureTrampolineSize)
+	if err != nil {
+		return err
+	}
+	ctx := (*[2]unsafe.Pointer)(unsafe.Pointer(&newFn))[1]
+	err = writeClosureTrampoline(buf, uintptr(ctx), newFnv.Pointer())
+	if err != nil {
+		alloc.Free(buf)
+		return err
+	}
+	cacheflush(buf)
+
+	key := itabMethod{tab: tab, index: index}
+	fun := unsafe.Slice(&tab.fun[0], iface.NumMethod())
+	patch, ok := itabPatches[key]
+	if !ok {
+		patch = &itabPatch{original: fun[index]}
+	}
+
+	err = writeItab(&fun[index], uintptr(unsafe.Pointer(unsafe.SliceData(buf))))
+	if err != nil {
+		alloc.Free(buf)
+		return err
+	}
+	addSymbol(buf, symbolName(newFnv.Pointer()), "trampoline")
+
+	// The old trampoline isn't reachable now.
+	patch.free()
+	patch.alloc, patch.trampoline, patch.newFn = alloc, buf, newFn
+	itabPatches[key] = patch
+
+	return nil
+}
+
+// RestoreItab reverses the effect of Itab.
+func RestoreItab(iface, concrete reflect.Type, method string) error {
+	tab, index, err := findItab(iface, concrete, method)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	key := itabMethod{tab: tab, index: index}
+	patch, ok := itabPatches[key]
+	if !ok {
+		// Not redefined, this is a no-op
+		return nil
+	}
+
+	fun := unsafe.Slice(&tab.fun[0], iface.NumMethod())
+	err = writeItab(&fun[index], patch.original)
+	if err != nil {
+		return err
+	}
+
+	patch.free()
+	delete(itabPatches, key)
+	return nil
+}
+
+// free releases the trampoline, which the itab must no longer point to.
+func (p *itabPatch) free() {
+	if p.trampoline == nil {
+		return
+	}
+
+	p.alloc.BeginMutate()
+	defer p.alloc.EndMutate()
+
+	p.alloc.Free(p.trampoline)
+	p.alloc, p.trampoline, p.newFn = nil, nil, nil
+}
+
+// findItab returns the itab for iface and concrete, and the index of method
+// in it.
+func findItab(iface, concrete reflect.Type, method string) (*itab, int, error) {
+	if iface == nil || iface.Kind() != reflect.Interface {
+		return nil, 0, fmt.Errorf("not an interface: %v", iface)
+	}
+	if concrete == nil || concrete.Kind() == reflect.Interface {
+		return nil, 0, fmt.Errorf("not a concrete type: %v", concrete)
+	}
+	if !concrete.Implements(iface) {
+		return nil, 0, fmt.Errorf("%v does not implement %v", concrete, iface)
+	}
+
+	// Interface methods are sorted the same way in reflect and the itab.
+	m, ok := iface.MethodByName(method)
+	if !ok {
+		return nil, 0, fmt.Errorf("%v has no method %s", iface, method)
+	}
+
+	tab := getitab(typePointer(iface), typePointer(concrete), true)
+	if tab == nil {
+		return nil, 0, fmt.Errorf("no itab for %v and %v", iface, concrete)
+	}
+
+	return tab, m.Index, nil
+}
+
+// writeItab sets an itab entry. Itabs generated by the compiler are in
+// read-only memory, so the page is made writable temporarily.
+func writeItab(entry *uintptr, fn uintptr) error {
+	prot, ok := moduleProtection(uintptr(unsafe.Pointer(entry)))
+	if !ok {
+		// Allocated by the runtime.
+		atomic.StoreUintptr(entry, fn)
+		return nil
+	}
+
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(entry)), unsafe.Sizeof(*entry))
+	err := mprotect(buf, mprotectRW)
+	if err != nil {
+		return fmt.Errorf("mprotect: %w", err)
+	}
+	defer mprotect(buf, prot)
+
+	atomic.StoreUintptr(entry, fn)
+	return nil
+}
+
+// moduleProtection returns the protection the loader gave the page at addr, if
+// it's in the code or read-only data of a module.
+func moduleProtection(addr uintptr) (int, bool) {
+	for _, datap := range modules() {
+		switch {
+		case datap.text <= addr && addr < datap.etext:
+			return mprotectRX, true
+		case datap.etext <= addr && addr < datap.noptrdata:
+			return mprotectR, true
+		}
+	}
+	return 0, false
+}
+
+// typePointer returns the runtime's type descriptor for t.
+func typePointer(t reflect.Type) unsafe.Pointer {
+	return (*[2]unsafe.Pointer)(unsafe.Pointer(&t))[1]
+}
+
+// isDirectIface reports whether values of t are stored directly in interface
+// values instead of behind a pointer.
+func isDirectIface(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return true
+	case reflect.Struct:
+		return t.NumField() == 1 && isDirectIface(t.Field(0).Type)
+	case reflect.Array:
+		return t.Len() == 1 && isDirectIface(t.Elem())
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package redefine
+
+import (
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type itabNamer interface {
+	Name() string
+}
+
+// Only used in type assertions so the itab is created at runtime.
+type itabLazyNamer interface {
+	Name() string
+}
+
+type itabImpl struct {
+	name string
+}
+
+//go:noinline
+func (i *itabImpl) Name() string {
+	return i.name
+}
+
+type itabFake itabImpl
+
+func (f *itabFake) Name() string {
+	return "fake " + f.name
+}
+
+type itabValue struct {
+	name string
+	n    int
+}
+
+func (v itabValue) Name() string {
+	return v.name
+}
+
+type itabValueFake itabValue
+
+func (v itabValueFake) Name() string {
+	return "fake " + v.name
+}
+
+//go:noinline
+func callName(n itabNamer) string {
+	return n.Name()
+}
+
+//go:noinline
+func callLazyName(v any) string {
+	return v.(itabLazyNamer).Name()
+}
+
+func TestItab(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	iface := reflect.TypeFor[itabNamer]()
+	concrete := reflect.TypeFor[*itabImpl]()
+
+	impl := &itabImpl{name: "impl"}
+	assert.Equal("impl", callName(impl))
+
+	require.NoError(Itab(iface, concrete, "Name", (*itabFake).Name))
+	assert.Equal("fake impl", callName(impl))
+	assert.Equal("impl", impl.Name())
+
+	require.NoError(RestoreItab(iface, concrete, "Name"))
+	assert.Equal("impl", callName(impl))
+
+	// No-op
+	require.NoError(RestoreItab(iface, concrete, "Name"))
+}
+
+func TestItab_Lazy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	iface := reflect.TypeFor[itabLazyNamer]()
+	require.NoError(Itab(iface, reflect.TypeFor[*itabImpl](), "Name", (*itabFake).Name))
+	t.Cleanup(func() { RestoreItab(iface, reflect.TypeFor[*itabImpl](), "Name") })
+
+	assert.Equal("fake lazy", callLazyName(&itabImpl{name: "lazy"}))
+}
+
+func TestItab_ValueReceiver(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	iface := reflect.TypeFor[itabNamer]()
+	concrete := reflect.TypeFor[itabValue]()
+
+	require.NoError(Itab(iface, concrete, "Name", (*itabValueFake).Name))
+	t.Cleanup(func() { RestoreItab(iface, concrete, "Name") })
+
+	assert.Equal("fake value", callName(itabValue{name: "value"}))
+}
+
+func TestItab_Errors(t *testing.T) {
+	assert := assert.New(t)
+
+	iface := reflect.TypeFor[itabNamer]()
+	concrete := reflect.TypeFor[*itabImpl]()
+
+	assert.Error(Itab(concrete, concrete, "Name", (*itabFake).Name))
+	assert.Error(Itab(iface, iface, "Name", (*itabFake).Name))
+	assert.Error(Itab(iface, reflect.TypeFor[itabImpl](), "Name", (*itabFake).Name))
+	assert.Error(Itab(iface, concrete, "Missing", (*itabFake).Name))
+	assert.Error(Itab(iface, concrete, "Name", "not a function"))
+	assert.Error(Itab(iface, concrete, "Name", func(*itabImpl) int { return 0 }))
+	assert.Error(Itab(iface, concrete, "Name", itabValueFake.Name))
+}
+
+func TestItab_Closure(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	iface := reflect.TypeFor[itabNamer]()
+	concrete := reflect.TypeFor[*itabImpl]()
+	t.Cleanup(func() { RestoreItab(iface, concrete, "Name") })
+
+	prefix := "closure"
+	require.NoError(Itab(iface, concrete, "Name", func(i *itabImpl) string {
+		return prefix + " " + i.name
+	}))
+	assert.Equal("closure impl", callName(&itabImpl{name: "impl"}))
+
+	// Replacing it frees the first trampoline.
+	suffix := "again"
+	require.NoError(Itab(iface, concrete, "Name", func(i *itabImpl) string {
+		return i.name + " " + suffix
+	}))
+	assert.Equal("impl again", callName(&itabImpl{name: "impl"}))
+
+	require.NoError(RestoreItab(iface, concrete, "Name"))
+	assert.Equal("impl", callName(&itabImpl{name: "impl"}))
+}
+
+func TestModuleProtection(t *testing.T) {
+	assert := assert.New(t)
+
+	prot, ok := moduleProtection(reflect.ValueOf(callName).Pointer())
+	assert.True(ok)
+	assert.Equal(mprotectRX, prot)
+
+	// The compiler writes this itab to the read-only data.
+	tab, _, err := findItab(reflect.TypeFor[itabNamer](), reflect.TypeFor[*itabImpl](), "Name")
+	require.NoError(t, err)
+	prot, ok = moduleProtection(uintptr(unsafe.Pointer(tab)))
+	assert.True(ok)
+	assert.Equal(mprotectR, prot)
+
+	_, ok = moduleProtection(uintptr(unsafe.Pointer(new(int))))
+	assert.False(ok)
+}
@@ -0,0 +1,324 @@
+package redefine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+// MethodByName redefines the method called name on t. It works like Method,
+// but it doesn't need a method expression, so it can redefine unexported
+// methods and methods of types that are only known at runtime. For example:
+//
+//	type myBuffer bytes.Buffer
+//
+//	func (*myBuffer) grow(int) int {
+//		return 0
+//	}
+//
+//	redefine.MethodByName(reflect.TypeFor[*bytes.Buffer](), "grow", (*myBuffer).grow)
+//
+// t may be the type or a pointer to it. If the method has a value receiver it
+// is redefined for both, otherwise t must be the pointer type. newFn has the
+// same requirements as in Method.
+//
+// The method is found in t's method table, or by name if the linker removed it
+// from the table. In the second case the signature isn't known, so only the
+// receiver of newFn is checked.
+//
+// Wrappers the compiler wrote for the method are handled the same way as in
+// Method, including the Unredirected option. Use RestoreMethodByName to restore
+// it.
+func MethodByName(t reflect.Type, name string, newFn any, opts ...Option) error {
+	newFnv := reflect.ValueOf(newFn)
+	if newFnv.Kind() != reflect.Func || newFnv.IsNil() {
+		return fmt.Errorf("not a function, kind: %v", newFnv.Kind())
+	}
+
+	m, err := findMethod(t, name)
+	if err != nil {
+		return err
+	}
+
+	var diff *funcDifferences
+	if m.typ != nil {
+		diff = diffFuncTypes(m.typ, newFnv.Type())
+	} else {
+		diff = diffReceivers(m.recv, newFnv.Type())
+	}
+	o := makeOptions(opts)
+	diff.ignoreEquivalentReceiver(o.unsafeReceiver)
+	if err := diff.Error(); err != nil {
+		return fmt.Errorf("function signatures do not match: %w", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, existed := redefined[m.entry]
+	err = unsafeFuncLocked(funcAt(m.entry), newFn, false, o)
+	if err != nil {
+		return err
+	}
+	return finishMethodLocked(m.entry, newFnv.Pointer(), existed, o)
+}
+
+// RestoreMethodByName reverses the effect of MethodByName.
+func RestoreMethodByName(t reflect.Type, name string) error {
+	m, err := findMethod(t, name)
+	if err != nil {
+		return err
+	}
+
+	return Restore(funcAt(m.entry))
+}
+
+// method is a method found by findMethod.
+type method struct {
+	name string
+
+	// entry is the address of the code.
+	entry uintptr
+
+	// recv is the receiver type.
+	recv reflect.Type
+
+	// typ is the type of the method expression, with the receiver as the
+	// first argument. It's nil if the signature isn't known.
+	typ reflect.Type
+}
+
+// findMethod finds the method called name on t or *t. Value receivers are
+// preferred, since the pointer method is only a wrapper.
+func findMethod(t reflect.Type, name string) (method, error) {
+	if t == nil {
+		return method{}, errors.New("type is nil")
+	}
+
+	valueType, pointerType := t, reflect.PointerTo(t)
+	if t.Kind() == reflect.Pointer {
+		valueType, pointerType = t.Elem(), t
+	}
+	if valueType.Name() == "" || valueType.PkgPath() == "" {
+		return method{}, fmt.Errorf("%v is not a named type", valueType)
+	}
+
+	prefix := symbolPrefix(valueType.PkgPath()) + "."
+	candidates := []struct {
+		recv   reflect.Type
+		symbol string
+	}{
+		{valueType, prefix + valueType.Name() + "." + name},
+		{pointerType, prefix + "(*" + valueType.Name() + ")." + name},
+	}
+
+	for _, c := range candidates {
+		// The pointer type's table also has wrappers for the value
+		// methods, but the value type is checked first.
+		m, ok := methodFromTable(c.recv, name)
+		if !ok {
+			m.entry, ok = funcByName(c.symbol)
+			m.name, m.recv = name, c.recv
+		}
+		if !ok {
+			continue
+		}
+
+		if m.recv != valueType && t == valueType {
+			return method{}, fmt.Errorf("%v.%s has a pointer receiver, use %v", t, name, pointerType)
+		}
+		return m, nil
+	}
+
+	return method{}, fmt.Errorf("%v has no method %s", t, name)
+}
+
+// funcAt returns a func value that calls the code at entry. The type only
+// satisfies unsafeFunc and Restore, which only look at the entry point.
+func funcAt(entry uintptr) func() {
+	fv := &struct{ fn uintptr }{entry}
+	return *(*func())(unsafe.Pointer(&fv))
+}
+
+// symbolPrefix escapes a package path the way the linker does in symbol
+// names.
+func symbolPrefix(pkgPath string) string {
+	slash := strings.LastIndexByte(pkgPath, '/')
+
+	var b strings.Builder
+	for i := 0; i < len(pkgPath); i++ {
+		c := pkgPath[i]
+		if c <= ' ' || c == '%' || c == '"' || c >= 0x7f || (c == '.' && i > slash) {
+			fmt.Fprintf(&b, "%%%02x", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// abiType mirrors the start of internal/abi.Type.
+type abiType struct {
+	size       uintptr
+	ptrBytes   uintptr
+	hash       uint32
+	tflag      uint8
+	align      uint8
+	fieldAlign uint8
+	kind       uint8
+	equal      func(unsafe.Pointer, unsafe.Pointer) bool
+	gcdata     *byte
+	str        int32
+	ptrToThis  int32
+}
+
+// tflagUncommon is set when an uncommonType follows the type.
+const tflagUncommon = 1 << 0
+
+// uncommonType mirrors internal/abi.UncommonType.
+type uncommonType struct {
+	pkgPath int32
+	mcount  uint16
+	xcount  uint16
+	moff    uint32
+	_       uint32
+}
+
+// abiMethod mirrors internal/abi.Method. Offsets that the linker removed are
+// -1.
+type abiMethod struct {
+	name int32
+	mtyp int32
+	ifn  int32
+	tfn  int32
+}
+
+// uncommonOffset returns the distance from the start of a type to its
+// uncommonType, which follows the part that's specific to the kind.
+func uncommonOffset(kind reflect.Kind) (uintptr, bool) {
+	base := unsafe.Sizeof(abiType{})
+	word := unsafe.Sizeof(uintptr(0))
+
+	switch kind {
+	case reflect.Struct, reflect.Interface:
+		// A package path and a slice.
+		return base + 4*word, true
+	case reflect.Pointer, reflect.Slice, reflect.Func:
+		// An element type, or the argument counts for functions,
+		// padded to a word.
+		return base + word, true
+	case reflect.Chan:
+		return base + 2*word, true
+	case reflect.Array:
+		return base + 3*word, true
+	case reflect.Map:
+		// The layout changes too often.
+		return 0, false
+	default:
+		return base, true
+	}
+}
+
+// methodFromTable looks up a method in the table the linker writes for t.
+func methodFromTable(t reflect.Type, name string) (method, bool) {
+	for _, m := range tableMethods(t) {
+		if m.name == name && m.entry != 0 {
+			return m, true
+		}
+	}
+	return method{}, false
+}
+
+// tableMethods returns the methods in the table the linker writes for t,
+// including unexported methods. entry is 0 for methods the linker removed.
+func tableMethods(t reflect.Type) []method {
+	tp := typePointer(t)
+	if (*abiType)(tp).tflag&tflagUncommon == 0 {
+		return nil
+	}
+	off, ok := uncommonOffset(t.Kind())
+	if !ok {
+		return nil
+	}
+
+	var datap *moduledata
+	for _, md := range modules() {
+		if uintptr(tp) >= md.types && uintptr(tp) < md.etypes {
+			datap = md
+			break
+		}
+	}
+	if datap == nil {
+		// Made by reflect at runtime.
+		return nil
+	}
+
+	// Names and types are offsets from the start of the module's types.
+	resolve := func(off int32) unsafe.Pointer {
+		return unsafe.Add(tp, int(datap.types)+int(off)-int(uintptr(tp)))
+	}
+
+	u := (*uncommonType)(unsafe.Add(tp, off))
+	abiMethods := unsafe.Slice((*abiMethod)(unsafe.Add(unsafe.Pointer(u), u.moff)), u.mcount)
+
+	methods := make([]method, 0, len(abiMethods))
+	for _, m := range abiMethods {
+		found := method{
+			name: abiName(resolve(m.name)),
+			recv: t,
+		}
+		if m.tfn != -1 {
+			found.entry = datap.textOff(m.tfn)
+		}
+		if m.mtyp != -1 {
+			ft := typeFromPointer(resolve(m.mtyp))
+			in := []reflect.Type{t}
+			for i := range ft.NumIn() {
+				in = append(in, ft.In(i))
+			}
+			out := make([]reflect.Type, ft.NumOut())
+			for i := range out {
+				out[i] = ft.Out(i)
+			}
+			found.typ = reflect.FuncOf(in, out, ft.IsVariadic())
+		}
+		methods = append(methods, found)
+	}
+
+	return methods
+}
+
+// abiName decodes an internal/abi.Name: a flag byte followed by the length
+// as a varint and the bytes.
+func abiName(p unsafe.Pointer) string {
+	// The length takes at most 10 bytes.
+	header := unsafe.Slice((*byte)(p), 11)
+	n, size := binary.Uvarint(header[1:])
+	if size <= 0 {
+		return ""
+	}
+	return unsafe.String((*byte)(unsafe.Add(p, 1+size)), n)
+}
+
+// typeFromPointer returns the reflect.Type for a runtime type descriptor.
+// It's the reverse of typePointer.
+func typeFromPointer(p unsafe.Pointer) reflect.Type {
+	var v any
+	(*[2]unsafe.Pointer)(unsafe.Pointer(&v))[0] = p
+	return reflect.TypeOf(v)
+}
+
+// textOff returns the address of code at an offset from the start of the
+// module's text, which may be split into sections.
+func (md *moduledata) textOff(off int32) uintptr {
+	addr := uintptr(off)
+	for i, sect := range md.textsectmap {
+		if addr >= sect.vaddr && (addr < sect.end || i == len(md.textsectmap)-1 && addr == sect.end) {
+			return sect.baseaddr + addr - sect.vaddr
+		}
+	}
+	return md.text + addr
+}
@@ -0,0 +1,125 @@
+package redefine
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type methodByNameType struct{ n int }
+
+//go:noinline
+func (m methodByNameType) value() int {
+	return m.n
+}
+
+//go:noinline
+func (m *methodByNameType) pointer() int {
+	return m.n * 2
+}
+
+//go:noinline
+func (m *methodByNameType) Exported(x int) int {
+	return m.n + x
+}
+
+type myMethodByNameType methodByNameType
+
+func (m myMethodByNameType) value() int {
+	return -1
+}
+
+func (m *myMethodByNameType) pointer() int {
+	return -2
+}
+
+func (m *myMethodByNameType) Exported(x int) int {
+	return -x
+}
+
+func TestMethodByName(t *testing.T) {
+	valueType := reflect.TypeFor[methodByNameType]()
+	pointerType := reflect.TypeFor[*methodByNameType]()
+
+	t.Run("exported", func(t *testing.T) {
+		m, err := findMethod(pointerType, "Exported")
+		require.NoError(t, err)
+		assert.Equal(t, reflect.TypeFor[func(*methodByNameType, int) int](), m.typ)
+		assert.Equal(t, reflect.ValueOf((*methodByNameType).Exported).Pointer(), m.entry)
+
+		require.NoError(t, MethodByName(pointerType, "Exported", (*myMethodByNameType).Exported))
+		assert.Equal(t, -2, (&methodByNameType{n: 1}).Exported(2))
+
+		require.NoError(t, RestoreMethodByName(pointerType, "Exported"))
+		assert.Equal(t, 3, (&methodByNameType{n: 1}).Exported(2))
+
+		// Restore works with the method expression too.
+		require.NoError(t, MethodByName(pointerType, "Exported", (*myMethodByNameType).Exported))
+		require.NoError(t, Restore((*methodByNameType).Exported))
+		assert.Equal(t, 3, (&methodByNameType{n: 1}).Exported(2))
+	})
+
+	t.Run("original", func(t *testing.T) {
+		require.NoError(t, MethodByName(pointerType, "Exported", (*myMethodByNameType).Exported))
+		t.Cleanup(func() { RestoreMethodByName(pointerType, "Exported") })
+
+		original := Original((*methodByNameType).Exported)
+		require.NotNil(t, original)
+		assert.Equal(t, 3, original(&methodByNameType{n: 1}, 2))
+
+		// The method can be redefined again through the method
+		// expression.
+		require.NoError(t, Method((*methodByNameType).Exported, (*myMethodByNameType).Exported))
+		assert.Equal(t, -2, (&methodByNameType{n: 1}).Exported(2))
+	})
+
+	t.Run("value receiver", func(t *testing.T) {
+		for _, typ := range []reflect.Type{valueType, pointerType} {
+			require.NoError(t, MethodByName(typ, "value", myMethodByNameType.value))
+			assert.Equal(t, -1, methodByNameType{n: 5}.value())
+			assert.Equal(t, -1, (&methodByNameType{n: 5}).value())
+
+			require.NoError(t, RestoreMethodByName(typ, "value"))
+			assert.Equal(t, 5, methodByNameType{n: 5}.value())
+		}
+	})
+
+	t.Run("pointer receiver", func(t *testing.T) {
+		err := MethodByName(valueType, "pointer", (*myMethodByNameType).pointer)
+		assert.ErrorContains(t, err, "pointer receiver")
+
+		// The method table and the symbol agree.
+		m, err := findMethod(pointerType, "pointer")
+		require.NoError(t, err)
+		entry, ok := funcByName("github.com/pboyd/redefine.(*methodByNameType).pointer")
+		assert.True(t, ok)
+		assert.Equal(t, m.entry, entry)
+
+		require.NoError(t, MethodByName(pointerType, "pointer", (*myMethodByNameType).pointer))
+		assert.Equal(t, -2, (&methodByNameType{n: 5}).pointer())
+
+		require.NoError(t, RestoreMethodByName(pointerType, "pointer"))
+		assert.Equal(t, 10, (&methodByNameType{n: 5}).pointer())
+	})
+
+	t.Run("signature mismatch", func(t *testing.T) {
+		err := MethodByName(pointerType, "Exported", func(*myMethodByNameType, int) string { return "" })
+		assert.ErrorContains(t, err, "function signatures do not match")
+
+		err = MethodByName(pointerType, "pointer", func(*[64]byte) int { return 0 })
+		assert.ErrorContains(t, err, "function signatures do not match")
+	})
+
+	t.Run("no method", func(t *testing.T) {
+		assert.Error(t, MethodByName(pointerType, "missing", (*myMethodByNameType).pointer))
+		assert.Error(t, MethodByName(reflect.TypeFor[int](), "value", myMethodByNameType.value))
+		assert.Error(t, MethodByName(nil, "value", myMethodByNameType.value))
+	})
+}
+
+func TestSymbolPrefix(t *testing.T) {
+	assert.Equal(t, "github.com/pboyd/redefine", symbolPrefix("github.com/pboyd/redefine"))
+	assert.Equal(t, "gopkg.in/yaml%2ev3", symbolPrefix("gopkg.in/yaml.v3"))
+}
@@ -0,0 +1,213 @@
+package redefine
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// MethodSet redefines the methods of T with the methods of the same name on F,
+// a fake version of T. It's Method for every method of F at once. For
+// example:
+//
+//	type fakeResolver net.Resolver
+//
+//	func (*fakeResolver) LookupHost(context.Context, string) ([]string, error) {
+//		return []string{"127.0.0.1"}, nil
+//	}
+//
+//	func (*fakeResolver) LookupAddr(context.Context, string) ([]string, error) {
+//		return []string{"localhost"}, nil
+//	}
+//
+//	restore, err := redefine.MethodSet[net.Resolver, fakeResolver]()
+//
+// T and F must have the same memory layout. Every method declared on F must
+// match a method of T by name, with a compatible signature and the same kind
+// of receiver. Methods of T that F doesn't have aren't changed, and methods F
+// gets from embedded fields are ignored. Unexported methods of F are only
+// available if the program uses them somewhere, otherwise the linker removes
+// them.
+//
+// Either every method is redefined or none are. If any method of F doesn't
+// match, the error is a *MethodSetError. The returned function puts every
+// method back the way it was, so one that was already redefined keeps that
+// redefinition. Wrappers the compiler wrote for the methods are handled the
+// same way as in Method, including the Unredirected option.
+func MethodSet[T, F any](opts ...Option) (func() error, error) {
+	o := makeOptions(opts)
+	target, fake := reflect.TypeFor[T](), reflect.TypeFor[F]()
+	if o.unsafeReceiver {
+		if target.Size() != fake.Size() {
+			return nil, fmt.Errorf("%v is %d bytes, %v is %d bytes", target, target.Size(), fake, fake.Size())
+		}
+	} else if err := compareLayouts(target, fake); err != nil {
+		return nil, fmt.Errorf("%v and %v have different layouts: %w", target, fake, err)
+	}
+
+	pairs, err := matchMethods(target, fake, o.unsafeReceiver)
+	if err != nil {
+		return nil, err
+	}
+
+	// Held for the whole set, so no other redefinition sees some of the
+	// methods redefined.
+	mu.Lock()
+	defer mu.Unlock()
+
+	var undos []func() error
+	for _, p := range pairs {
+		// A method that was redefined before goes back to that, not to
+		// the original.
+		undos = append(undos, saveLocked(p.target.entry))
+		err := unsafeFuncLocked(funcAt(p.target.entry), funcAt(p.fake.entry), false, o)
+		if err == nil {
+			err = redirectWrappers(p.target.entry, p.fake.entry, o)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", p.target.name, err)
+			if rerr := undoAllLocked(undos); rerr != nil {
+				err = errors.Join(err, fmt.Errorf("unable to restore the other methods: %w", rerr))
+			}
+			return nil, err
+		}
+	}
+
+	restore := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return undoAllLocked(undos)
+	}
+	return restore, nil
+}
+
+// MethodSetError lists the methods of a fake type that can't replace methods
+// of the target type.
+type MethodSetError struct {
+	Target, Fake reflect.Type
+
+	// Missing are the methods of Fake that Target doesn't have.
+	Missing []string
+
+	// Mismatched maps the name of every other method that can't be used to
+	// the reason.
+	Mismatched map[string]error
+}
+
+func (e *MethodSetError) Error() string {
+	var problems []string
+	if len(e.Missing) > 0 {
+		problems = append(problems, fmt.Sprintf("%v has no method %s", e.Target, strings.Join(e.Missing, ", ")))
+	}
+	for _, name := range slices.Sorted(maps.Keys(e.Mismatched)) {
+		msg := strings.ReplaceAll(e.Mismatched[name].Error(), "\n", ", ")
+		problems = append(problems, fmt.Sprintf("%s: %s", name, msg))
+	}
+
+	return fmt.Sprintf("%v can't replace %v: %s", e.Fake, e.Target, strings.Join(problems, "; "))
+}
+
+type methodPair struct {
+	target, fake method
+}
+
+// matchMethods pairs the methods declared on fake with the methods of target.
+func matchMethods(target, fake reflect.Type, unsafeReceiver bool) ([]methodPair, error) {
+	setErr := &MethodSetError{
+		Target:     target,
+		Fake:       fake,
+		Mismatched: map[string]error{},
+	}
+
+	var pairs []methodPair
+	for _, fm := range declaredMethods(fake) {
+		tm, err := findMethod(reflect.PointerTo(target), fm.name)
+		if err != nil {
+			setErr.Missing = append(setErr.Missing, fm.name)
+			continue
+		}
+		if fm.entry == 0 {
+			setErr.Mismatched[fm.name] = errors.New("removed by the linker because it isn't used")
+			continue
+		}
+
+		var diff *funcDifferences
+		if tm.typ != nil && fm.typ != nil {
+			diff = diffFuncTypes(tm.typ, fm.typ)
+		} else {
+			diff = diffReceivers(tm.recv, reflect.FuncOf([]reflect.Type{fm.recv}, nil, false))
+		}
+		diff.ignoreEquivalentReceiver(unsafeReceiver)
+		if err := diff.Error(); err != nil {
+			setErr.Mismatched[fm.name] = err
+			continue
+		}
+
+		pairs = append(pairs, methodPair{target: tm, fake: fm})
+	}
+
+	if len(setErr.Missing) > 0 || len(setErr.Mismatched) > 0 {
+		return nil, setErr
+	}
+	return pairs, nil
+}
+
+// declaredMethods returns the methods declared on t, with either receiver.
+// Wrappers the compiler generated are left out.
+func declaredMethods(t reflect.Type) []method {
+	var methods []method
+	seen := map[string]bool{}
+
+	for _, typ := range []reflect.Type{t, reflect.PointerTo(t)} {
+		for _, m := range tableMethods(typ) {
+			if seen[m.name] {
+				continue
+			}
+			if m.entry != 0 && isAutogenerated(m.entry) {
+				continue
+			}
+			if m.entry == 0 && isPromoted(t, m.name) {
+				continue
+			}
+
+			seen[m.name] = true
+			methods = append(methods, m)
+		}
+	}
+
+	return methods
+}
+
+// isAutogenerated reports whether the function at entry was generated by the
+// compiler, like the wrapper for a promoted method.
+func isAutogenerated(entry uintptr) bool {
+	info := findfunc(entry)
+	return info._func != nil && funcFile(info) == "<autogenerated>"
+}
+
+// isPromoted reports whether name is a method of an embedded field of t.
+func isPromoted(t reflect.Type, name string) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.Anonymous {
+			continue
+		}
+		for _, typ := range []reflect.Type{f.Type, reflect.PointerTo(f.Type)} {
+			for _, m := range tableMethods(typ) {
+				if m.name == name {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
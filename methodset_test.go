@@ -0,0 +1,203 @@
+package redefine
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type methodSetTarget struct{ a, b int }
+
+//go:noinline
+func (t *methodSetTarget) Sum() int {
+	return t.a + t.b
+}
+
+//go:noinline
+func (t methodSetTarget) Product() int {
+	return t.a * t.b
+}
+
+//go:noinline
+func (t *methodSetTarget) Untouched() int {
+	return t.a
+}
+
+type methodSetFake methodSetTarget
+
+func (f *methodSetFake) Sum() int {
+	return 100 + f.a
+}
+
+func (f methodSetFake) Product() int {
+	return 200 + f.b
+}
+
+type methodSetOtherFake methodSetTarget
+
+func (f *methodSetOtherFake) Sum() int {
+	return 300 + f.a
+}
+
+func (f methodSetOtherFake) Product() int {
+	return 400 + f.b
+}
+
+type methodSetBadFake methodSetTarget
+
+func (f *methodSetBadFake) Sum() string {
+	return ""
+}
+
+func (f *methodSetBadFake) Product() int {
+	return 0
+}
+
+func (f *methodSetBadFake) Difference() int {
+	return 0
+}
+
+type methodSetSmallFake struct{ a int }
+
+func (f *methodSetSmallFake) Sum() int {
+	return 0
+}
+
+func TestMethodSet(t *testing.T) {
+	target := &methodSetTarget{a: 2, b: 3}
+
+	restore, err := MethodSet[methodSetTarget, methodSetFake]()
+	require.NoError(t, err)
+	t.Cleanup(func() { restore() })
+
+	assert.Equal(t, 102, target.Sum())
+	assert.Equal(t, 203, target.Product())
+	assert.Equal(t, 203, (*target).Product())
+	assert.Equal(t, 2, target.Untouched())
+
+	require.NoError(t, restore())
+	assert.Equal(t, 5, target.Sum())
+	assert.Equal(t, 6, target.Product())
+
+	// It's safe to call again.
+	assert.NoError(t, restore())
+}
+
+func TestMethodSet_Redefined(t *testing.T) {
+	target := &methodSetTarget{a: 2, b: 3}
+
+	require.NoError(t, Method((*methodSetTarget).Sum, (*methodSetOtherFake).Sum))
+	t.Cleanup(func() { Restore((*methodSetTarget).Sum) })
+	require.NoError(t, Method(methodSetTarget.Product, methodSetOtherFake.Product))
+	t.Cleanup(func() { Restore(methodSetTarget.Product) })
+
+	restore, err := MethodSet[methodSetTarget, methodSetFake]()
+	require.NoError(t, err)
+	t.Cleanup(func() { restore() })
+
+	assert.Equal(t, 102, target.Sum())
+	assert.Equal(t, 203, target.Product())
+	assert.NoError(t, Verify())
+
+	// The methods go back to what Method redefined them with.
+	require.NoError(t, restore())
+	assert.Equal(t, 302, target.Sum())
+	assert.Equal(t, 403, target.Product())
+	assert.Equal(t, 403, (*target).Product())
+	assert.NoError(t, Verify())
+
+	require.NoError(t, Restore((*methodSetTarget).Sum))
+	require.NoError(t, Restore(methodSetTarget.Product))
+	assert.Equal(t, 5, target.Sum())
+	assert.Equal(t, 6, target.Product())
+
+	// Restoring again after that leaves them alone.
+	assert.NoError(t, restore())
+	assert.Equal(t, 5, target.Sum())
+}
+
+func TestMethodSet_Original(t *testing.T) {
+	target := &methodSetTarget{a: 2, b: 3}
+
+	restore, err := MethodSet[methodSetTarget, methodSetFake]()
+	require.NoError(t, err)
+	t.Cleanup(func() { restore() })
+
+	sum := Original((*methodSetTarget).Sum)
+	require.NotNil(t, sum)
+	assert.Equal(t, 5, sum(target))
+
+	product := Original(methodSetTarget.Product)
+	require.NotNil(t, product)
+	assert.Equal(t, 6, product(*target))
+}
+
+func TestMethodSet_Mismatch(t *testing.T) {
+	target := &methodSetTarget{a: 2, b: 3}
+
+	_, err := MethodSet[methodSetTarget, methodSetBadFake]()
+	var setErr *MethodSetError
+	require.ErrorAs(t, err, &setErr)
+	assert.Equal(t, []string{"Difference"}, setErr.Missing)
+	assert.Contains(t, setErr.Mismatched, "Sum")
+	assert.Contains(t, setErr.Mismatched, "Product")
+	assert.ErrorContains(t, err, "Difference")
+
+	// Nothing was redefined.
+	assert.Equal(t, 5, target.Sum())
+	assert.Equal(t, 6, target.Product())
+
+	_, err = MethodSet[methodSetTarget, methodSetSmallFake]()
+	assert.ErrorContains(t, err, "different layouts")
+	assert.Equal(t, 5, target.Sum())
+}
+
+func TestMethodSet_PartialFailure(t *testing.T) {
+	target := &methodSetTarget{a: 2, b: 3}
+
+	// Sum was redefined, and then something else wrote over it, so
+	// MethodSet fails on it after Product is done.
+	require.NoError(t, Method((*methodSetTarget).Sum, (*methodSetFake).Sum))
+	code, err := funcSlice((*methodSetTarget).Sum)
+	require.NoError(t, err)
+	saved := bytes.Clone(code)
+	write := func(fn func([]byte)) {
+		require.NoError(t, mprotect(code, mprotectRWX))
+		defer mprotect(code, mprotectRX)
+		fn(code)
+		cacheflush(code)
+	}
+	write(func(code []byte) {
+		require.NoError(t, insertJump(code[:minJumpSize], reflect.ValueOf(testCloneFuncWithData).Pointer()))
+	})
+	t.Cleanup(func() {
+		write(func(code []byte) { copy(code, saved) })
+		Restore((*methodSetTarget).Sum)
+	})
+
+	_, err = MethodSet[methodSetTarget, methodSetFake]()
+	assert.ErrorIs(t, err, ErrTampered)
+	assert.ErrorContains(t, err, "Sum")
+
+	// Product was put back.
+	assert.Equal(t, 6, target.Product())
+}
+
+func TestMethodSet_Wrappers(t *testing.T) {
+	target := asSummer(&wrapperTarget{1, 1, 1})
+
+	var unredirected []string
+	restore, err := MethodSet[wrapperTarget, wrapperFake](Unredirected(&unredirected))
+	require.NoError(t, err)
+	t.Cleanup(func() { restore() })
+
+	// The pointer wrapper inlined Sum, so it had to be redirected too.
+	assert.Equal(t, -1, target.Sum())
+	assert.Contains(t, unredirected, "github.com/pboyd/redefine.(*wrapperOuter).Sum")
+
+	require.NoError(t, restore())
+	assert.Equal(t, 15, target.Sum())
+}
@@ -0,0 +1,67 @@
+//go:build go1.27
+
+package redefine
+
+import "unsafe"
+
+// moduledata records information about the layout of the executable
+// image. It is written by the linker. Any changes here must be
+// matched changes to the code in cmd/link/internal/ld/symtab.go:symtab.
+// moduledata is stored in statically allocated non-pointer memory;
+// none of the pointers here are visible to the garbage collector.
+//
+// This is the layout from Go 1.27, which replaced typelinks and itablinks
+// with offsets into the types section. Later versions are assumed to match
+// until they're known not to.
+type moduledata struct {
+	pcHeader     *pcHeader
+	funcnametab  []byte
+	cutab        []uint32
+	filetab      []byte
+	pctab        []byte
+	pclntable    []byte
+	ftab         []functab
+	findfunctab  uintptr
+	minpc, maxpc uintptr
+
+	text, etext                uintptr
+	noptrdata, enoptrdata      uintptr
+	data, edata                uintptr
+	bss, ebss                  uintptr
+	noptrbss, enoptrbss        uintptr
+	covctrs, ecovctrs          uintptr
+	end, gcdata, gcbss         uintptr
+	types, typedesclen, etypes uintptr
+	itaboffset, itabsize       uintptr
+	rodata                     uintptr
+	gofunc                     uintptr // go.func.*
+	epclntab                   uintptr
+
+	// The fields below here change more often than the ones above, so
+	// modules checks them before following next.
+
+	textsectmap []textsect
+
+	ptab []ptabEntry
+
+	pluginpath string
+	pkghashes  []modulehash
+
+	inittasks []unsafe.Pointer
+
+	modulename   string
+	modulehashes []modulehash
+
+	hasmain uint8 // 1 if module contains the main function, 0 otherwise
+	bad     bool  // module failed to load and should be ignored
+
+	gcdatamask, gcbssmask bitvector
+
+	typemap map[unsafe.Pointer]unsafe.Pointer
+
+	next *moduledata
+}
+
+// funcIDWrapper is the funcID of code the compiler generates, such as method
+// wrappers, from internal/abi in Go 1.27.
+const funcIDWrapper = 23
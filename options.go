@@ -0,0 +1,116 @@
+package redefine
+
+// Option changes how a function is redefined or copied. Options that don't
+// apply to a call are ignored.
+type Option func(*options)
+
+type options struct {
+	recursive    bool
+	isolated     bool
+	foreignLayer bool
+
+	unsafeReceiver bool
+
+	abi0Adapter bool
+
+	unredirected *[]string
+}
+
+func makeOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Recursive makes calls that the original function makes to itself go to the
+// copy instead of the redefined function. Without it, only the outermost call
+// of a recursive function runs the original code.
+func Recursive() Option {
+	return func(o *options) {
+		o.recursive = true
+	}
+}
+
+// Isolated makes the copy call the original version of every redefined
+// function it reaches, directly or through other functions, so the whole call
+// tree behaves as if nothing had been redefined. Isolated implies Recursive.
+//
+// Functions between the copy and the redefined functions are copied too,
+// which can be slow for functions with large call trees. The copy reflects
+// the redefinitions at the time it was made. Calling Original again after
+// another function is redefined or restored makes a new copy.
+//
+// If the copies can't be made, Original falls back to a copy without this
+// option, see Original. Clone returns the error.
+func Isolated() Option {
+	return func(o *options) {
+		o.recursive = true
+		o.isolated = true
+	}
+}
+
+// ForeignLayer lets Func and Method redefine a function that another patching
+// library, like bouk/monkey or gomonkey, has already replaced. The other
+// library's replacement is treated as the original: Original calls it, and
+// Restore puts its jump back. Restore this package's redefinition before the
+// other library restores its own, or Restore will return a TamperError.
+//
+// Without ForeignLayer, Func and Method return a ForeignPatchError for those
+// functions.
+func ForeignLayer() Option {
+	return func(o *options) {
+		o.foreignLayer = true
+	}
+}
+
+// UnsafeReceiver lets Method, MethodByName and MethodSet use a receiver that
+// only has the same kind and size as the original, without comparing the
+// fields. Code compiled for one layout that runs on another corrupts memory,
+// and the garbage collector can free memory that's still in use if pointers
+// are in different places. Only use it when the fake can't copy the layout,
+// for example because a field's type is unexported in another package.
+func UnsafeReceiver() Option {
+	return func(o *options) {
+		o.unsafeReceiver = true
+	}
+}
+
+// ABI0Adapter makes Func redefine the assembly of a function written in
+// assembly along with its wrapper, so that Go code that calls the assembly
+// directly reaches newFn too, through an adapter. See Func. It's needed to
+// redefine assembly that has no wrapper at all.
+//
+// The runtime can't walk the stack through the adapter. If newFn grows the
+// stack, panics, or is stopped for a garbage collection while it runs from a
+// direct call, the program crashes with "unknown caller pc". Only use it for
+// small functions that don't allocate or call anything else.
+//
+// Adapters are only available on amd64. Elsewhere the option is ignored.
+func ABI0Adapter() Option {
+	return func(o *options) {
+		o.abi0Adapter = true
+	}
+}
+
+// Unredirected appends the names of the code that still runs the original
+// function after Func, Method or MethodByName redefines it to *names. That's
+// the wrappers that have their own copy of a method, as described in Method,
+// and the assembly of a function written in assembly without the ABI0Adapter
+// option, as described in Func. Nothing is appended if every caller reaches the new function.
+//
+// The function is redefined either way. The option only tells which calls
+// still miss it.
+func Unredirected(names *[]string) Option {
+	return func(o *options) {
+		o.unredirected = names
+	}
+}
+
+// reportUnredirected adds names to the list for the Unredirected option.
+func (o options) reportUnredirected(names ...string) {
+	if o.unredirected != nil {
+		*o.unredirected = append(*o.unredirected, names...)
+	}
+}
@@ -0,0 +1,558 @@
+package redefine
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"unsafe"
+)
+
+// Package redefines functions in the package at path with fakes, by name. The
+// names are the keys of fakeFuncs, as they appear in the package, and the
+// values are the new functions. For example:
+//
+//	restore, err := redefine.Package("os", map[string]any{
+//		"Getwd":    func() (string, error) { return "/fake", nil },
+//		"Hostname": func() (string, error) { return "fake", nil },
+//	})
+//
+// Methods can be named too, like "(*File).Close". Unexported functions can be
+// used as long as the linker kept them.
+//
+// The linker doesn't record the signatures of functions, so only the size of
+// the arguments and results is checked, along with the offset and size of
+// each argument that tracebacks print, and where the arguments hold pointers,
+// from the maps the garbage collector uses. The maps only have the pointers a
+// function keeps, so an unused pointer argument can be replaced by an integer
+// of the same size, and the results aren't compared beyond their size. The
+// fakes have the same requirements as newFn in Func.
+//
+// Either every function is redefined or none are, all under the lock that
+// every redefinition and restore takes, so no other one sees part of the
+// package changed. If any name can't be used, the error is a *PackageError.
+// The returned function puts every function back the way it was, so one that
+// was already redefined keeps that redefinition.
+func Package(path string, fakeFuncs map[string]any, opts ...Option) (func() error, error) {
+	pairs, err := matchFuncs(path, fakeFuncs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Held for the whole package, so no other redefinition sees some of
+	// the functions redefined.
+	mu.Lock()
+	defer mu.Unlock()
+
+	o := makeOptions(opts)
+	var undos []func() error
+	for _, p := range pairs {
+		// A function that was redefined before goes back to that, not
+		// to the original.
+		undos = append(undos, saveLocked(p.target.Entry))
+		err := unsafeFuncLocked(funcAt(p.target.Entry), p.fake, false, o)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("%s: %w", p.target.Name, err), undoAllLocked(undos))
+		}
+	}
+
+	restore := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return undoAllLocked(undos)
+	}
+	return restore, nil
+}
+
+// PackageError lists the fakes passed to Package that can't replace functions
+// in the package.
+type PackageError struct {
+	Path string
+
+	// Missing are the names the package doesn't have.
+	Missing []string
+
+	// Mismatched maps every other name that can't be used to the reason.
+	Mismatched map[string]error
+}
+
+func (e *PackageError) Error() string {
+	var problems []string
+	if len(e.Missing) > 0 {
+		problems = append(problems, fmt.Sprintf("no function %s", strings.Join(e.Missing, ", ")))
+	}
+	for _, name := range slices.Sorted(maps.Keys(e.Mismatched)) {
+		problems = append(problems, fmt.Sprintf("%s: %v", name, e.Mismatched[name]))
+	}
+
+	return fmt.Sprintf("package %s: %s", e.Path, strings.Join(problems, "; "))
+}
+
+type funcPair struct {
+	target Function
+	fake   any
+}
+
+// matchFuncs finds the function in the package at path for every fake, in
+// order of name.
+func matchFuncs(path string, fakeFuncs map[string]any) ([]funcPair, error) {
+	pkgErr := &PackageError{
+		Path:       path,
+		Mismatched: map[string]error{},
+	}
+
+	funcs := map[string]Function{}
+	for f := range Functions(symbolPrefix(path)) {
+		funcs[f.Name] = f
+	}
+
+	var pairs []funcPair
+	for _, name := range slices.Sorted(maps.Keys(fakeFuncs)) {
+		fake := fakeFuncs[name]
+
+		target, ok := funcs[symbolPrefix(path)+"."+name]
+		if !ok {
+			pkgErr.Missing = append(pkgErr.Missing, name)
+			continue
+		}
+
+		if err := checkFake(target, fake); err != nil {
+			pkgErr.Mismatched[name] = err
+			continue
+		}
+
+		pairs = append(pairs, funcPair{target: target, fake: fake})
+	}
+
+	if len(pkgErr.Missing) > 0 || len(pkgErr.Mismatched) > 0 {
+		return nil, pkgErr
+	}
+	return pairs, nil
+}
+
+// checkFake returns an error if fake can't replace target. Without the
+// signature of target, the comparison is limited to what the compiler left for
+// tracebacks and the garbage collector: the size of the arguments and results,
+// how far into the arguments there are pointers, the offset and size of each
+// argument, and which words target keeps pointers in.
+func checkFake(target Function, fake any) error {
+	fakeInfo, err := FuncInfo(fake)
+	if err != nil {
+		return err
+	}
+	if fakeInfo.Entry == target.Entry {
+		return errors.New("a function can't replace itself")
+	}
+
+	// Assembly functions may not say.
+	if target.Args != argsSizeUnknown && fakeInfo.Args != argsSizeUnknown && target.Args != fakeInfo.Args {
+		return fmt.Errorf("arguments and results take %d bytes, the fake's take %d", target.Args, fakeInfo.Args)
+	}
+
+	targetFunc, fakeFunc := findfunc(target.Entry), findfunc(fakeInfo.Entry)
+	wantMap, ok := argPointerMap(targetFunc)
+	if !ok {
+		return nil
+	}
+	gotMap, ok := argPointerMap(fakeFunc)
+	if ok && wantMap.nbit != gotMap.nbit {
+		ptrSize := int32(unsafe.Sizeof(uintptr(0)))
+		return fmt.Errorf("the last pointer in the arguments ends at byte %d, in the fake's at byte %d", wantMap.nbit*ptrSize, gotMap.nbit*ptrSize)
+	}
+
+	want, ok := argInfo(targetFunc)
+	if !ok {
+		return nil
+	}
+	got, ok := argInfo(fakeFunc)
+	if !ok {
+		return nil
+	}
+	if !slices.Equal(want, got) {
+		return fmt.Errorf("the arguments are laid out as %s, the fake's as %s", formatArgInfo(want), formatArgInfo(got))
+	}
+
+	// The maps only have the pointers that are live, so target's are
+	// checked against the types of fake's arguments.
+	ptrs, known := argPointers(got, reflect.TypeOf(fake))
+	for word := range wantMap.nbit {
+		if wantMap.live(word) && known[word] && !ptrs[word] {
+			return fmt.Errorf("argument byte %d holds a pointer, but not in the fake", uintptr(word)*unsafe.Sizeof(uintptr(0)))
+		}
+	}
+	return nil
+}
+
+// Indexes into a function's funcdata, from internal/abi.
+const (
+	funcdataArgsPointerMaps = 0
+	funcdataArgInfo         = 5
+)
+
+// funcdata returns the function's funcdata at index i, or nil if it has none.
+func funcdata(info funcInfo, i uint8) unsafe.Pointer {
+	if info._func == nil || info.nfuncdata <= i {
+		return nil
+	}
+
+	// The funcdata offsets from gofunc follow the npcdata offsets.
+	tables := unsafe.Add(unsafe.Pointer(info._func), unsafe.Sizeof(_func{}))
+	off := *(*uint32)(unsafe.Add(tables, 4*(uintptr(info.npcdata)+uintptr(i))))
+	if off == ^uint32(0) {
+		return nil
+	}
+	return unsafe.Pointer(pointerAt(info.datap.gofunc + uintptr(off)))
+}
+
+// argPointerMaps holds the stack maps for a function's arguments, one for
+// each point where the garbage collector can stop it.
+type argPointerMaps struct {
+	n, nbit int32
+	bits    []byte
+}
+
+// live reports whether the word of the arguments holds a live pointer in any
+// of the maps.
+func (m argPointerMaps) live(word int32) bool {
+	stride := (m.nbit + 7) / 8
+	for i := range m.n {
+		if m.bits[i*stride+word/8]&(1<<(word%8)) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// argPointerMap returns the stack maps for the function's arguments. The
+// compiler makes the maps just large enough to hold the last pointer
+// argument, whether or not it's used, so nbit depends only on the types of
+// the arguments. The bits are set only where a pointer is live. ok is false
+// for functions without maps, which includes assembly.
+func argPointerMap(info funcInfo) (maps argPointerMaps, ok bool) {
+	if info.flag&funcFlagAsm != 0 {
+		return argPointerMaps{}, false
+	}
+	sm := (*stackmap)(funcdata(info, funcdataArgsPointerMaps))
+	if sm == nil {
+		return argPointerMaps{}, false
+	}
+
+	// The bitmaps follow the header.
+	size := int(sm.n * ((sm.nbit + 7) / 8))
+	bits := unsafe.Slice((*byte)(unsafe.Add(unsafe.Pointer(sm), unsafe.Sizeof(stackmap{}))), size)
+	return argPointerMaps{n: sm.n, nbit: sm.nbit, bits: bits}, true
+}
+
+// The special bytes in the argument info, from internal/abi.
+const (
+	traceArgsEndSeq         = 0xff
+	traceArgsStartAgg       = 0xfe
+	traceArgsEndAgg         = 0xfd
+	traceArgsDotdotdot      = 0xfc
+	traceArgsOffsetTooLarge = 0xfb
+
+	// traceArgsLimit and traceArgsMaxDepth limit how much of the
+	// arguments is described.
+	traceArgsLimit    = 10
+	traceArgsMaxDepth = 5
+)
+
+// argInfo returns the description of the function's arguments that traceback
+// prints them from, without the end marker. Each argument, and each field or
+// element of one that has them, is an offset byte and a size byte. Aggregates
+// are wrapped in traceArgsStartAgg and traceArgsEndAgg, and it stops after the
+// first few.
+func argInfo(info funcInfo) ([]byte, bool) {
+	p := funcdata(info, funcdataArgInfo)
+	if p == nil {
+		return nil, false
+	}
+
+	var data []byte
+	for i := uintptr(0); ; i++ {
+		b := *(*byte)(unsafe.Add(p, i))
+		switch b {
+		case traceArgsEndSeq:
+			return data, true
+		case traceArgsStartAgg, traceArgsEndAgg, traceArgsDotdotdot, traceArgsOffsetTooLarge:
+			data = append(data, b)
+		default:
+			i++
+			data = append(data, b, *(*byte)(unsafe.Add(p, i)))
+		}
+	}
+}
+
+// formatArgInfo formats argument info the way traceback would, with each
+// value as offset:size.
+func formatArgInfo(data []byte) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	sep := ""
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case traceArgsStartAgg:
+			b.WriteString(sep + "{")
+			sep = ""
+			continue
+		case traceArgsEndAgg:
+			b.WriteByte('}')
+		case traceArgsDotdotdot:
+			b.WriteString(sep + "...")
+		case traceArgsOffsetTooLarge:
+			b.WriteString(sep + "_")
+		default:
+			fmt.Fprintf(&b, "%s%d:%d", sep, data[i], data[i+1])
+			i++
+		}
+		sep = ", "
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// argPointers follows the arguments of the function type t through its
+// argument info, and returns the words that hold pointers. known has the
+// words the argument info covers.
+func argPointers(info []byte, t reflect.Type) (ptrs, known map[int32]bool) {
+	w := argWalker{info: info, ptrs: map[int32]bool{}, known: map[int32]bool{}}
+	for i := range t.NumIn() {
+		if !w.visit(t.In(i), 0) {
+			break
+		}
+	}
+	return w.ptrs, w.known
+}
+
+// argWalker visits types in the same order as the compiler when it writes
+// argument info.
+type argWalker struct {
+	info        []byte
+	i, n        int
+	ptrs, known map[int32]bool
+}
+
+// next returns the next byte of the argument info, or traceArgsEndSeq at the
+// end.
+func (w *argWalker) next() byte {
+	if w.i >= len(w.info) {
+		return traceArgsEndSeq
+	}
+	b := w.info[w.i]
+	w.i++
+	return b
+}
+
+// visit visits an argument, field or element of type t, and reports whether
+// to go on.
+func (w *argWalker) visit(t reflect.Type, depth int) bool {
+	switch t.Kind() {
+	case reflect.String:
+		return w.visitAgg(depth, func(depth int) bool {
+			return w.value(true) && w.value(false)
+		})
+	case reflect.Interface:
+		// The first word is a type or itab, which the garbage
+		// collector doesn't treat as a pointer.
+		return w.visitAgg(depth, func(depth int) bool {
+			return w.value(false) && w.value(true)
+		})
+	case reflect.Slice:
+		return w.visitAgg(depth, func(depth int) bool {
+			return w.value(true) && w.value(false) && w.value(false)
+		})
+	case reflect.Complex64, reflect.Complex128:
+		return w.visitAgg(depth, func(depth int) bool {
+			return w.value(false) && w.value(false)
+		})
+	case reflect.Array:
+		return w.visitAgg(depth, func(depth int) bool {
+			if t.Len() == 0 {
+				w.n++
+			}
+			for range t.Len() {
+				if !w.visit(t.Elem(), depth) {
+					break
+				}
+			}
+			return true
+		})
+	case reflect.Struct:
+		return w.visitAgg(depth, func(depth int) bool {
+			if t.NumField() == 0 {
+				w.n++
+			}
+			for i := range t.NumField() {
+				if !w.visit(t.Field(i).Type, depth) {
+					break
+				}
+			}
+			return true
+		})
+	case reflect.Pointer, reflect.UnsafePointer, reflect.Map, reflect.Chan, reflect.Func:
+		return w.value(true)
+	default:
+		return w.value(false)
+	}
+}
+
+// visitAgg visits an aggregate, with fn visiting what's in it.
+func (w *argWalker) visitAgg(depth int, fn func(depth int) bool) bool {
+	if w.n >= traceArgsLimit {
+		w.next()
+		return false
+	}
+	if w.next() != traceArgsStartAgg {
+		return false
+	}
+	depth++
+	if depth >= traceArgsMaxDepth {
+		w.next()
+		w.next()
+		w.n++
+		return true
+	}
+	fn(depth)
+	return w.next() == traceArgsEndAgg
+}
+
+// value visits a value that isn't an aggregate.
+func (w *argWalker) value(ptr bool) bool {
+	if w.n >= traceArgsLimit {
+		w.next()
+		return false
+	}
+	w.n++
+
+	off := w.next()
+	switch off {
+	case traceArgsOffsetTooLarge:
+		return true
+	case traceArgsEndSeq, traceArgsStartAgg, traceArgsEndAgg, traceArgsDotdotdot:
+		// It doesn't match the type.
+		w.i = len(w.info)
+		return false
+	}
+	w.next()
+
+	word := int32(uintptr(off) / unsafe.Sizeof(uintptr(0)))
+	w.known[word] = true
+	if ptr {
+		w.ptrs[word] = true
+	}
+	return true
+}
+
+// FuncByName redefines the function called name with newFn. The name is the
+// full name, as Functions reports it, such as "net/http.(*Client).Do". Like
+// Package, it can reach unexported functions, and the signatures are only
+// compared as far as Package describes.
+//
+// Use RestoreFuncByName to restore it.
+func FuncByName(name string, newFn any, opts ...Option) error {
+	entry, ok := funcByName(name)
+	if !ok {
+		return fmt.Errorf("no function %s", name)
+	}
+	target := makeFunction(findfunc(entry))
+	if err := checkFake(target, newFn); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return unsafeFunc(funcAt(target.Entry), newFn, false, makeOptions(opts))
+}
+
+// RestoreFuncByName reverses the effect of FuncByName.
+func RestoreFuncByName(name string) error {
+	entry, ok := funcByName(name)
+	if !ok {
+		return fmt.Errorf("no function %s", name)
+	}
+	return Restore(funcAt(entry))
+}
+
+// SwapByName moves from one set of redefinitions made by name to another.
+// prev maps the names of the functions that are redefined now to their new
+// versions, as they were passed to FuncByName, and next is the set to move to.
+// The functions only prev has are restored, then every function in next is
+// redefined, in order of name. next is checked the same way as FuncByName.
+//
+// It all happens under the lock that every redefinition and restore takes, so
+// no other one sees part of the change. If anything fails, the functions that
+// were changed are put back the way prev had them, and the error includes
+// anything that couldn't be put back. Calls running while the functions are
+// written may still see some of them changed and not others.
+func SwapByName(prev, next map[string]any, opts ...Option) error {
+	o := makeOptions(opts)
+
+	entries := map[string]uintptr{}
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(prev)) {
+		if entry, ok := funcByName(name); ok {
+			entries[name] = entry
+		} else {
+			errs = append(errs, fmt.Errorf("no function %s", name))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(next)) {
+		entry, ok := funcByName(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("no function %s", name))
+			continue
+		}
+		if err := checkFake(makeFunction(findfunc(entry)), next[name]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		entries[name] = entry
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var changed []string
+	fail := func(name string, err error) error {
+		errs := []error{fmt.Errorf("%s: %w", name, err)}
+		for _, name := range slices.Backward(changed) {
+			var err error
+			if fake, ok := prev[name]; ok {
+				err = unsafeFuncLocked(funcAt(entries[name]), fake, false, o)
+			} else {
+				err = restoreLocked(entries[name])
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to put back %s: %w", name, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(prev)) {
+		if _, ok := next[name]; ok {
+			continue
+		}
+		if err := restoreLocked(entries[name]); err != nil {
+			return fail(name, err)
+		}
+		changed = append(changed, name)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(next)) {
+		if err := unsafeFuncLocked(funcAt(entries[name]), next[name], false, o); err != nil {
+			return fail(name, err)
+		}
+		changed = append(changed, name)
+	}
+
+	return nil
+}
+
+// argsSizeUnknown is the argument size of functions that don't declare one,
+// from internal/abi.
+const argsSizeUnknown = -0x80000000
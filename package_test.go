@@ -0,0 +1,257 @@
+package redefine
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//go:noinline
+func packageTargetAdd(a, b int) int {
+	return a + b
+}
+
+//go:noinline
+func packageTargetGreet(name string) string {
+	return "hello " + name
+}
+
+func packageFakeAdd(a, b int) int {
+	return a * b
+}
+
+func packageFakeGreet(name string) string {
+	return "bye " + name
+}
+
+func packageFakeWrongSize(a, b, c int) int {
+	return 0
+}
+
+// packageFakeWrongType takes as many bytes as packageTargetAdd, but one of
+// them is a pointer. It doesn't use s, so the pointer is never live.
+func packageFakeWrongType(s string) int {
+	return 0
+}
+
+func TestPackage(t *testing.T) {
+	restore, err := Package("github.com/pboyd/redefine", map[string]any{
+		"packageTargetAdd":   packageFakeAdd,
+		"packageTargetGreet": packageFakeGreet,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { restore() })
+
+	assert.Equal(t, 6, packageTargetAdd(2, 3))
+	assert.Equal(t, "bye world", packageTargetGreet("world"))
+
+	require.NoError(t, restore())
+	assert.Equal(t, 5, packageTargetAdd(2, 3))
+	assert.Equal(t, "hello world", packageTargetGreet("world"))
+}
+
+func TestPackage_Redefined(t *testing.T) {
+	require.NoError(t, Func(packageTargetAdd, func(a, b int) int { return a - b }))
+	t.Cleanup(func() { Restore(packageTargetAdd) })
+
+	restore, err := Package("github.com/pboyd/redefine", map[string]any{
+		"packageTargetAdd":   packageFakeAdd,
+		"packageTargetGreet": packageFakeGreet,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { restore() })
+
+	assert.Equal(t, 6, packageTargetAdd(2, 3))
+	assert.Equal(t, "bye world", packageTargetGreet("world"))
+
+	// packageTargetAdd goes back to what Func redefined it with.
+	require.NoError(t, restore())
+	assert.Equal(t, -1, packageTargetAdd(2, 3))
+	assert.Equal(t, "hello world", packageTargetGreet("world"))
+	assert.NoError(t, Verify())
+
+	require.NoError(t, Restore(packageTargetAdd))
+	assert.Equal(t, 5, packageTargetAdd(2, 3))
+}
+
+func TestPackage_Original(t *testing.T) {
+	restore, err := Package("github.com/pboyd/redefine", map[string]any{
+		"packageTargetAdd": packageFakeAdd,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { restore() })
+
+	original := Original(packageTargetAdd)
+	require.NotNil(t, original)
+	assert.Equal(t, 5, original(2, 3))
+
+	// Func can redefine it again on top of Package.
+	require.NoError(t, Func(packageTargetAdd, func(a, b int) int { return a - b }))
+	assert.Equal(t, -1, packageTargetAdd(2, 3))
+}
+
+func TestPackage_Mismatch(t *testing.T) {
+	_, err := Package("github.com/pboyd/redefine", map[string]any{
+		"packageTargetAdd":   packageFakeWrongSize,
+		"packageTargetGreet": packageFakeGreet,
+		"noSuchFunction":     packageFakeAdd,
+		"packageFakeAdd":     42,
+	})
+	var pkgErr *PackageError
+	require.ErrorAs(t, err, &pkgErr)
+	assert.Equal(t, []string{"noSuchFunction"}, pkgErr.Missing)
+	assert.Contains(t, pkgErr.Mismatched, "packageTargetAdd")
+	assert.Contains(t, pkgErr.Mismatched, "packageFakeAdd")
+	assert.NotContains(t, pkgErr.Mismatched, "packageTargetGreet")
+
+	// Nothing was redefined.
+	assert.Equal(t, 5, packageTargetAdd(2, 3))
+	assert.Equal(t, "hello world", packageTargetGreet("world"))
+}
+
+func TestFuncByName(t *testing.T) {
+	name := "github.com/pboyd/redefine.packageTargetAdd"
+	require.NoError(t, FuncByName(name, packageFakeAdd))
+	t.Cleanup(func() { RestoreFuncByName(name) })
+
+	assert.Equal(t, 6, packageTargetAdd(2, 3))
+
+	require.NoError(t, RestoreFuncByName(name))
+	assert.Equal(t, 5, packageTargetAdd(2, 3))
+
+	assert.ErrorContains(t, FuncByName(name, packageFakeWrongSize), "arguments and results")
+	assert.ErrorContains(t, FuncByName("github.com/pboyd/redefine.noSuchFunction", packageFakeAdd), "no function")
+}
+
+func TestFuncByName_SameSize(t *testing.T) {
+	name := "github.com/pboyd/redefine.packageTargetAdd"
+	err := FuncByName(name, packageFakeWrongType)
+	assert.ErrorContains(t, err, "last pointer")
+	assert.Equal(t, 5, packageTargetAdd(2, 3))
+
+	// Likewise the other way around.
+	name = "github.com/pboyd/redefine.packageTargetGreet"
+	err = FuncByName(name, func(a, b int) string { return "" })
+	assert.ErrorContains(t, err, "last pointer")
+	assert.Equal(t, "hello world", packageTargetGreet("world"))
+}
+
+//go:noinline
+func packageTargetDeref(a, b *int) int {
+	return *a + *b
+}
+
+type packageMixed struct {
+	n int
+	p *int
+}
+
+//go:noinline
+func packageTargetMixed(s string, p *int, x any, m packageMixed, a [2]*int, f func()) int {
+	f()
+	return len(s) + *p + x.(int) + *m.p + *a[0] + *a[1]
+}
+
+func TestFuncByName_Layout(t *testing.T) {
+	name := "github.com/pboyd/redefine.packageTargetGreet"
+	err := FuncByName(name, func(p *byte, n int) string { return "" })
+	assert.ErrorContains(t, err, "laid out")
+	assert.Equal(t, "hello world", packageTargetGreet("world"))
+
+	// The same size, with the last pointer in the same place, but a
+	// pointer packageTargetDeref uses is an int in the fake.
+	name = "github.com/pboyd/redefine.packageTargetDeref"
+	err = FuncByName(name, func(a int, b *int) int { return 0 })
+	assert.ErrorContains(t, err, "argument byte 0 holds a pointer")
+	a, b := 1, 2
+	assert.Equal(t, 3, packageTargetDeref(&a, &b))
+
+	require.NoError(t, FuncByName(name, func(a, b *int) int { return 0 }))
+	assert.Equal(t, 0, packageTargetDeref(&a, &b))
+	require.NoError(t, RestoreFuncByName(name))
+}
+
+func TestArgPointers(t *testing.T) {
+	target, err := FuncInfo(packageTargetMixed)
+	require.NoError(t, err)
+	info := findfunc(target.Entry)
+
+	data, ok := argInfo(info)
+	require.True(t, ok)
+	maps, ok := argPointerMap(info)
+	require.True(t, ok)
+
+	// Every argument is used, so the pointers the types say are there
+	// are the ones that are live.
+	ptrs, known := argPointers(data, reflect.TypeOf(packageTargetMixed))
+	for word := range maps.nbit {
+		assert.True(t, known[word], "word %d", word)
+		assert.Equal(t, maps.live(word), ptrs[word], "word %d", word)
+	}
+}
+
+func TestPackage_PartialFailure(t *testing.T) {
+	// packageTargetGreet was redefined, and then something else wrote over
+	// it, so Package fails on it after packageTargetAdd is done.
+	require.NoError(t, Func(packageTargetGreet, packageFakeGreet))
+	code, err := funcSlice(packageTargetGreet)
+	require.NoError(t, err)
+	saved := bytes.Clone(code)
+	write := func(fn func([]byte)) {
+		require.NoError(t, mprotect(code, mprotectRWX))
+		defer mprotect(code, mprotectRX)
+		fn(code)
+		cacheflush(code)
+	}
+	write(func(code []byte) {
+		require.NoError(t, insertJump(code[:minJumpSize], reflect.ValueOf(testCloneFuncWithData).Pointer()))
+	})
+	t.Cleanup(func() {
+		write(func(code []byte) { copy(code, saved) })
+		Restore(packageTargetGreet)
+	})
+
+	_, err = Package("github.com/pboyd/redefine", map[string]any{
+		"packageTargetAdd":   packageFakeAdd,
+		"packageTargetGreet": packageFakeGreet,
+	})
+	assert.ErrorIs(t, err, ErrTampered)
+	assert.ErrorContains(t, err, "packageTargetGreet")
+
+	// packageTargetAdd was put back.
+	assert.Equal(t, 5, packageTargetAdd(2, 3))
+}
+
+func TestSwapByName(t *testing.T) {
+	add := "github.com/pboyd/redefine.packageTargetAdd"
+	greet := "github.com/pboyd/redefine.packageTargetGreet"
+	t.Cleanup(func() {
+		RestoreFuncByName(add)
+		RestoreFuncByName(greet)
+	})
+
+	prev := map[string]any{add: packageFakeAdd}
+	require.NoError(t, FuncByName(add, packageFakeAdd))
+
+	// The arguments of math.archFloor can't be adapted, so nothing changes.
+	err := SwapByName(prev, map[string]any{
+		greet:            packageFakeGreet,
+		"math.archFloor": func([2]uint32) float64 { return 0 },
+	})
+	assert.ErrorIs(t, err, ErrABI0)
+	assert.Equal(t, 6, packageTargetAdd(2, 3))
+	assert.Equal(t, "hello world", packageTargetGreet("world"))
+
+	next := map[string]any{greet: packageFakeGreet}
+	require.NoError(t, SwapByName(prev, next))
+	assert.Equal(t, 5, packageTargetAdd(2, 3))
+	assert.Equal(t, "bye world", packageTargetGreet("world"))
+
+	require.NoError(t, SwapByName(next, nil))
+	assert.Equal(t, "hello world", packageTargetGreet("world"))
+
+	assert.ErrorContains(t, SwapByName(nil, map[string]any{add: packageFakeWrongSize}), "arguments and results")
+}
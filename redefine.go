@@ -1,8 +1,11 @@
 package redefine
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"reflect"
+	"slices"
 	"sync"
 	"unsafe"
 )
@@ -11,6 +14,13 @@ var mu sync.RWMutex
 
 var redefined = map[uintptr]any{}
 
+// redefinedGen changes every time a function is redefined or restored.
+var redefinedGen uint64
+
+// ErrNoOriginal means a function was redefined without a copy of the
+// original, so Clone can't make one. See Func.
+var ErrNoOriginal = errors.New("no copy of the original function")
+
 // Func redefines fn with newFn. An error will be returned if fn or newFn are
 // not function pointers.
 //
@@ -27,7 +37,30 @@ var redefined = map[uintptr]any{}
 //   - Generic functions cannot be redefined
 //   - newFn cannot be a closure (anonymous functions are fine, but it will crash
 //     if you attempt to use data from the stack)
-func Func[T any](fn, newFn T) error {
+//
+// The copy of fn that Original returns has to be close enough to fn to reach
+// the same code and data. If no memory can be reserved that close, which can
+// happen in position-independent builds, fn is redefined without a copy. Then
+// Original returns nil, and Clone returns an error that wraps ErrNoOriginal.
+//
+// If another patching library has already replaced fn, Func returns a
+// ForeignPatchError unless the ForeignLayer option is given.
+//
+// If fn is written in assembly, Go code may call the assembly directly instead
+// of the wrapper that fn points to. Only the wrapper is redefined, the same as
+// for other functions. The direct calls still run the assembly, and the
+// Unredirected option reports it. Assembly without a wrapper can't be
+// redefined that way, and Func returns an error that wraps ErrABI0.
+//
+// With the ABI0Adapter option, the assembly is redefined too, and the direct
+// calls reach newFn through an adapter that converts between the calling
+// conventions. The adapter only handles arguments and results that fit in
+// registers. If the direct calls can't be redefined, Func returns an error that
+// wraps ErrABI0 and changes nothing. The runtime can't see the adapter in stack
+// traces, so a panic, a stack that has to grow, or a garbage collection while
+// newFn runs from a direct call crashes the program. Adapters are only
+// available on amd64.
+func Func[T any](fn, newFn T, opts ...Option) error {
 	fnv := reflect.ValueOf(fn)
 	if fnv.Kind() != reflect.Func || fnv.IsNil() {
 		return fmt.Errorf("not a function, kind: %v", fnv.Kind())
@@ -37,7 +70,7 @@ func Func[T any](fn, newFn T) error {
 		return fmt.Errorf("not a function, kind: %v", newFnv.Kind())
 	}
 
-	return unsafeFunc(fn, newFn)
+	return unsafeFunc(fn, newFn, false, makeOptions(opts))
 }
 
 // Method redefines a method of an object. The same caveats from Func apply
@@ -48,8 +81,20 @@ func Func[T any](fn, newFn T) error {
 //
 // Any other type for the instance of newFn will likely lead to very
 // troublesome bugs because the code compiled for newFn will be operating on
-// the memory for the instance of fn.
-func Method[T1, T2 any](fn T1, newFn T2) error {
+// the memory for the instance of fn. So the receivers are compared field by
+// field, including the types their fields point to, and Method returns an
+// error that names the first field that differs. The UnsafeReceiver option
+// skips that check.
+//
+// When fn has a value receiver, the compiler also writes a wrapper for calls
+// made through a pointer or an interface, and wrappers for types that embed
+// fn's type. Wrappers that call fn are covered already. If a wrapper has its
+// own copy of fn's code instead, the pointer wrapper is sent to newFn's pointer
+// wrapper, which exists as long as newFn is a method too. The other wrappers
+// keep running the original, and the Unredirected option lists them.
+//
+// Options are the same as for Func.
+func Method[T1, T2 any](fn T1, newFn T2, opts ...Option) error {
 	fnv := reflect.ValueOf(fn)
 	if fnv.Kind() != reflect.Func {
 		return fmt.Errorf("not a function, kind: %v", fnv.Kind())
@@ -59,36 +104,38 @@ func Method[T1, T2 any](fn T1, newFn T2) error {
 		return fmt.Errorf("not a function, kind: %v", newFnv.Kind())
 	}
 
+	o := makeOptions(opts)
 	diff := diffFuncs(fnv, newFnv)
+	diff.ignoreEquivalentReceiver(o.unsafeReceiver)
 
-	// Ignore differences in the first argument if they are the same kind and size.
-	if len(diff.In) > 0 {
-		if diff.In[0] != nil {
-			ta := diff.In[0].A
-			tb := diff.In[0].B
-
-			if ta.Kind() == tb.Kind() {
-				// If the types are pointers then check the
-				// size of what they point to instead of the
-				// size of the pointers.
-				if ta.Kind() == reflect.Pointer {
-					ta = ta.Elem()
-					tb = tb.Elem()
-				}
+	if err := diff.Error(); err != nil {
+		return fmt.Errorf("function signatures do not match: %w", err)
+	}
 
-				if ta.Size() == tb.Size() {
-					diff.In[0] = nil
-				}
-			}
+	// Held across both so nothing sees the method redefined without its
+	// wrappers.
+	mu.Lock()
+	defer mu.Unlock()
 
-		}
+	_, existed := redefined[fnv.Pointer()]
+	err := unsafeFuncLocked(fn, newFn, false, o)
+	if err != nil {
+		return err
 	}
+	return finishMethodLocked(fnv.Pointer(), newFnv.Pointer(), existed, o)
+}
 
-	if err := diff.Error(); err != nil {
-		return fmt.Errorf("function signatures do not match: %w", err)
+// finishMethodLocked redirects the wrappers for the method at entry, which was
+// just redefined with newFn. If that fails, a method that wasn't redefined
+// before is restored, so the error means nothing changed.
+//
+// The caller must hold mu.
+func finishMethodLocked(entry, newFn uintptr, existed bool, opts options) error {
+	err := redirectWrappers(entry, newFn, opts)
+	if err != nil && !existed {
+		return errors.Join(err, restoreLocked(entry))
 	}
-
-	return unsafeFunc(fn, newFn)
+	return err
 }
 
 // Original returns a function with the same behavior as the original version
@@ -96,13 +143,33 @@ func Method[T1, T2 any](fn T1, newFn T2) error {
 // returned.
 //
 // If the original function cannot be found for any reason Original returns nil.
+// That includes a function that was redefined without a copy of the original,
+// as described in Func. Clone returns an error that wraps ErrNoOriginal
+// instead.
 //
 // Technically, this returns a copy of the original that's been relocated and
-// had relative addresses adjusted. This process may introduce problems.
-func Original[T any](fn T) T {
+// had relative addresses adjusted. When it's safe, only the instructions
+// replaced by the jump to the new function are copied, and the copy jumps back
+// to the rest of the original. Otherwise the whole function is copied. This
+// process may introduce problems.
+//
+// By default, the copy calls functions the same way the original did, so
+// recursive calls and calls to other redefined functions run the new
+// versions. Pass Recursive or Isolated to change that. If the copy can't be
+// made with those options, Original returns the copy it makes without them,
+// which still calls the redefined functions, and the reason is lost. Clone
+// takes the same options and returns the error instead, so use it when the
+// options matter.
+func Original[T any](fn T, opts ...Option) T {
+	var zero T
+
 	fnv := reflect.ValueOf(fn)
 	if fnv.Kind() != reflect.Func {
-		return *((*T)(nil))
+		return zero
+	}
+
+	if o := makeOptions(opts); o.recursive {
+		return originalVariant(fn, o)
 	}
 
 	mu.RLock()
@@ -114,16 +181,114 @@ func Original[T any](fn T) T {
 		return fn
 	}
 
-	if clonedType, ok := cloned.(*clonedFunc[T]); ok {
-		if clonedType != nil {
-			return clonedType.Func
-		}
+	// The function may have been redefined through a different type, such
+	// as by MethodByName, so build the T from the code.
+	pc, ok := cloned.(patchedCode)
+	if !ok {
+		return zero
+	}
+	ref := pc.funcRef()
+	if ref == nil {
+		return zero
+	}
+	return funcFromRef[T](ref)
+}
+
+// originalVariant is Original with options.
+func originalVariant[T any](fn T, opts options) T {
+	var zero T
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	entry := reflect.ValueOf(fn).Pointer()
+	cloned, ok := redefined[entry]
+	if !ok {
+		return fn
+	}
+
+	pc, ok := cloned.(patchedCode)
+	if !ok {
+		return zero
+	}
+
+	ref, err := pc.variant(entry, opts)
+	if err != nil {
+		// Settle for the copy without options, as documented.
+		// Original has no way to return err, Clone does.
+		ref = pc.funcRef()
+	}
+	if ref == nil {
+		return zero
+	}
+	return funcFromRef[T](ref)
+}
+
+// noOriginalError returns the error for a function at entry that was redefined
+// without a copy.
+func noOriginalError(entry uintptr) error {
+	return fmt.Errorf("%w: %s was redefined, but there wasn't room for a copy close enough to it", ErrNoOriginal, symbolName(entry))
+}
+
+// Clone returns a copy of fn that keeps working after fn is redefined, along
+// with a function to release the memory used by the copy. Calling the copy
+// after release crashes the program.
+//
+// If fn has been redefined, the copy has the original behavior, the same as
+// Original. The options that Original accepts also apply here. Unlike
+// Original, Isolated works for functions that haven't been redefined.
+//
+// The same caveats from Original apply here.
+func Clone[T any](fn T, opts ...Option) (T, func(), error) {
+	var zero T
+
+	fnv := reflect.ValueOf(fn)
+	if fnv.Kind() != reflect.Func || fnv.IsNil() {
+		return zero, nil, fmt.Errorf("not a function, kind: %v", fnv.Kind())
 	}
+	entry := fnv.Pointer()
+
+	mu.Lock()
+	defer mu.Unlock()
 
-	return *((*T)(nil))
+	src, err := originalSource(entry)
+	if err != nil {
+		return zero, nil, err
+	}
+
+	alloc := allocatorFor(entry)
+	code, _, err := copyWithOptions(alloc, entry, src, makeOptions(opts))
+	if err != nil {
+		return zero, nil, fmt.Errorf("unable to clone function: %w", err)
+	}
+
+	cloned, ref := makeFunc[T](code[0])
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			mu.Lock()
+			defer mu.Unlock()
+
+			alloc.BeginMutate()
+			defer alloc.EndMutate()
+
+			*ref = nil
+			for _, c := range code {
+				alloc.Free(c)
+			}
+		})
+	}
+
+	return cloned, release, nil
 }
 
 // Restore reverses the effect of redefining a method.
+//
+// If the code at the entry point was changed by something else after it was
+// redefined, Restore leaves it alone and returns a TamperError. Func and
+// Method refuse to redefine it again for the same reason. If the original code
+// was already put back, Restore just forgets about the redefinition.
 func Restore[T any](fn T) error {
 	fnv := reflect.ValueOf(fn)
 	if fnv.Kind() != reflect.Func {
@@ -133,77 +298,435 @@ func Restore[T any](fn T) error {
 	mu.Lock()
 	defer mu.Unlock()
 
-	cloned, ok := redefined[fnv.Pointer()]
+	return restoreLocked(fnv.Pointer())
+}
+
+// restoreLocked is Restore for the function at addr.
+//
+// The caller must hold mu.
+func restoreLocked(addr uintptr) error {
+	cloned, ok := redefined[addr]
 	if !ok {
 		// Not redefined, this is a no-op
 		return nil
 	}
 
-	clonedType, ok := cloned.(*clonedFunc[T])
+	pc, ok := cloned.(patchedCode)
 	if !ok {
 		return fmt.Errorf("unknown function type: %T", cloned)
 	}
 
-	code, err := funcSlice(fn)
-	if err != nil {
-		return err
+	// Functions written in assembly have two entry points. Check both
+	// before restoring either.
+	entries := []uintptr{addr}
+	if companion := pc.companionEntry(); companion != 0 {
+		entries = append(entries, companion)
 	}
-	if len(code) != len(clonedType.originalCode) {
-		return fmt.Errorf("func length mismatch %d != %d", len(code), len(clonedType.originalCode))
+
+	// So do the wrappers that Method redirected.
+	for _, entry := range methodWrappers[addr] {
+		if _, ok := redefined[entry]; ok {
+			entries = append(entries, entry)
+		}
 	}
 
-	err = mprotect(code, mprotectRWX)
-	if err != nil {
-		return fmt.Errorf("mprotect: %w", err)
+	var restores []func() error
+	for _, entry := range entries {
+		restore, err := restoreEntry(entry)
+		if err != nil {
+			return err
+		}
+		restores = append(restores, restore)
 	}
-	defer mprotect(code, mprotectRX)
+	for _, restore := range restores {
+		err := restore()
+		if err != nil {
+			return err
+		}
+		redefinedGen++
+	}
+	delete(methodWrappers, addr)
 
-	copy(code, clonedType.originalCode)
+	return nil
+}
+
+// savedEntry is the code at one entry point of a redefined function, and the
+// patch that recorded it.
+type savedEntry struct {
+	entry         uintptr
+	ep            entryPatcher
+	code, written []byte
+}
 
-	clonedType.Free()
-	delete(redefined, fnv.Pointer())
+// saveLocked returns a function that puts the function at entry back the way
+// it is now, so a redefinition made after it can be undone without losing an
+// earlier one. If the function is redefined, the code at its entry points is
+// written back, along with the wrappers Method redirected. Otherwise it's
+// restored.
+//
+// The caller must hold mu, and so must the caller of the returned function.
+func saveLocked(entry uintptr) func() error {
+	pc, ok := redefined[entry].(patchedCode)
+	if !ok {
+		return func() error { return restoreLocked(entry) }
+	}
 
-	cacheflush(code)
+	entries := []uintptr{entry}
+	if companion := pc.companionEntry(); companion != 0 {
+		entries = append(entries, companion)
+	}
+	wrappers := slices.Clone(methodWrappers[entry])
+	entries = append(entries, wrappers...)
 
-	return nil
+	var saved []savedEntry
+	for _, e := range entries {
+		ep, ok := redefined[e].(entryPatcher)
+		if !ok {
+			continue
+		}
+		code, err := funcSliceAt(e)
+		if err != nil {
+			continue
+		}
+		saved = append(saved, savedEntry{entry: e, ep: ep, code: bytes.Clone(code), written: ep.written()})
+	}
+
+	return func() error {
+		// If it was restored since, the code it jumped to is gone.
+		if redefined[entry] != pc {
+			return nil
+		}
+
+		// Wrappers redirected since then go back to the original.
+		for _, w := range methodWrappers[entry] {
+			if slices.Contains(wrappers, w) {
+				continue
+			}
+			if err := restoreLocked(w); err != nil {
+				return err
+			}
+		}
+
+		// Check every entry point before writing any.
+		var writes []func() error
+		for _, s := range saved {
+			if redefined[s.entry] != s.ep {
+				continue
+			}
+			code, err := funcSliceAt(s.entry)
+			if err != nil {
+				return err
+			}
+			if err := verifyPatch(s.entry, code, s.ep); err != nil && !bytes.Equal(code, s.code) {
+				return err
+			}
+			writes = append(writes, func() error {
+				err := mprotect(code, mprotectRWX)
+				if err != nil {
+					return fmt.Errorf("mprotect: %w", err)
+				}
+				defer mprotect(code, mprotectRX)
+
+				copy(code, s.code)
+				cacheflush(code)
+				s.ep.setWritten(s.written)
+				return nil
+			})
+		}
+		for _, write := range writes {
+			if err := write(); err != nil {
+				return err
+			}
+		}
+
+		methodWrappers[entry] = slices.DeleteFunc(wrappers, func(w uintptr) bool {
+			_, ok := redefined[w]
+			return !ok
+		})
+		redefinedGen++
+		return nil
+	}
 }
 
-// unsafeFunc redefines a function after the safety checks.
-func unsafeFunc[T any](fn T, newFn any) error {
-	code, err := funcSlice(fn)
+// undoAllLocked calls the functions from saveLocked in reverse order.
+//
+// The caller must hold mu.
+func undoAllLocked(undos []func() error) error {
+	var errs []error
+	for _, undo := range slices.Backward(undos) {
+		errs = append(errs, undo())
+	}
+	return errors.Join(errs...)
+}
+
+// restoreEntry checks that the function at entry can be restored and returns
+// a function that restores it.
+//
+// The caller must hold mu.
+func restoreEntry(entry uintptr) (func() error, error) {
+	pc, ok := redefined[entry].(patchedCode)
+	if !ok {
+		return nil, fmt.Errorf("unknown function type: %T", redefined[entry])
+	}
+
+	code, err := funcSliceAt(entry)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(code) != len(pc.original()) {
+		return nil, fmt.Errorf("func length mismatch %d != %d", len(code), len(pc.original()))
 	}
 
+	err = verifyPatch(entry, code, pc)
+	if err != nil && !bytes.Equal(code, pc.original()) {
+		return nil, err
+	}
+
+	// Skip the write if something else already put the original code
+	// back.
+	write := err == nil
+
+	return func() error {
+		if write {
+			err := mprotect(code, mprotectRWX)
+			if err != nil {
+				return fmt.Errorf("mprotect: %w", err)
+			}
+			defer mprotect(code, mprotectRX)
+
+			copy(code, pc.original())
+			cacheflush(code)
+		}
+
+		pc.Free()
+		delete(redefined, entry)
+		return nil
+	}, nil
+}
+
+// forget drops a function that was cloned but never patched, along with the
+// other entry point of an assembly function.
+//
+// The caller must hold mu.
+func forget(entry uintptr) {
+	pc, ok := redefined[entry].(patchedCode)
+	if ok {
+		if companion := pc.companionEntry(); companion != 0 {
+			if cpc, ok := redefined[companion].(patchedCode); ok {
+				cpc.Free()
+			}
+			delete(redefined, companion)
+		}
+		pc.Free()
+	}
+	delete(redefined, entry)
+}
+
+// unsafeFunc redefines a function after the safety checks. If closure is
+// true, newFn is called through a trampoline that sets up its closure context,
+// so it can use captured variables.
+//
+// Functions written in assembly have a second entry point for callers that use
+// the ABI0 calling convention, which is redefined too. See findAsmFunc.
+func unsafeFunc[T any](fn T, newFn any, closure bool, opts options) error {
 	// Locked to prevent simultaneous writes to the map and competing
 	// mprotect calls
 	mu.Lock()
 	defer mu.Unlock()
 
+	return unsafeFuncLocked(fn, newFn, closure, opts)
+}
+
+// unsafeFuncLocked is unsafeFunc for callers that already hold mu.
+func unsafeFuncLocked[T any](fn T, newFn any, closure bool, opts options) error {
 	addr := reflect.ValueOf(fn).Pointer()
-	if _, ok := redefined[addr]; !ok {
-		redefined[addr], err = cloneFunc(fn)
+	af, err := findAsmFunc(addr)
+	if err != nil {
+		return err
+	}
+	if af.wrapper != 0 && addr == af.body {
+		// The wrapper redefines both.
+		return unsafeFuncLocked(funcAt(af.wrapper), newFn, closure, opts)
+	}
+
+	if closure && af.body == addr {
+		// The adapter would replace the closure trampoline.
+		return fmt.Errorf("%w: can't redirect to a closure without a wrapper", ErrABI0)
+	}
+
+	// Without adapters, only the wrapper is redefined and callers of the
+	// assembly still run it.
+	var unredirected []string
+	if !abi0Adapters || !opts.abi0Adapter {
+		if af.body == addr {
+			return fmt.Errorf("%s: %w: it has no wrapper, and redirecting it needs the ABI0Adapter option on amd64", funcName(findfunc(addr)), ErrABI0)
+		}
+		if af.wrapper == addr {
+			unredirected = append(unredirected, funcName(findfunc(af.body)))
+			af = asmFunc{}
+		}
+	}
+
+	var layout abiLayout
+	var loadG []byte
+	if af.body != 0 {
+		layout, err = checkABI0(af, reflect.TypeOf(newFn))
+		if err != nil {
+			return err
+		}
+		loadG, err = loadGFor(af)
 		if err != nil {
+			return fmt.Errorf("%w: %w", ErrABI0, err)
+		}
+	}
+
+	code, err := funcSlice(fn)
+	if err != nil {
+		return err
+	}
+
+	_, ok := redefined[addr]
+	created := !ok
+	if created {
+		var cloned *clonedFunc[T]
+		if fj, ok := detectForeignJump(addr, code); ok {
+			if !opts.foreignLayer {
+				return newForeignPatchError(addr, fj)
+			}
+			cloned, err = foreignLayerFunc(fn, code, fj)
+		} else if af.wrapper == addr {
+			cloned, err = cloneAsmWrapper(fn, code, af.body)
+		} else {
+			// Moving the prologue is cheaper, but not always
+			// possible.
+			cloned, err = detourFunc(fn)
+			if err != nil {
+				cloned, err = cloneFunc(fn)
+			}
+		}
+		if errors.Is(err, errArenaOutOfRange) {
+			// The arena couldn't be placed close enough to the
+			// function, which can happen in position-independent
+			// builds. Redefine it anyway, Clone reports
+			// ErrNoOriginal.
+			cloned = &clonedFunc[T]{
+				alloc:        allocatorFor(addr),
+				originalCode: bytes.Clone(code),
+				name:         symbolName(addr),
+			}
+		} else if err != nil {
 			// TODO: Should this be fatal?
 			return fmt.Errorf("unable to clone function: %w", err)
 		}
+		redefined[addr] = cloned
 	}
 
-	err = mprotect(code, mprotectRWX)
-	if err != nil {
-		return fmt.Errorf("mprotect: %w", err)
+	// Any type works here, the function may have been redefined through
+	// another one first.
+	cloned, ok := redefined[addr].(entryPatcher)
+	if !ok {
+		return fmt.Errorf("unknown function type: %T", redefined[addr])
 	}
-	defer mprotect(code, mprotectRX)
 
-	err = insertJump(code, reflect.ValueOf(newFn).Pointer())
+	// Don't overwrite changes something else made since the last time.
+	err = verifyPatch(addr, code, cloned)
 	if err != nil {
 		return err
 	}
 
-	cacheflush(code)
+	dest := reflect.ValueOf(newFn).Pointer()
+	if closure {
+		dest, err = cloned.addClosure(newFn)
+		if err != nil {
+			if created {
+				forget(addr)
+			}
+			return err
+		}
+	}
+
+	if af.body == addr {
+		// There's no wrapper, so the adapter is all there is.
+		dest, err = cloned.addABI0Adapter(newFn, layout, loadG)
+		if err != nil {
+			if created {
+				forget(addr)
+			}
+			return fmt.Errorf("%w: %w", ErrABI0, err)
+		}
+	}
+
+	var undoABI0 func() error
+	if af.body != 0 && af.body != addr {
+		undoABI0, err = redirectABI0(af.body, newFn, layout, loadG)
+		if err != nil {
+			if created {
+				forget(addr)
+			}
+			return err
+		}
+	}
+
+	err = patchEntry(code, cloned, dest)
+	if err != nil {
+		// Don't leave the assembly going to newFn without the wrapper.
+		if undoABI0 != nil {
+			err = errors.Join(err, undoABI0())
+		}
+		if created {
+			forget(addr)
+		}
+		return err
+	}
+	redefinedGen++
+	opts.reportUnredirected(unredirected...)
 	return nil
 }
 
+// redirectABI0 sends the assembly at body, which was cloned along with its
+// wrapper, to an adapter that calls newFn. It returns a function that puts
+// back the code that was at body before.
+//
+// The caller must hold mu.
+func redirectABI0(body uintptr, newFn any, layout abiLayout, loadG []byte) (func() error, error) {
+	ep, ok := redefined[body].(entryPatcher)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown function type: %T", ErrABI0, redefined[body])
+	}
+
+	code, err := funcSliceAt(body)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyPatch(body, code, ep)
+	if err != nil {
+		return nil, err
+	}
+
+	prev, prevWritten := bytes.Clone(code), ep.written()
+	dest, err := ep.addABI0Adapter(newFn, layout, loadG)
+	if err == nil {
+		err = patchEntry(code, ep, dest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrABI0, err)
+	}
+
+	undo := func() error {
+		err := mprotect(code, mprotectRWX)
+		if err != nil {
+			return fmt.Errorf("mprotect: %w", err)
+		}
+		defer mprotect(code, mprotectRX)
+
+		copy(code, prev)
+		cacheflush(code)
+		ep.setWritten(prevWritten)
+		return nil
+	}
+	return undo, nil
+}
+
 // funcSlice returns a slice containing the machine instructions for a function.
 func funcSlice(fn any) ([]byte, error) {
 	fnv := reflect.ValueOf(fn)
@@ -211,31 +734,23 @@ func funcSlice(fn any) ([]byte, error) {
 		return nil, fmt.Errorf("not a function, kind: %v", fnv.Kind())
 	}
 
-	entry := fnv.Pointer()
-
-	// To find the length, look at the offsets of every function and find
-	// the one that comes immediately after this one.
-
-	// TODO: Is there a better way to do this?
-	//    - ftab seems to be ordered so could it find the next entry that way?
-	//    - is the info stored somewhere more conveniently in datap?
+	return funcSliceAt(fnv.Pointer())
+}
 
+// funcSliceAt returns a slice containing the machine instructions for the
+// function that starts at entry.
+func funcSliceAt(entry uintptr) ([]byte, error) {
 	info := findfunc(entry)
-	funcOffset := uint32(entry - info.datap.text)
-	length := uint32(info.datap.etext - entry)
-
-	for _, ft := range info.datap.ftab {
-		// Does this function come before the one we're looking for?
-		if ft.entryoff <= funcOffset {
-			continue
-		}
+	if info._func == nil {
+		return nil, fmt.Errorf("no function found at 0x%x", entry)
+	}
 
-		// Is the distance between these two functions less than what we've seen before?
-		testLength := ft.entryoff - funcOffset
-		if testLength < length {
-			length = testLength
-		}
+	start := info.datap.text + uintptr(info.entryOff)
+	p := unsafe.Pointer(start)
+	length := uintptr(funcLength(info, p))
+	if entry-start >= length {
+		return nil, fmt.Errorf("0x%x is in the padding after a function", entry)
 	}
 
-	return unsafe.Slice((*byte)(unsafe.Pointer(entry)), length), nil
+	return unsafe.Slice((*byte)(unsafe.Add(p, entry-start)), start+length-entry), nil
 }
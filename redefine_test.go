@@ -2,6 +2,7 @@ package redefine
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -311,15 +312,18 @@ func TestMethod_DifferentTypes(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
-	// This is to demonstrate the effect of not using an equivalent type
-	// for redefined methods. The size of testStruct and testStruct4 are
-	// the same but the fields are different. So the code compiled for
-	// testStruct4 operates on the memory of testStruct and things get
-	// weird. It works OK in this test, but in general expect crashes and
-	// weird bugs.
+	// The size of testStruct and testStruct4 are the same but the fields
+	// are different, so Method refuses.
+	err := Method((*testStruct).Inc, (*testStruct4).Inc)
+	assert.ErrorContains(err, "v.Num int != uint32")
 
+	// This is to demonstrate the effect of not using an equivalent type
+	// for redefined methods. The code compiled for testStruct4 operates on
+	// the memory of testStruct and things get weird. It works OK in this
+	// test, but in general expect crashes and weird bugs.
 	ts := &testStruct{}
-	require.NoError(Method((*testStruct).Inc, (*testStruct4).Inc))
+	require.NoError(Method((*testStruct).Inc, (*testStruct4).Inc, UnsafeReceiver()))
+	t.Cleanup(func() { Restore((*testStruct).Inc) })
 	ts.Inc()
 	assert.Equal(1<<32|1, ts.Num)
 }
@@ -486,3 +490,209 @@ func TestFunc_Closure(t *testing.T) {
 		assert.Equal(t, 3, closureTestFunc())
 	})
 }
+
+//go:noinline
+func fib(n int) int {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}
+
+func TestOriginal_Recursive(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	require.NoError(Func(fib, func(n int) int { return -1 }))
+	t.Cleanup(func() { Restore(fib) })
+
+	assert.Equal(-1, fib(10))
+
+	// Without Recursive only the first call runs the original.
+	assert.Equal(-2, Original(fib)(10))
+
+	assert.Equal(55, Original(fib, Recursive())(10))
+	assert.Equal(55, Original(fib, Isolated())(10))
+}
+
+//go:noinline
+func isolatedOuter() string {
+	return "outer " + isolatedMiddle()
+}
+
+//go:noinline
+func isolatedMiddle() string {
+	return "middle " + isolatedInner()
+}
+
+//go:noinline
+func isolatedInner() string {
+	return "inner"
+}
+
+func TestOriginal_Isolated(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	require.NoError(Func(isolatedOuter, func() string { return "new outer" }))
+	t.Cleanup(func() { Restore(isolatedOuter) })
+	require.NoError(Func(isolatedInner, func() string { return "new inner" }))
+	t.Cleanup(func() { Restore(isolatedInner) })
+
+	assert.Equal("outer middle new inner", Original(isolatedOuter)())
+	assert.Equal("outer middle inner", Original(isolatedOuter, Isolated())())
+
+	// Isolated copies ignore whatever is redefined when they're made.
+	require.NoError(Restore(isolatedInner))
+	require.NoError(Func(isolatedMiddle, func() string { return "new middle" }))
+	t.Cleanup(func() { Restore(isolatedMiddle) })
+	assert.Equal("outer middle inner", Original(isolatedOuter, Isolated())())
+}
+
+func TestOriginal_IsolatedVariants(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	require.NoError(Func(isolatedOuter, func() string { return "new outer" }))
+	t.Cleanup(func() { Restore(isolatedOuter) })
+
+	mu.RLock()
+	cloned := redefined[reflect.ValueOf(isolatedOuter).Pointer()].(*clonedFunc[func() string])
+	mu.RUnlock()
+
+	assert.Equal("outer middle inner", Original(isolatedOuter, Isolated())())
+	assert.Len(cloned.variants, 1)
+
+	// Redefining something outside the call tree doesn't need a new copy.
+	require.NoError(Func(a, b))
+	require.NoError(Restore(a))
+	assert.Equal("outer middle inner", Original(isolatedOuter, Isolated())())
+	assert.Len(cloned.variants, 1)
+
+	require.NoError(Func(isolatedInner, func() string { return "new inner" }))
+	t.Cleanup(func() { Restore(isolatedInner) })
+	assert.Equal("outer middle inner", Original(isolatedOuter, Isolated())())
+	assert.Len(cloned.variants, 2)
+
+	// Going back reuses the first copy.
+	require.NoError(Restore(isolatedInner))
+	assert.Equal("outer middle inner", Original(isolatedOuter, Isolated())())
+	assert.Len(cloned.variants, 2)
+}
+
+func TestCallGraph_Cached(t *testing.T) {
+	entry := reflect.ValueOf(isolatedOuter).Pointer()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	graph, err := callGraph(entry)
+	require.NoError(t, err)
+	assert.Contains(t, graph, reflect.ValueOf(isolatedInner).Pointer())
+
+	// The second call doesn't walk the calls again.
+	again, err := callGraph(entry)
+	require.NoError(t, err)
+	assert.Equal(t, reflect.ValueOf(graph).UnsafePointer(), reflect.ValueOf(again).UnsafePointer())
+}
+
+func TestFuncSliceAt(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	datap := findfunc(reflect.ValueOf(a).Pointer()).datap
+	require.NotNil(datap)
+
+	// The last entry in ftab is the end of the text segment.
+	ftab := datap.ftab[:len(datap.ftab)-1]
+	for i, ft := range ftab {
+		entry := datap.text + uintptr(ft.entryoff)
+		code, err := funcSliceAt(entry)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		// Several entries can start at the same address, like the
+		// aliases of C functions in a race build.
+		next := datap.etext
+		for _, nft := range datap.ftab[i+1:] {
+			if nft.entryoff > ft.entryoff {
+				next = datap.text + uintptr(nft.entryoff)
+				break
+			}
+		}
+		assert.NotEmpty(code)
+		assert.LessOrEqual(entry+uintptr(len(code)), next)
+	}
+
+	last := datap.text + uintptr(ftab[len(ftab)-1].entryoff)
+	code, err := funcSliceAt(last)
+	if assert.NoError(err) {
+		assert.LessOrEqual(last+uintptr(len(code)), datap.etext)
+	}
+
+	_, err = funcSliceAt(0)
+	assert.Error(err)
+}
+
+func TestRestore_Tampered(t *testing.T) {
+	// write replaces the start of a, the way another patching library
+	// would.
+	write := func(fn func([]byte)) {
+		code, err := funcSlice(a)
+		require.NoError(t, err)
+		require.NoError(t, mprotect(code, mprotectRWX))
+		defer mprotect(code, mprotectRX)
+		fn(code)
+		cacheflush(code)
+	}
+
+	require.NoError(t, Func(a, b))
+	t.Cleanup(func() { Restore(a) })
+	assert.NoError(t, Verify())
+
+	mu.RLock()
+	cloned := redefined[reflect.ValueOf(a).Pointer()].(*clonedFunc[func() string])
+	mu.RUnlock()
+
+	write(func(code []byte) {
+		require.NoError(t, insertJump(code[:minJumpSize], reflect.ValueOf(testCloneFuncWithData).Pointer()))
+	})
+	assert.Equal(t, "something static", a())
+
+	err := Verify()
+	assert.ErrorIs(t, err, ErrTampered)
+	var tamperErr *TamperError
+	if assert.ErrorAs(t, err, &tamperErr) {
+		assert.Equal(t, reflect.ValueOf(a).Pointer(), tamperErr.Entry)
+		assert.Equal(t, "github.com/pboyd/redefine.a", tamperErr.Name)
+		assert.NotEqual(t, tamperErr.Want, tamperErr.Got)
+	}
+
+	assert.ErrorIs(t, Restore(a), ErrTampered)
+	gen := redefinedGen
+	assert.ErrorIs(t, Func(a, b), ErrTampered)
+	assert.Equal(t, gen, redefinedGen, "nothing was redefined")
+	assert.Equal(t, "something static", a())
+
+	// Once our jump is back, it can be restored.
+	write(func(code []byte) {
+		copy(code, cloned.patched)
+	})
+	assert.NoError(t, Verify())
+	assert.NoError(t, Restore(a))
+	assert.Equal(t, "a", a())
+
+	// Something else put the original code back.
+	require.NoError(t, Func(a, b))
+	mu.RLock()
+	cloned = redefined[reflect.ValueOf(a).Pointer()].(*clonedFunc[func() string])
+	mu.RUnlock()
+	write(func(code []byte) {
+		copy(code, cloned.originalCode)
+	})
+	assert.ErrorIs(t, Verify(), ErrTampered)
+	assert.NoError(t, Restore(a))
+	assert.NoError(t, Verify())
+	assert.Equal(t, "a", a())
+}
@@ -0,0 +1,433 @@
+// Package redefinecheck defines an Analyzer that reports calls to the redefine
+// package that are likely to misbehave at run time.
+//
+// It reports:
+//   - targets of Func and Method that the compiler can inline, because they're
+//     small and not marked //go:noinline, so some calls won't be redefined
+//   - closures and method values passed as replacements, which lose the
+//     variables they capture
+//   - instantiations of generic functions passed as targets, which can't be
+//     redefined
+//   - calls to Func and Method in a function that never restores the target,
+//     either itself or in a function it passes to Cleanup, which leave the
+//     redefinition in place for the rest of the program
+//   - replacements passed to Method with a receiver type that isn't defined
+//     from the target's receiver type, like "type myT T"
+//
+// Whether a function can be inlined is an estimate, based on the size of its
+// body, of what the compiler decides.
+package redefinecheck
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+// Analyzer reports misuse of the redefine package.
+var Analyzer = &analysis.Analyzer{
+	Name:      "redefinecheck",
+	Doc:       "report calls to redefine that are likely to misbehave",
+	URL:       "https://pkg.go.dev/github.com/pboyd/redefine/redefinecheck",
+	Run:       run,
+	FactTypes: []analysis.Fact{new(inlinable)},
+}
+
+const redefinePath = "github.com/pboyd/redefine"
+
+// inlinable is exported for functions that the compiler is likely to inline.
+type inlinable struct{}
+
+func (*inlinable) AFact() {}
+
+func (*inlinable) String() string { return "inlinable" }
+
+// inlineBudget is the compiler's limit on the cost of a function it inlines,
+// and callCost is roughly what it charges for each call that isn't inlined.
+const (
+	inlineBudget = 80
+	callCost     = 57
+)
+
+// The position of the target and the replacement in the arguments of each
+// function that redefines something. -1 if there isn't one.
+//
+// Itab isn't listed. It has no target to check, and it calls the replacement
+// through a trampoline that sets up its context, so closures are fine.
+var redefiners = map[string]struct{ target, newFn int }{
+	"Func":         {0, 1},
+	"Method":       {0, 1},
+	"FuncByName":   {-1, 1},
+	"MethodByName": {-1, 2},
+}
+
+func run(pass *analysis.Pass) (any, error) {
+	var funcs []*ast.FuncDecl
+	for _, file := range pass.Files {
+		for _, decl := range file.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && fd.Body != nil {
+				funcs = append(funcs, fd)
+			}
+		}
+	}
+
+	// Facts for this package's functions are needed by the calls in it.
+	for _, fd := range funcs {
+		if fd.Recv == nil && (fd.Name.Name == "init" || fd.Name.Name == "main") {
+			// These can't be redefined.
+			continue
+		}
+		if !likelyInlined(pass, fd) {
+			continue
+		}
+		if fn, ok := pass.TypesInfo.Defs[fd.Name].(*types.Func); ok {
+			pass.ExportObjectFact(fn, new(inlinable))
+		}
+	}
+
+	decls := map[*types.Func]*ast.FuncDecl{}
+	for _, fd := range funcs {
+		if fn, ok := pass.TypesInfo.Defs[fd.Name].(*types.Func); ok {
+			decls[fn] = fd
+		}
+	}
+
+	for _, fd := range funcs {
+		checkFunc(pass, fd.Body, decls)
+	}
+
+	return nil, nil
+}
+
+// checkFunc checks the calls to redefine in the body of a function declaration,
+// including the function literals in it. decls has the function declarations
+// in the package, for the ones passed to Cleanup.
+func checkFunc(pass *analysis.Pass, body *ast.BlockStmt, decls map[*types.Func]*ast.FuncDecl) {
+	var needRestore []*ast.CallExpr
+	restored := map[string]bool{}
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+
+		fn := callee(pass, call)
+		if fn == nil {
+			return true
+		}
+		if fn.Name() == "Cleanup" && isMethod(fn) && len(call.Args) == 1 {
+			// Function literals are inspected with the rest of the
+			// body, so only named functions need to be looked up.
+			if fd := decls[funcObject(pass, ast.Unparen(call.Args[0]))]; fd != nil {
+				addRestored(pass, fd.Body, restored)
+			}
+			return true
+		}
+		if fn.Pkg() == nil || fn.Pkg().Path() != redefinePath || isMethod(fn) {
+			return true
+		}
+
+		if isRestore(fn, call) {
+			restored[types.ExprString(call.Args[0])] = true
+			return true
+		}
+
+		pos, ok := redefiners[fn.Name()]
+		if !ok {
+			return true
+		}
+		if pos.target >= 0 && pos.target < len(call.Args) {
+			checkTarget(pass, call.Args[pos.target])
+		}
+		if pos.newFn >= 0 && pos.newFn < len(call.Args) {
+			checkNewFn(pass, call.Args[pos.newFn])
+		}
+		if fn.Name() == "Func" || fn.Name() == "Method" {
+			needRestore = append(needRestore, call)
+		}
+		if fn.Name() == "Method" && len(call.Args) >= 2 {
+			checkReceiver(pass, call.Args[0], call.Args[1])
+		}
+		return true
+	})
+
+	for _, call := range needRestore {
+		if !restored[types.ExprString(call.Args[0])] {
+			pass.ReportRangef(call, "%s is never restored: call redefine.Restore, or restore it in t.Cleanup", types.ExprString(call.Args[0]))
+		}
+	}
+}
+
+// addRestored adds the targets of the calls to Restore in body to restored.
+func addRestored(pass *analysis.Pass, body *ast.BlockStmt, restored map[string]bool) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		if fn := callee(pass, call); fn != nil && isRestore(fn, call) {
+			restored[types.ExprString(call.Args[0])] = true
+		}
+		return true
+	})
+}
+
+// isRestore reports whether call is a call to redefine.Restore.
+func isRestore(fn *types.Func, call *ast.CallExpr) bool {
+	return fn.Name() == "Restore" && fn.Pkg() != nil && fn.Pkg().Path() == redefinePath && len(call.Args) == 1
+}
+
+// checkTarget reports targets that can't be redefined reliably.
+func checkTarget(pass *analysis.Pass, target ast.Expr) {
+	target = ast.Unparen(target)
+
+	if isGenericInstance(pass, target) {
+		pass.ReportRangef(target, "%s is an instance of a generic function, which can't be redefined", types.ExprString(target))
+		return
+	}
+
+	fn := funcObject(pass, target)
+	if fn == nil {
+		return
+	}
+	if pass.ImportObjectFact(fn.Origin(), new(inlinable)) {
+		pass.ReportRangef(target, "%s is small enough to be inlined, where it won't be redefined: add //go:noinline to it", types.ExprString(target))
+	}
+}
+
+// checkNewFn reports replacements that depend on a closure context, which
+// redefine doesn't pass on.
+func checkNewFn(pass *analysis.Pass, newFn ast.Expr) {
+	newFn = ast.Unparen(newFn)
+
+	switch e := newFn.(type) {
+	case *ast.FuncLit:
+		if v := capturedVar(pass, e); v != nil {
+			pass.ReportRangef(e, "the replacement is a closure that captures %s, which will be lost when it's called in place of the original", v.Name())
+		}
+	case *ast.SelectorExpr:
+		if sel, ok := pass.TypesInfo.Selections[e]; ok && sel.Kind() == types.MethodVal {
+			pass.ReportRangef(e, "%s is a method value, which loses its receiver when it's called in place of the original: use a method expression", types.ExprString(e))
+		}
+	}
+}
+
+// checkReceiver reports replacements for methods whose receiver type isn't
+// defined from the receiver type of the target.
+func checkReceiver(pass *analysis.Pass, target, newFn ast.Expr) {
+	tsig, ok := pass.TypesInfo.TypeOf(target).(*types.Signature)
+	if !ok || tsig.Params().Len() == 0 {
+		return
+	}
+	nsig, ok := pass.TypesInfo.TypeOf(newFn).(*types.Signature)
+	if !ok || nsig.Params().Len() == 0 {
+		return
+	}
+
+	want, got := tsig.Params().At(0).Type(), nsig.Params().At(0).Type()
+	if types.Identical(want, got) {
+		return
+	}
+
+	wp, wptr := want.(*types.Pointer)
+	gp, gptr := got.(*types.Pointer)
+	if wptr != gptr {
+		pass.ReportRangef(newFn, "the receiver of the replacement is %s, but the target's is %s", got, want)
+		return
+	}
+	if wptr {
+		want, got = wp.Elem(), gp.Elem()
+	}
+
+	if !definedFrom(pass, got, want) {
+		pass.ReportRangef(newFn, "the receiver of the replacement is %s, which isn't defined from %s: use \"type %s %s\"", got, want, typeName(got), types.TypeString(want, types.RelativeTo(pass.Pkg)))
+	}
+}
+
+// definedFrom reports whether t is declared as "type T from", possibly
+// through other types declared the same way.
+func definedFrom(pass *analysis.Pass, t, from types.Type) bool {
+	named, ok := types.Unalias(t).(*types.Named)
+	if !ok {
+		return false
+	}
+
+	// Only the declarations in this package can be seen. For others, the
+	// underlying types have to do.
+	if named.Obj().Pkg() != pass.Pkg {
+		return types.Identical(named.Underlying(), from.Underlying())
+	}
+
+	for _, file := range pass.Files {
+		for _, decl := range file.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if pass.TypesInfo.Defs[ts.Name] != named.Obj() {
+					continue
+				}
+				source := pass.TypesInfo.TypeOf(ts.Type)
+				if source == nil {
+					return false
+				}
+				return types.Identical(source, from) || definedFrom(pass, source, from)
+			}
+		}
+	}
+	return false
+}
+
+// likelyInlined reports whether the compiler is likely to inline the function.
+func likelyInlined(pass *analysis.Pass, fd *ast.FuncDecl) bool {
+	if fd.Body == nil || fd.Type.TypeParams != nil || hasDirective(fd, "go:noinline") {
+		return false
+	}
+
+	cost := 0
+	ast.Inspect(fd.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case nil:
+			return false
+		case *ast.DeferStmt, *ast.GoStmt:
+			// Functions with these aren't inlined.
+			cost += inlineBudget + 1
+		case *ast.CallExpr:
+			cost += callExprCost(pass, n)
+		}
+		cost++
+		return cost <= inlineBudget
+	})
+	return cost <= inlineBudget
+}
+
+// callExprCost returns the extra cost of a call for likelyInlined.
+func callExprCost(pass *analysis.Pass, call *ast.CallExpr) int {
+	if pass.TypesInfo.Types[call.Fun].IsType() {
+		// A conversion.
+		return 0
+	}
+
+	if id, ok := ast.Unparen(call.Fun).(*ast.Ident); ok {
+		if b, ok := pass.TypesInfo.Uses[id].(*types.Builtin); ok {
+			if b.Name() == "recover" {
+				// Functions that call recover aren't inlined.
+				return inlineBudget + 1
+			}
+			return 0
+		}
+	}
+
+	return callCost
+}
+
+// hasDirective reports whether the function's doc comment has the directive.
+func hasDirective(fd *ast.FuncDecl, directive string) bool {
+	if fd.Doc == nil {
+		return false
+	}
+	for _, c := range fd.Doc.List {
+		if strings.HasPrefix(c.Text, "//"+directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// callee returns the function or method that call calls, if it's known.
+func callee(pass *analysis.Pass, call *ast.CallExpr) *types.Func {
+	fn, _ := typeutil.Callee(pass.TypesInfo, call).(*types.Func)
+	return fn
+}
+
+// funcObject returns the function or method that e refers to, if it's a
+// function name or a method expression.
+func funcObject(pass *analysis.Pass, e ast.Expr) *types.Func {
+	switch e := e.(type) {
+	case *ast.Ident:
+		fn, _ := pass.TypesInfo.Uses[e].(*types.Func)
+		return fn
+	case *ast.SelectorExpr:
+		if sel, ok := pass.TypesInfo.Selections[e]; ok {
+			if sel.Kind() != types.MethodExpr {
+				return nil
+			}
+			fn, _ := sel.Obj().(*types.Func)
+			return fn
+		}
+		// A qualified identifier.
+		fn, _ := pass.TypesInfo.Uses[e.Sel].(*types.Func)
+		return fn
+	}
+	return nil
+}
+
+// isGenericInstance reports whether e is an instance of a generic function, or
+// a method of an instance of a generic type.
+func isGenericInstance(pass *analysis.Pass, e ast.Expr) bool {
+	switch x := e.(type) {
+	case *ast.IndexExpr:
+		e = x.X
+	case *ast.IndexListExpr:
+		e = x.X
+	}
+
+	var id *ast.Ident
+	switch x := e.(type) {
+	case *ast.Ident:
+		id = x
+	case *ast.SelectorExpr:
+		id = x.Sel
+	}
+	if id != nil {
+		if _, ok := pass.TypesInfo.Instances[id]; ok {
+			return true
+		}
+	}
+
+	fn := funcObject(pass, e)
+	return fn != nil && fn.Origin() != fn
+}
+
+// capturedVar returns a local variable from outside lit that it uses, if any.
+func capturedVar(pass *analysis.Pass, lit *ast.FuncLit) *types.Var {
+	var captured *types.Var
+	ast.Inspect(lit.Body, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || captured != nil {
+			return captured == nil
+		}
+		v, ok := pass.TypesInfo.Uses[id].(*types.Var)
+		if !ok || v.IsField() || v.Pkg() != pass.Pkg || v.Parent() == nil {
+			return true
+		}
+		// Package variables aren't captured.
+		if v.Parent() == pass.Pkg.Scope() {
+			return true
+		}
+		if v.Pos() < lit.Pos() || v.Pos() >= lit.End() {
+			captured = v
+		}
+		return true
+	})
+	return captured
+}
+
+func isMethod(fn *types.Func) bool {
+	return fn.Signature().Recv() != nil
+}
+
+// typeName returns the name of t without the package.
+func typeName(t types.Type) string {
+	if named, ok := types.Unalias(t).(*types.Named); ok {
+		return named.Obj().Name()
+	}
+	return t.String()
+}
@@ -0,0 +1,137 @@
+package a
+
+import (
+	"b"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/pboyd/redefine"
+)
+
+//go:noinline
+func target(n int) string {
+	return fmt.Sprint(n)
+}
+
+func small(n int) string { // want small:"inlinable"
+	return "small"
+}
+
+// big calls enough functions that it won't be inlined.
+func big(n int) string {
+	a := fmt.Sprint(n)
+	b := fmt.Sprint(n + 1)
+	return a + b
+}
+
+func generic[T any](v T) string {
+	return fmt.Sprint(v)
+}
+
+type thing struct {
+	n int
+}
+
+//go:noinline
+func (t *thing) Get() int {
+	return t.n
+}
+
+type myThing thing
+
+func (t *myThing) Get() int { // want Get:"inlinable"
+	return 0
+}
+
+type otherThing struct {
+	n int
+}
+
+func (t *otherThing) Get() int { // want Get:"inlinable"
+	return 0
+}
+
+type myServer b.Server
+
+func (s *myServer) Addr() string { // want Addr:"inlinable"
+	return "fake"
+}
+
+func TestRestored(t *testing.T) {
+	redefine.Func(target, func(int) string { return "" })
+	defer redefine.Restore(target)
+
+	redefine.Func(big, func(int) string { return "" })
+	redefine.Restore(big)
+}
+
+func TestCleanup(t *testing.T) {
+	redefine.Func(target, func(int) string { return "" })
+	redefine.Method((*thing).Get, (*myThing).Get)
+	t.Cleanup(func() {
+		redefine.Restore(target)
+		redefine.Restore((*thing).Get)
+	})
+}
+
+func TestNotRestored(t *testing.T) { // want TestNotRestored:"inlinable"
+	redefine.Func(target, func(int) string { return "" }) // want `target is never restored`
+}
+
+func TestOtherCleanup(t *testing.T) {
+	redefine.Func(target, func(int) string { return "" }) // want `target is never restored`
+	redefine.Func(big, func(int) string { return "" })
+	t.Cleanup(func() { redefine.Restore(big) })
+}
+
+// restoreAll restores everything the tests below redefine.
+func restoreAll() {
+	redefine.Restore(target)
+	redefine.Restore(small)
+	redefine.Restore(b.Small)
+	redefine.Restore(b.NoInline)
+	redefine.Restore((*b.Server).Addr)
+	redefine.Restore(generic[int])
+	redefine.Restore((*thing).Get)
+}
+
+func TestInlinable(t *testing.T) {
+	t.Cleanup(restoreAll)
+
+	redefine.Func(small, func(int) string { return "" }) // want `small is small enough to be inlined`
+	redefine.Func(b.Small, func() int { return 2 })      // want `b.Small is small enough to be inlined`
+	redefine.Func(b.NoInline, func() int { return 2 })
+	redefine.Method((*b.Server).Addr, (*myServer).Addr) // want `\(\*b.Server\).Addr is small enough to be inlined`
+}
+
+func TestClosure(t *testing.T) {
+	t.Cleanup(restoreAll)
+
+	prefix := "x"
+	redefine.Func(target, func(n int) string { return prefix }) // want `captures prefix`
+	redefine.Func(target, func(n int) string {
+		s := "y"
+		return s
+	})
+
+	th := &thing{}
+	redefine.FuncByName("a.target", th.Get) // want `th.Get is a method value`
+
+	// Itab passes on the context.
+	n := 2
+	redefine.Itab(reflect.TypeFor[interface{ Get() int }](), reflect.TypeFor[*thing](), "Get", func(*thing) int { return n })
+}
+
+func TestGeneric(t *testing.T) {
+	t.Cleanup(restoreAll)
+
+	redefine.Func(generic[int], func(int) string { return "" }) // want `instance of a generic function`
+}
+
+func TestReceiver(t *testing.T) {
+	t.Cleanup(restoreAll)
+
+	redefine.Method((*thing).Get, (*otherThing).Get) // want `isn't defined from a.thing`
+	redefine.Method((*thing).Get, func(*thing) int { return 0 })
+}
@@ -0,0 +1,19 @@
+// Package b has functions for package a to redefine.
+package b
+
+func Small() int {
+	return 1
+}
+
+//go:noinline
+func NoInline() int {
+	return 1
+}
+
+type Server struct {
+	addr string
+}
+
+func (s *Server) Addr() string {
+	return s.addr
+}
@@ -0,0 +1,191 @@
+package redefine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// codeSymbol names code that this package wrote to an arena.
+type codeSymbol struct {
+	addr uintptr
+	size int
+
+	// fn is the name of the function the code belongs to, and name is
+	// what tools show, which includes the kind of code.
+	fn, name string
+
+	// The entry registered with GDB, if any.
+	jit *jitCodeEntry
+}
+
+var (
+	// symbolsEnabled is set by EnableSymbols. It's checked before
+	// acquiring symbolsMu so nothing is done for code that won't be named,
+	// and checked again after.
+	symbolsEnabled atomic.Bool
+
+	// symbolsMu protects the variables below. It may be acquired while
+	// holding mu or an allocator's lock, so don't acquire those with it.
+	symbolsMu sync.Mutex
+
+	// symbols maps the start of every piece of code in the arenas to its
+	// name, while symbols are enabled.
+	symbols = map[uintptr]*codeSymbol{}
+
+	// perfMap is the open perf map file, or nil if symbols are disabled or
+	// writing to it failed. perfMapErr is why it failed.
+	perfMap    *os.File
+	perfMapErr error
+)
+
+// EnableSymbols names the code that this package writes outside of the
+// program, so profilers and debuggers show names instead of addresses. That
+// includes the copies of functions that Original and Clone run, prologues
+// moved by Func and Method, and trampolines. Names look like
+// "net/http.(*Client).Do [redefine copy]". Code written before EnableSymbols
+// isn't named.
+//
+// The code is listed in /tmp/perf-PID.map, which perf reads when it finds an
+// address that isn't in a binary. Lines are only appended to it, so entries
+// that another JIT in the process already wrote are kept, and when the
+// code is freed and something else is written at the same address, the later
+// line is the one that applies.
+//
+// Programs built with the redefine_gdb build tag also register the code with
+// GDB through its JIT interface, and unregister it when Restore frees it. The
+// interface needs the __jit_debug_descriptor and __jit_debug_register_code
+// symbols, which conflict with C libraries that define them too, such as LLVM.
+func EnableSymbols() error {
+	symbolsMu.Lock()
+	defer symbolsMu.Unlock()
+
+	if symbolsEnabled.Load() {
+		return nil
+	}
+
+	f, err := os.OpenFile(perfMapPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	perfMap, perfMapErr = f, nil
+	symbolsEnabled.Store(true)
+
+	return nil
+}
+
+// DisableSymbols undoes EnableSymbols. The code is unregistered from GDB, and
+// nothing more is written to the perf map. The file is left in place, since
+// perf reads it after the program exits, and it may have lines from other
+// JITs. It returns the error from writing the perf map, if there was one,
+// since EnableSymbols.
+func DisableSymbols() error {
+	symbolsMu.Lock()
+	defer symbolsMu.Unlock()
+
+	if !symbolsEnabled.Load() {
+		return nil
+	}
+	symbolsEnabled.Store(false)
+
+	for _, sym := range symbols {
+		unregisterJITCode(sym)
+	}
+	clear(symbols)
+
+	errs := []error{perfMapErr}
+	if perfMap != nil {
+		errs = append(errs, perfMap.Close())
+		perfMap = nil
+	}
+	perfMapErr = nil
+
+	return errors.Join(errs...)
+}
+
+// addSymbol names the code in buf, which is part of the function fn. kind says
+// what the code is, such as "copy" or "trampoline".
+func addSymbol(buf []byte, fn, kind string) {
+	if len(buf) == 0 || !symbolsEnabled.Load() {
+		return
+	}
+
+	sym := &codeSymbol{
+		addr: uintptr(unsafe.Pointer(unsafe.SliceData(buf))),
+		size: len(buf),
+		fn:   fn,
+		name: fmt.Sprintf("%s [redefine %s]", fn, kind),
+	}
+
+	symbolsMu.Lock()
+	defer symbolsMu.Unlock()
+
+	if !symbolsEnabled.Load() {
+		return
+	}
+
+	if old, ok := symbols[sym.addr]; ok {
+		unregisterJITCode(old)
+	}
+	symbols[sym.addr] = sym
+
+	registerJITCode(sym)
+	appendPerfMap(sym)
+}
+
+// dropSymbol removes the name of the code at addr, which is being freed.
+func dropSymbol(addr uintptr) {
+	if !symbolsEnabled.Load() {
+		return
+	}
+
+	symbolsMu.Lock()
+	defer symbolsMu.Unlock()
+
+	sym, ok := symbols[addr]
+	if !ok {
+		return
+	}
+	delete(symbols, addr)
+	unregisterJITCode(sym)
+}
+
+// symbolName returns the name of the function at addr, which may be in the
+// program or in an arena.
+func symbolName(addr uintptr) string {
+	if info := findfunc(addr); info._func != nil {
+		return funcName(info)
+	}
+
+	symbolsMu.Lock()
+	defer symbolsMu.Unlock()
+	if sym, ok := symbols[addr]; ok {
+		return sym.fn
+	}
+	return fmt.Sprintf("0x%x", addr)
+}
+
+func perfMapPath() string {
+	return fmt.Sprintf("/tmp/perf-%d.map", os.Getpid())
+}
+
+// appendPerfMap adds a line for sym to the perf map file, with the address and
+// size in hex, then the name. If the write fails, the file is closed and
+// nothing more is written to it.
+//
+// The caller must hold symbolsMu.
+func appendPerfMap(sym *codeSymbol) {
+	if perfMap == nil {
+		return
+	}
+
+	_, err := fmt.Fprintf(perfMap, "%x %x %s\n", sym.addr, sym.size, sym.name)
+	if err != nil {
+		perfMapErr = fmt.Errorf("writing %s: %w", perfMap.Name(), err)
+		perfMap.Close()
+		perfMap = nil
+	}
+}
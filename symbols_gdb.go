@@ -0,0 +1,214 @@
+//go:build redefine_gdb
+
+package redefine
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"runtime"
+	"unsafe"
+)
+
+// The GDB JIT interface, from "JIT Compilation Interface" in the GDB manual.
+// GDB puts a breakpoint on __jit_debug_register_code, and when it's called,
+// reads the entry in __jit_debug_descriptor that changed.
+const (
+	jitNoAction = iota
+	jitRegisterFn
+	jitUnregisterFn
+)
+
+type jitDescriptor struct {
+	version       uint32
+	actionFlag    uint32
+	relevantEntry uintptr
+	firstEntry    uintptr
+}
+
+type jitCodeEntry struct {
+	nextEntry, prevEntry uintptr
+	symfileAddr          uintptr
+	symfileSize          uint64
+
+	// The image symfileAddr points to. It's kept here because GDB reads
+	// it from memory the garbage collector doesn't know about.
+	symfile []byte
+}
+
+//go:linkname jitDebugDescriptor __jit_debug_descriptor
+var jitDebugDescriptor = jitDescriptor{version: 1}
+
+//go:linkname jitDebugRegisterCode __jit_debug_register_code
+//go:noinline
+func jitDebugRegisterCode() {
+	// GDB's breakpoint is all that's needed, but the call can't be
+	// optimized away.
+	runtime.KeepAlive(&jitDebugDescriptor)
+}
+
+// registerJITCode tells GDB about the code. The entries are kept in the
+// linked list GDB reads, newest first.
+//
+// The caller must hold symbolsMu.
+func registerJITCode(sym *codeSymbol) {
+	if sym.jit != nil {
+		return
+	}
+
+	entry := &jitCodeEntry{symfile: jitImage(sym)}
+	entry.symfileAddr = uintptr(unsafe.Pointer(unsafe.SliceData(entry.symfile)))
+	entry.symfileSize = uint64(len(entry.symfile))
+	sym.jit = entry
+
+	addr := uintptr(unsafe.Pointer(entry))
+	entry.nextEntry = jitDebugDescriptor.firstEntry
+	if first := jitEntryAt(jitDebugDescriptor.firstEntry); first != nil {
+		first.prevEntry = addr
+	}
+	jitDebugDescriptor.firstEntry = addr
+
+	jitDebugDescriptor.relevantEntry = addr
+	jitDebugDescriptor.actionFlag = jitRegisterFn
+	jitDebugRegisterCode()
+	jitDebugDescriptor.actionFlag = jitNoAction
+}
+
+// unregisterJITCode undoes registerJITCode.
+//
+// The caller must hold symbolsMu.
+func unregisterJITCode(sym *codeSymbol) {
+	entry := sym.jit
+	if entry == nil {
+		return
+	}
+	sym.jit = nil
+
+	if prev := jitEntryAt(entry.prevEntry); prev != nil {
+		prev.nextEntry = entry.nextEntry
+	} else {
+		jitDebugDescriptor.firstEntry = entry.nextEntry
+	}
+	if next := jitEntryAt(entry.nextEntry); next != nil {
+		next.prevEntry = entry.prevEntry
+	}
+
+	jitDebugDescriptor.relevantEntry = uintptr(unsafe.Pointer(entry))
+	jitDebugDescriptor.actionFlag = jitUnregisterFn
+	jitDebugRegisterCode()
+	jitDebugDescriptor.actionFlag = jitNoAction
+	jitDebugDescriptor.relevantEntry = 0
+}
+
+// jitEntryAt returns the entry at addr, which is in the list GDB reads. The
+// entries are kept alive by the symbols they belong to.
+//
+// The caller must hold symbolsMu.
+func jitEntryAt(addr uintptr) *jitCodeEntry {
+	if addr == 0 {
+		return nil
+	}
+	for _, sym := range symbols {
+		if sym.jit != nil && uintptr(unsafe.Pointer(sym.jit)) == addr {
+			return sym.jit
+		}
+	}
+	return nil
+}
+
+// jitImage returns an ELF object file for GDB that has one function, for the
+// code. The code isn't in the file, the .text section just says where it is.
+func jitImage(sym *codeSymbol) []byte {
+	const (
+		shstrtabIndex = 1
+		strtabIndex   = 2
+		symtabIndex   = 3
+		textIndex     = 4
+		numSections   = 5
+	)
+
+	shstrtab := []byte("\x00.shstrtab\x00.strtab\x00.symtab\x00.text\x00")
+	strtab := append([]byte{0}, sym.name...)
+	strtab = append(strtab, 0)
+
+	var symtab bytes.Buffer
+	binary.Write(&symtab, binary.LittleEndian, []elf.Sym64{
+		{},
+		{
+			Name:  1,
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC),
+			Shndx: textIndex,
+			Size:  uint64(sym.size),
+		},
+	})
+
+	headerSize := uint64(unsafe.Sizeof(elf.Header64{}))
+	shstrtabOff := headerSize
+	strtabOff := shstrtabOff + uint64(len(shstrtab))
+	symtabOff := (strtabOff + uint64(len(strtab)) + 7) &^ 7
+	sectionsOff := symtabOff + uint64(symtab.Len())
+
+	machine := elf.EM_X86_64
+	if runtime.GOARCH == "arm64" {
+		machine = elf.EM_AARCH64
+	}
+
+	var img bytes.Buffer
+	binary.Write(&img, binary.LittleEndian, elf.Header64{
+		Ident: [elf.EI_NIDENT]byte{
+			0x7f, 'E', 'L', 'F',
+			byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT),
+		},
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     sectionsOff,
+		Ehsize:    uint16(headerSize),
+		Shentsize: uint16(unsafe.Sizeof(elf.Section64{})),
+		Shnum:     numSections,
+		Shstrndx:  shstrtabIndex,
+	})
+	img.Write(shstrtab)
+	img.Write(strtab)
+	img.Write(make([]byte, symtabOff-uint64(img.Len())))
+	img.Write(symtab.Bytes())
+
+	binary.Write(&img, binary.LittleEndian, []elf.Section64{
+		{},
+		{
+			Name:      uint32(bytes.Index(shstrtab, []byte(".shstrtab"))),
+			Type:      uint32(elf.SHT_STRTAB),
+			Off:       shstrtabOff,
+			Size:      uint64(len(shstrtab)),
+			Addralign: 1,
+		},
+		{
+			Name:      uint32(bytes.Index(shstrtab, []byte(".strtab"))),
+			Type:      uint32(elf.SHT_STRTAB),
+			Off:       strtabOff,
+			Size:      uint64(len(strtab)),
+			Addralign: 1,
+		},
+		{
+			Name:      uint32(bytes.Index(shstrtab, []byte(".symtab"))),
+			Type:      uint32(elf.SHT_SYMTAB),
+			Off:       symtabOff,
+			Size:      uint64(symtab.Len()),
+			Link:      strtabIndex,
+			Info:      1, // The first global symbol.
+			Addralign: 8,
+			Entsize:   uint64(unsafe.Sizeof(elf.Sym64{})),
+		},
+		{
+			Name:      uint32(bytes.Index(shstrtab, []byte(".text"))),
+			Type:      uint32(elf.SHT_NOBITS),
+			Flags:     uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR),
+			Addr:      uint64(sym.addr),
+			Off:       sectionsOff,
+			Size:      uint64(sym.size),
+			Addralign: 1,
+		},
+	})
+
+	return img.Bytes()
+}
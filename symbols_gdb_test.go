@@ -0,0 +1,53 @@
+//go:build redefine_gdb
+
+package redefine
+
+import (
+	"bytes"
+	"debug/elf"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSymbols_GDB(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	enableSymbols(t)
+
+	const name = "github.com/pboyd/redefine.testSymbolsTarget [redefine copy]"
+
+	_, release, err := Clone(testSymbolsTarget)
+	require.NoError(err)
+	t.Cleanup(release)
+
+	symbolsMu.Lock()
+	var sym *codeSymbol
+	for _, s := range symbols {
+		if s.name == name {
+			sym = s
+		}
+	}
+	symbolsMu.Unlock()
+	require.NotNil(sym)
+	require.NotNil(sym.jit)
+	assert.NotZero(jitDebugDescriptor.firstEntry)
+
+	f, err := elf.NewFile(bytes.NewReader(sym.jit.symfile))
+	require.NoError(err)
+	text := f.Section(".text")
+	require.NotNil(text)
+	assert.Equal(uint64(sym.addr), text.Addr)
+	elfSyms, err := f.Symbols()
+	require.NoError(err)
+	if assert.Len(elfSyms, 1) {
+		assert.Equal(name, elfSyms[0].Name)
+		assert.Equal(elf.STT_FUNC, elf.ST_TYPE(elfSyms[0].Info))
+		assert.Equal(uint64(sym.size), elfSyms[0].Size)
+	}
+
+	require.NoError(DisableSymbols())
+	assert.Zero(jitDebugDescriptor.firstEntry)
+}
@@ -0,0 +1,12 @@
+//go:build !redefine_gdb
+
+package redefine
+
+// Without the redefine_gdb build tag, code isn't registered with GDB. See
+// EnableSymbols.
+
+type jitCodeEntry struct{}
+
+func registerJITCode(*codeSymbol) {}
+
+func unregisterJITCode(*codeSymbol) {}
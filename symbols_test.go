@@ -0,0 +1,143 @@
+package redefine
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//go:noinline
+func testSymbolsTarget(v int) int {
+	return v * 3
+}
+
+// enableSymbols enables symbols with an empty perf map, and disables them and
+// removes the perf map when the test ends.
+func enableSymbols(t *testing.T) {
+	t.Helper()
+
+	os.Remove(perfMapPath())
+	require.NoError(t, EnableSymbols())
+	t.Cleanup(func() {
+		DisableSymbols()
+		os.Remove(perfMapPath())
+	})
+}
+
+func TestSymbols(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Nothing is kept for code written while symbols are disabled.
+	_, release, err := Clone(testSymbolsTarget)
+	require.NoError(err)
+	symbolsMu.Lock()
+	assert.Empty(symbols)
+	symbolsMu.Unlock()
+	release()
+
+	enableSymbols(t)
+
+	const name = "github.com/pboyd/redefine.testSymbolsTarget [redefine copy]"
+
+	cloned, release, err := Clone(testSymbolsTarget)
+	require.NoError(err)
+	assert.Equal(6, cloned(2))
+
+	perfMap, err := os.ReadFile(perfMapPath())
+	require.NoError(err)
+	assert.Contains(string(perfMap), name)
+
+	symbolsMu.Lock()
+	assert.Len(symbols, 1)
+	symbolsMu.Unlock()
+
+	release()
+
+	symbolsMu.Lock()
+	assert.Empty(symbols)
+	symbolsMu.Unlock()
+
+	// Another copy appends to the file.
+	_, release, err = Clone(testSymbolsTarget)
+	require.NoError(err)
+	release()
+
+	perfMap, err = os.ReadFile(perfMapPath())
+	require.NoError(err)
+	assert.Equal(2, strings.Count(string(perfMap), name))
+
+	// The file stays for perf to read.
+	require.NoError(DisableSymbols())
+	perfMap, err = os.ReadFile(perfMapPath())
+	require.NoError(err)
+	assert.Equal(2, strings.Count(string(perfMap), name))
+}
+
+func TestSymbols_Func(t *testing.T) {
+	require := require.New(t)
+
+	enableSymbols(t)
+
+	require.NoError(Func(testSymbolsTarget, func(v int) int { return v + 1 }))
+	t.Cleanup(func() { Restore(testSymbolsTarget) })
+
+	perfMap, err := os.ReadFile(perfMapPath())
+	require.NoError(err)
+
+	// Depending on the function, Func either moves the prologue or makes
+	// a copy.
+	var found bool
+	for line := range strings.Lines(string(perfMap)) {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		require.Len(fields, 3, line)
+		found = found || strings.HasPrefix(fields[2], "github.com/pboyd/redefine.testSymbolsTarget [redefine ")
+	}
+	assert.True(t, found, string(perfMap))
+
+	require.NoError(Restore(testSymbolsTarget))
+	symbolsMu.Lock()
+	for _, sym := range symbols {
+		assert.NotContains(t, sym.name, "testSymbolsTarget")
+	}
+	symbolsMu.Unlock()
+}
+
+func TestSymbols_KeepsPerfMap(t *testing.T) {
+	require := require.New(t)
+
+	// Another JIT in the process wrote to the perf map first.
+	const other = "1000 10 other-jit-function\n"
+	require.NoError(os.WriteFile(perfMapPath(), []byte(other), 0o644))
+	t.Cleanup(func() { os.Remove(perfMapPath()) })
+
+	require.NoError(EnableSymbols())
+	t.Cleanup(func() { DisableSymbols() })
+
+	_, release, err := Clone(testSymbolsTarget)
+	require.NoError(err)
+	release()
+
+	perfMap, err := os.ReadFile(perfMapPath())
+	require.NoError(err)
+	assert.True(t, strings.HasPrefix(string(perfMap), other), string(perfMap))
+	assert.Contains(t, string(perfMap), "testSymbolsTarget [redefine copy]")
+}
+
+func TestSymbols_WriteError(t *testing.T) {
+	enableSymbols(t)
+
+	// Writing to a closed file fails.
+	symbolsMu.Lock()
+	perfMap.Close()
+	symbolsMu.Unlock()
+
+	_, release, err := Clone(testSymbolsTarget)
+	require.NoError(t, err)
+	release()
+
+	assert.ErrorContains(t, DisableSymbols(), "writing "+perfMapPath())
+}
@@ -13,6 +13,8 @@ const (
 	mprotectExec = syscall.PROT_EXEC
 	mprotectRX   = syscall.PROT_READ | syscall.PROT_EXEC
 	mprotectRWX  = syscall.PROT_READ | syscall.PROT_WRITE | syscall.PROT_EXEC
+	mprotectR    = syscall.PROT_READ
+	mprotectRW   = syscall.PROT_READ | syscall.PROT_WRITE
 )
 
 func mprotect(buf []byte, flags int) error {
@@ -28,3 +30,10 @@ func mprotect(buf []byte, flags int) error {
 
 	return unix.Mprotect(unsafe.Slice((*byte)(unsafe.Pointer(pageStart)), regionSize), flags)
 }
+
+// discardPages tells the OS the contents of buf are no longer needed, so the
+// memory can be reclaimed. The pages stay mapped and are refilled on the next
+// access.
+func discardPages(buf []byte) error {
+	return unix.Madvise(buf, unix.MADV_DONTNEED)
+}
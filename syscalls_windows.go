@@ -13,6 +13,8 @@ const (
 	mprotectExec = windows.PAGE_EXECUTE
 	mprotectRX   = windows.PAGE_EXECUTE_READ
 	mprotectRWX  = windows.PAGE_EXECUTE_READWRITE
+	mprotectR    = windows.PAGE_READONLY
+	mprotectRW   = windows.PAGE_READWRITE
 )
 
 func mprotect(buf []byte, flags int) error {
@@ -29,3 +31,12 @@ func mprotect(buf []byte, flags int) error {
 	var oldFlags uint32
 	return windows.VirtualProtect(pageStart, uintptr(regionSize), uint32(flags), &oldFlags)
 }
+
+// discardPages tells the OS the contents of buf are no longer needed, so it
+// can drop them instead of writing them to the page file. The pages stay
+// committed, and their contents are undefined until they're written again.
+func discardPages(buf []byte) error {
+	addr := uintptr(unsafe.Pointer(unsafe.SliceData(buf)))
+	_, err := windows.VirtualAlloc(addr, uintptr(len(buf)), windows.MEM_RESET, windows.PAGE_NOACCESS)
+	return err
+}
@@ -0,0 +1,113 @@
+// Command asmfunc redefines a function written in assembly, which Go code
+// calls both directly and through a function value. It's run by
+// TestFunc_Assembly.
+//
+// By default only the wrapper is redefined, so the direct calls still run the
+// assembly. With the ABI0Adapter option on amd64, they're redefined too.
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+
+	"github.com/pboyd/redefine"
+)
+
+// add is in add_amd64.s and add_arm64.s.
+func add(a, b int) int
+
+// addDirect calls the assembly with ABI0.
+//
+//go:noinline
+func addDirect(a, b int) int {
+	return add(a, b)
+}
+
+// sub runs a garbage collection and grows the stack, which the wrapper has
+// to allow.
+func sub(a, b int) int {
+	runtime.GC()
+	return a - b + deep(1000)
+}
+
+// deep recurses n times with a large frame, and returns 0.
+//
+//go:noinline
+func deep(n int) int {
+	var buf [128]byte
+	if n == 0 {
+		return 0
+	}
+	return deep(n-1) + int(buf[n%len(buf)])
+}
+
+// subSmall is small enough to run through an adapter.
+func subSmall(a, b int) int {
+	return a - b
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
+func run() error {
+	// Taking the value makes the compiler generate the ABIInternal
+	// wrapper.
+	addValue := add
+
+	if err := redefineAdd(addValue, sub, 8); err != nil {
+		return err
+	}
+
+	// Adapters aren't available elsewhere.
+	if runtime.GOARCH != "amd64" {
+		return nil
+	}
+	if err := redefineAdd(addValue, subSmall, 2, redefine.ABI0Adapter()); err != nil {
+		return fmt.Errorf("with ABI0Adapter: %w", err)
+	}
+	return nil
+}
+
+// redefineAdd redefines add with newFn and restores it. direct is what
+// addDirect(5, 3) should return in between.
+func redefineAdd(addValue, newFn func(a, b int) int, direct int, opts ...redefine.Option) error {
+	var unredirected []string
+	opts = append(opts, redefine.Unredirected(&unredirected))
+	if err := redefine.Func(add, newFn, opts...); err != nil {
+		return err
+	}
+	if got := addValue(5, 3); got != 2 {
+		return fmt.Errorf("through the wrapper: got %d, want 2", got)
+	}
+	if got := addDirect(5, 3); got != direct {
+		return fmt.Errorf("direct call: got %d, want %d", got, direct)
+	}
+	if slices.Contains(unredirected, "main.add") != (direct == 8) {
+		return fmt.Errorf("unredirected: %v", unredirected)
+	}
+	if got := redefine.Original(add)(5, 3); got != 8 {
+		return fmt.Errorf("original: got %d, want 8", got)
+	}
+	if err := redefine.Verify(); err != nil {
+		return err
+	}
+
+	if err := redefine.Restore(add); err != nil {
+		return err
+	}
+	if got := addValue(5, 3); got != 8 {
+		return fmt.Errorf("restored wrapper: got %d, want 8", got)
+	}
+	if got := addDirect(5, 3); got != 8 {
+		return fmt.Errorf("restored direct call: got %d, want 8", got)
+	}
+
+	return nil
+}
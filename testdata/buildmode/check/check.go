@@ -0,0 +1,77 @@
+// Package check exercises redefine from the programs built by TestBuildModes.
+package check
+
+import (
+	"fmt"
+
+	"github.com/pboyd/redefine"
+)
+
+//go:noinline
+func greet(name string) string {
+	return "hello " + name
+}
+
+type counter struct {
+	n int
+}
+
+//go:noinline
+func (c *counter) Inc() {
+	c.n++
+}
+
+type doubler counter
+
+func (d *doubler) Inc() {
+	d.n *= 2
+}
+
+// Run redefines a function and a method, calls the originals and restores
+// them.
+func Run() error {
+	err := redefine.Func(greet, func(name string) string {
+		return "goodbye " + name
+	})
+	if err != nil {
+		return fmt.Errorf("Func: %w", err)
+	}
+
+	if got := greet("world"); got != "goodbye world" {
+		return fmt.Errorf("redefined greet returned %q", got)
+	}
+	if got := redefine.Original(greet)("world"); got != "hello world" {
+		return fmt.Errorf("original greet returned %q", got)
+	}
+
+	err = redefine.Restore(greet)
+	if err != nil {
+		return fmt.Errorf("Restore: %w", err)
+	}
+	if got := greet("world"); got != "hello world" {
+		return fmt.Errorf("restored greet returned %q", got)
+	}
+
+	err = redefine.Method((*counter).Inc, (*doubler).Inc)
+	if err != nil {
+		return fmt.Errorf("Method: %w", err)
+	}
+
+	c := &counter{n: 1}
+	c.Inc()
+	redefine.Original((*counter).Inc)(c)
+	if c.n != 3 {
+		return fmt.Errorf("counter is %d after redefined and original Inc, expected 3", c.n)
+	}
+
+	err = redefine.Restore((*counter).Inc)
+	if err != nil {
+		return fmt.Errorf("Restore: %w", err)
+	}
+	c.Inc()
+	if c.n != 4 {
+		return fmt.Errorf("counter is %d after restored Inc, expected 4", c.n)
+	}
+
+	return nil
+}
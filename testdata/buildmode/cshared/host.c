@@ -0,0 +1,32 @@
+// Loads the library built from main.go and runs the checks.
+
+#include <dlfcn.h>
+#include <stdio.h>
+
+int main(int argc, char **argv) {
+	if (argc != 2) {
+		fprintf(stderr, "usage: %s library\n", argv[0]);
+		return 2;
+	}
+
+	void *lib = dlopen(argv[1], RTLD_NOW);
+	if (lib == NULL) {
+		fprintf(stderr, "%s\n", dlerror());
+		return 1;
+	}
+
+	char *(*run)(void) = (char *(*)(void))dlsym(lib, "RunCheck");
+	if (run == NULL) {
+		fprintf(stderr, "%s\n", dlerror());
+		return 1;
+	}
+
+	char *err = run();
+	if (err != NULL) {
+		fprintf(stderr, "%s\n", err);
+		return 1;
+	}
+
+	printf("ok\n");
+	return 0;
+}
@@ -0,0 +1,19 @@
+// Command cshared runs the checks from a shared library loaded by a C program
+// (host.c).
+package main
+
+import "C"
+
+import "github.com/pboyd/redefine/testdata/buildmode/check"
+
+// RunCheck returns an error message, or NULL if the checks passed.
+//
+//export RunCheck
+func RunCheck() *C.char {
+	if err := check.Run(); err != nil {
+		return C.CString(err.Error())
+	}
+	return nil
+}
+
+func main() {}
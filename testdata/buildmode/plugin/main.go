@@ -0,0 +1,14 @@
+// Package main is a plugin with a function for pluginhost to redefine.
+package main
+
+//go:noinline
+func Greet(name string) string {
+	return "hello " + name
+}
+
+// CallGreet calls Greet from inside the plugin.
+func CallGreet(name string) string {
+	return Greet(name)
+}
+
+func main() {}
@@ -0,0 +1,82 @@
+// Command pluginhost loads the plugin built from ../plugin, redefines a
+// function in it and runs the checks.
+package main
+
+import (
+	"fmt"
+	"os"
+	"plugin"
+	"reflect"
+
+	"github.com/pboyd/redefine"
+	"github.com/pboyd/redefine/testdata/buildmode/check"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s plugin\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	if err := run(os.Args[1]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
+func run(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+
+	sym, err := p.Lookup("Greet")
+	if err != nil {
+		return err
+	}
+	greet := sym.(func(string) string)
+
+	sym, err = p.Lookup("CallGreet")
+	if err != nil {
+		return err
+	}
+	callGreet := sym.(func(string) string)
+
+	// The plugin is a separate module, so this makes sure every module is
+	// searched.
+	found := false
+	for f := range redefine.Functions("") {
+		if f.Entry == reflect.ValueOf(greet).Pointer() {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("Functions didn't include Greet")
+	}
+
+	err = redefine.Func(greet, func(name string) string {
+		return "goodbye " + name
+	})
+	if err != nil {
+		return fmt.Errorf("Func: %w", err)
+	}
+
+	if got := callGreet("world"); got != "goodbye world" {
+		return fmt.Errorf("redefined Greet returned %q", got)
+	}
+	if got := redefine.Original(greet)("world"); got != "hello world" {
+		return fmt.Errorf("original Greet returned %q", got)
+	}
+
+	err = redefine.Restore(greet)
+	if err != nil {
+		return fmt.Errorf("Restore: %w", err)
+	}
+	if got := callGreet("world"); got != "hello world" {
+		return fmt.Errorf("restored Greet returned %q", got)
+	}
+
+	return check.Run()
+}
@@ -0,0 +1,18 @@
+// Command prog runs the checks in a normal program, for the exe and pie build
+// modes.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pboyd/redefine/testdata/buildmode/check"
+)
+
+func main() {
+	if err := check.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
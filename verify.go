@@ -0,0 +1,114 @@
+package redefine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// ErrTampered is wrapped by TamperError.
+var ErrTampered = errors.New("patched code was modified")
+
+// TamperError is returned when the code at the entry point of a redefined
+// function is no longer what this package wrote there. Something else, like
+// another patching library, has overwritten it.
+type TamperError struct {
+	// Name and Entry identify the function.
+	Name  string
+	Entry uintptr
+
+	// Offset is the distance from the entry point to the first byte that
+	// changed.
+	Offset int
+
+	// Want is what this package wrote from Offset to the last byte that
+	// changed, and Got is what's there now.
+	Want, Got []byte
+
+	// Target is where the function jumps now, if another patching library
+	// replaced the jump at the entry point. Otherwise it's 0.
+	Target uintptr
+}
+
+func (e *TamperError) Error() string {
+	msg := fmt.Sprintf("%s at 0x%x: %v at +0x%x: wrote %x, found %x", e.Name, e.Entry, ErrTampered, e.Offset, e.Want, e.Got)
+	if e.Target != 0 {
+		msg += fmt.Sprintf(", it now jumps to 0x%x", e.Target)
+	}
+	return msg
+}
+
+func (e *TamperError) Unwrap() error {
+	return ErrTampered
+}
+
+// Verify checks that every redefined function still has the code this package
+// wrote to it. The error joins a TamperError for every function that was
+// changed.
+func Verify() error {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var errs []error
+	for _, entry := range slices.Sorted(maps.Keys(redefined)) {
+		pc, ok := redefined[entry].(patchedCode)
+		if !ok {
+			continue
+		}
+
+		code, err := funcSliceAt(entry)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		err = verifyPatch(entry, code, pc)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// verifyPatch returns a TamperError if code, which starts at entry, isn't what
+// was written by the last patch.
+//
+// The caller must hold mu.
+func verifyPatch(entry uintptr, code []byte, pc patchedCode) error {
+	want := pc.written()
+	if want == nil || bytes.Equal(code, want) {
+		return nil
+	}
+
+	n := min(len(code), len(want))
+	start := 0
+	for start < n && code[start] == want[start] {
+		start++
+	}
+	end := n
+	for end > start && code[end-1] == want[end-1] {
+		end--
+	}
+
+	e := &TamperError{
+		Entry:  entry,
+		Offset: start,
+		Want:   bytes.Clone(want[start:end]),
+		Got:    bytes.Clone(code[start:end]),
+	}
+	if info := findfunc(entry); info._func != nil {
+		e.Name = funcName(info)
+	}
+	if fj, ok := decodeEntryJump(code); ok && start < fj.size {
+		e.Target = fj.target
+	}
+	return e
+}
+
+// written returns the code at the entry point after the last patch.
+func (cf *clonedFunc[T]) written() []byte {
+	return cf.patched
+}
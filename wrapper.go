@@ -0,0 +1,222 @@
+package redefine
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// The table of PCs to inlined calls, and the calls, from internal/abi.
+const (
+	pcdataInlTreeIndex = 2
+	funcdataInlTree    = 3
+)
+
+// inlinedCall mirrors runtime.inlinedCall.
+type inlinedCall struct {
+	funcID    uint8
+	_         [3]byte
+	nameOff   int32
+	parentPc  int32
+	startLine int32
+}
+
+// methodWrappers maps methods redefined by Method to the wrappers that were
+// redirected along with them.
+var methodWrappers = map[uintptr][]uintptr{}
+
+// methodWrapper is a compiler-generated function that runs a copy of a method.
+type methodWrapper struct {
+	name  string
+	entry uintptr
+}
+
+var (
+	wrapperIndexesMu sync.Mutex
+
+	// wrapperIndexes maps each module to its compiler-generated wrappers,
+	// by the names of the functions they inlined.
+	wrapperIndexes = map[*moduledata]map[string][]methodWrapper{}
+)
+
+// wrapperIndexFor returns the wrappers in datap by the functions they inlined,
+// indexing them the first time.
+func wrapperIndexFor(datap *moduledata) map[string][]methodWrapper {
+	wrapperIndexesMu.Lock()
+	defer wrapperIndexesMu.Unlock()
+
+	if idx, ok := wrapperIndexes[datap]; ok {
+		return idx
+	}
+
+	idx := map[string][]methodWrapper{}
+	for _, ft := range datap.ftab[:max(len(datap.ftab)-1, 0)] {
+		wi := funcInfo{
+			_func: (*_func)(unsafe.Pointer(&datap.pclntable[ft.funcoff])),
+			datap: datap,
+		}
+		if wi.funcID != funcIDWrapper {
+			continue
+		}
+
+		w := methodWrapper{
+			name:  funcName(wi),
+			entry: datap.text + uintptr(wi.entryOff),
+		}
+		for _, inlined := range inlinedFuncs(wi) {
+			idx[inlined] = append(idx[inlined], w)
+		}
+	}
+	wrapperIndexes[datap] = idx
+
+	return idx
+}
+
+// inlinedWrappers returns the compiler-generated wrappers, in every module,
+// that inlined the method at target. Wrappers that call it don't need to be
+// found, they run whatever is at target.
+func inlinedWrappers(target uintptr) []methodWrapper {
+	info := findfunc(target)
+	if info._func == nil {
+		return nil
+	}
+	name := funcName(info)
+	dot := strings.LastIndexByte(name, '.')
+	if dot < 0 || strings.ContainsRune(name, '[') {
+		return nil
+	}
+	suffix := name[dot:]
+
+	var wrappers []methodWrapper
+	for _, datap := range modules() {
+		for _, w := range wrapperIndexFor(datap)[name] {
+			if strings.HasSuffix(w.name, suffix) && w.name != name {
+				wrappers = append(wrappers, w)
+			}
+		}
+	}
+
+	return wrappers
+}
+
+// inlinedFuncs returns the names of the functions that were inlined into the
+// function, from its inlining tree.
+func inlinedFuncs(info funcInfo) []string {
+	if info.npcdata <= pcdataInlTreeIndex || info.nfuncdata <= funcdataInlTree {
+		return nil
+	}
+
+	// The tables follow the _func: npcdata offsets into pctab, then
+	// nfuncdata offsets from gofunc.
+	tables := unsafe.Add(unsafe.Pointer(info._func), unsafe.Sizeof(_func{}))
+	pcdata := *(*uint32)(unsafe.Add(tables, 4*pcdataInlTreeIndex))
+	funcdata := *(*uint32)(unsafe.Add(tables, 4*(uintptr(info.npcdata)+funcdataInlTree)))
+	if pcdata == 0 || funcdata == ^uint32(0) {
+		return nil
+	}
+	tree := unsafe.Pointer(pointerAt(info.datap.gofunc + uintptr(funcdata)))
+
+	var names []string
+	walkPCValue(info, pcdata, func(_ uint32, val int32) bool {
+		if val < 0 {
+			return true
+		}
+		call := (*inlinedCall)(unsafe.Add(tree, uintptr(val)*unsafe.Sizeof(inlinedCall{})))
+		if call.nameOff > 0 && int(call.nameOff) < len(info.datap.funcnametab) {
+			name := cstring(info.datap.funcnametab[call.nameOff:])
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// redirectWrappers sends the wrappers that inlined the method at target to the
+// matching wrappers of newFn, which replaced it. The ones that have no
+// matching wrapper are reported to the Unredirected option. The error is from
+// redefining a wrapper that has one, or from restoring any wrapper that was
+// redirected before and can't be now.
+//
+// Only the pointer wrapper for a method with a value receiver can be
+// redirected, since newFn has one too if it's a method. Wrappers for promoted
+// methods depend on the layout of the outer type.
+//
+// The caller must hold mu.
+func redirectWrappers(target, newFn uintptr, opts options) error {
+	wrappers := inlinedWrappers(target)
+	if len(wrappers) == 0 {
+		return nil
+	}
+
+	name := funcName(findfunc(target))
+	newName := funcName(findfunc(newFn))
+
+	previous := methodWrappers[target]
+
+	var redirected []uintptr
+	var unredirected []string
+	var errs []error
+	for _, w := range wrappers {
+		var dest uintptr
+		ok := false
+		if ptrName := pointerMethodName(name); ptrName != "" && w.name == ptrName {
+			dest, ok = funcByName(pointerMethodName(newName))
+		}
+		if ok {
+			err := unsafeFuncLocked(funcAt(w.entry), funcAt(dest), false, opts)
+			if err == nil {
+				redirected = append(redirected, w.entry)
+				continue
+			}
+			errs = append(errs, fmt.Errorf("redirect %s: %w", w.name, err))
+		} else {
+			unredirected = append(unredirected, w.name)
+		}
+
+		// It may still go to a function that replaced the method before.
+		if slices.Contains(previous, w.entry) {
+			err := restoreLocked(w.entry)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("restore %s: %w", w.name, err))
+			}
+		}
+	}
+
+	entries := slices.DeleteFunc(slices.Clone(previous), func(entry uintptr) bool {
+		_, ok := redefined[entry]
+		return !ok
+	})
+	for _, entry := range redirected {
+		if !slices.Contains(entries, entry) {
+			entries = append(entries, entry)
+		}
+	}
+	methodWrappers[target] = entries
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	opts.reportUnredirected(unredirected...)
+	return nil
+}
+
+// pointerMethodName returns the name of the wrapper the compiler writes for
+// calling a method with a value receiver through a pointer. For example, it
+// returns "bytes.(*Reader).Len" for "bytes.Reader.Len". It returns "" if name
+// isn't a method with a value receiver.
+func pointerMethodName(name string) string {
+	pkg := funcPackage(name)
+	if len(name) <= len(pkg) {
+		return ""
+	}
+	recv, method, ok := strings.Cut(name[len(pkg)+1:], ".")
+	if !ok || recv == "" || recv[0] == '(' || strings.Contains(method, ".") {
+		return ""
+	}
+	return pkg + ".(*" + recv + ")." + method
+}
@@ -0,0 +1,95 @@
+package redefine
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type wrapperTarget struct {
+	a, b, c int
+}
+
+// Small enough to be inlined into the wrappers.
+func (w wrapperTarget) Sum() int {
+	return w.a*3 + w.b*5 + w.c*7
+}
+
+type wrapperFake wrapperTarget
+
+func (w wrapperFake) Sum() int {
+	return -w.a
+}
+
+type wrapperOuter struct {
+	wrapperTarget
+}
+
+type summer interface {
+	Sum() int
+}
+
+// asSummer keeps the compiler from devirtualizing calls.
+//
+//go:noinline
+func asSummer(s summer) summer {
+	return s
+}
+
+func TestMethod_Wrappers(t *testing.T) {
+	fake := asSummer(&wrapperFake{a: 1})
+	target := asSummer(&wrapperTarget{1, 1, 1})
+	outer := asSummer(&wrapperOuter{wrapperTarget{1, 1, 1}})
+	require.Equal(t, -1, fake.Sum())
+	require.Equal(t, 15, target.Sum())
+	require.Equal(t, 15, outer.Sum())
+
+	var unredirected []string
+	require.NoError(t, Method(wrapperTarget.Sum, wrapperFake.Sum, Unredirected(&unredirected)))
+	t.Cleanup(func() { Restore(wrapperTarget.Sum) })
+
+	// The wrapper for the embedding type can't be redirected.
+	assert.Contains(t, unredirected, "github.com/pboyd/redefine.(*wrapperOuter).Sum")
+	assert.NotContains(t, unredirected, "github.com/pboyd/redefine.(*wrapperTarget).Sum")
+
+	assert.Equal(t, -1, target.Sum())
+	assert.Equal(t, -1, (*wrapperTarget).Sum(&wrapperTarget{1, 1, 1}))
+	assert.Equal(t, 15, outer.Sum())
+
+	require.NoError(t, Restore(wrapperTarget.Sum))
+	assert.Equal(t, 15, target.Sum())
+	assert.Equal(t, 15, (*wrapperTarget).Sum(&wrapperTarget{1, 1, 1}))
+}
+
+func TestPointerMethodName(t *testing.T) {
+	assert.Equal(t, "bytes.(*Reader).Len", pointerMethodName("bytes.Reader.Len"))
+	assert.Equal(t, "a/b%2ec.(*T).M", pointerMethodName("a/b%2ec.T.M"))
+	assert.Equal(t, "", pointerMethodName("bytes.(*Reader).Read"))
+	assert.Equal(t, "", pointerMethodName("bytes.NewReader"))
+}
+
+func TestInlinedWrappers(t *testing.T) {
+	name := "github.com/pboyd/redefine.wrapperTarget.Sum"
+	entry, ok := funcByName(name)
+	require.True(t, ok)
+
+	var names []string
+	for _, w := range inlinedWrappers(entry) {
+		names = append(names, w.name)
+	}
+	assert.Contains(t, names, "github.com/pboyd/redefine.(*wrapperOuter).Sum")
+	assert.NotContains(t, names, name)
+
+	// The index is built once for each module.
+	datap := findfunc(entry).datap
+	wrapperIndexesMu.Lock()
+	idx := wrapperIndexes[datap]
+	wrapperIndexesMu.Unlock()
+	require.NotNil(t, idx)
+	inlinedWrappers(entry)
+	wrapperIndexesMu.Lock()
+	assert.Equal(t, reflect.ValueOf(idx).UnsafePointer(), reflect.ValueOf(wrapperIndexes[datap]).UnsafePointer())
+	wrapperIndexesMu.Unlock()
+}